@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	fileSystem "manic-compression/pkg/file_system"
+)
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// manic-import uploads a local directory tree into a container, skipping files that are
+// already stored with the same checksum. storage is configured from the same environment
+// as manic-server (STORAGE_BACKEND, MANIC_KEYFILE, ...)
+func main() {
+	dir := flag.String("dir", "", "local directory to import (required)")
+	container := flag.String("container", os.Getenv("INPUT_CONTAINER_NAME"), "destination container, defaults to INPUT_CONTAINER_NAME")
+	include := flag.String("include", "", "comma separated globs, only matching files are imported")
+	exclude := flag.String("exclude", "", "comma separated globs of files to leave out")
+	prefix := flag.String("prefix", "", "prefix prepended to each blob name")
+	clientID := flag.String("client", "", "clientID whose key encrypts the files")
+	concurrency := flag.Int("concurrency", 4, "number of parallel uploads, at most 16")
+	formats := flag.String("formats", os.Getenv("ALLOWED_AUDIO_FORMATS"), "comma separated audio formats files have to be, defaults to ALLOWED_AUDIO_FORMATS or all")
+	flag.Parse()
+
+	if *dir == "" || *container == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *formats == "" {
+		*formats = strings.Join(audioTypes.AllFormats, ",")
+	}
+	allowedFormats, err := audioTypes.ParseFormats(*formats)
+	if err != nil {
+		log.Fatalf("invalid formats: %v", err)
+	}
+
+	backend, err := fileSystem.NewBackendFromEnv()
+	if err != nil {
+		log.Fatalf("could not create storage backend: %v", err)
+	}
+	fs := &fileSystem.FileSystem{Backend: backend, ContainerName: *container}
+
+	if keyFile := os.Getenv("MANIC_KEYFILE"); keyFile != "" {
+		keyRing, err := fileSystem.LoadKeyRing(keyFile)
+		if err != nil {
+			log.Fatalf("could not load keyfile: %v", err)
+		}
+		fs.KeyRing = keyRing
+	}
+
+	opts := fileSystem.ImportOptions{
+		Directory:      *dir,
+		Include:        splitList(*include),
+		Exclude:        splitList(*exclude),
+		Prefix:         *prefix,
+		ClientID:       *clientID,
+		Concurrency:    *concurrency,
+		AllowedFormats: allowedFormats,
+	}
+
+	done := 0
+	report, err := fs.Import(context.Background(), opts, func(event fileSystem.ImportEvent) {
+		if event.Status == "" {
+			fmt.Printf("importing %d files into %s\n", event.Total, *container)
+			return
+		}
+		done++
+		if event.Err != nil {
+			fmt.Printf("[%d/%d] %s %s: %v\n", done, event.Total, event.Status, event.Path, event.Err)
+			return
+		}
+		fmt.Printf("[%d/%d] %s %s -> %s\n", done, event.Total, event.Status, event.Path, event.BlobName)
+	})
+	if err != nil {
+		log.Fatalf("import failed: %v", err)
+	}
+
+	fmt.Printf("%d uploaded, %d skipped, %d failed\n", len(report.Uploaded), len(report.Skipped), len(report.Failures))
+	if len(report.Failures) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+// the queues used by manic-server and the functions, reported by stats when no queue is given
+var knownQueues = []string{
+	"audiotasks",
+	"audiotaskresults",
+	"audiotasks-high",
+	"audiotasks-normal",
+	"audiotasks-low",
+}
+
+const usage = `manic-queue inspects and administers the message queues. the broker is configured from the
+same environment as manic-server (MESSAGE_BROKER, AZURE_SERVICEBUS_CONNECTION_STRING, NATS_URL)
+
+usage: manic-queue <command> [flags]
+
+commands:
+  send                 send a message, the payload is the argument or stdin
+  peek                 list messages without receiving them
+  receive              receive and complete messages
+  stats                message counts of the queues
+  purge                delete the active messages of a queue
+  deadletter list      list dead lettered messages
+  deadletter resubmit  move dead lettered messages back onto the queue
+  deadletter purge     delete dead lettered messages
+  tail                 print messages as they arrive, without receiving them
+
+run manic-queue <command> -h for the flags of a command
+`
+
+const defaultQueue = "audiotasks"
+
+type command func(ctx context.Context, bus serviceBus.Broker, args []string) error
+
+var commands = map[string]command{
+	"send":    send,
+	"peek":    peek,
+	"receive": receive,
+	"stats":   stats,
+	"purge":   purge,
+	"tail":    tail,
+}
+
+var deadLetterCommands = map[string]command{
+	"list":     listDeadLetters,
+	"resubmit": resubmitDeadLetters,
+	"purge":    purgeDeadLetters,
+}
+
+func main() {
+	log.SetFlags(0)
+	args := os.Args[1:]
+	if len(args) == 0 || args[0] == "-h" || args[0] == "help" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	run, args, err := lookupCommand(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n%s", err, usage)
+		os.Exit(2)
+	}
+
+	bus, err := serviceBus.NewBrokerFromEnv()
+	if err != nil {
+		log.Fatalf("could not create broker: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = run(ctx, bus, args)
+	stop()
+	bus.Close(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// lookupCommand finds the command named by the first arguments, "deadletter" takes a subcommand,
+// and returns it with the arguments left for its flags
+func lookupCommand(args []string) (command, []string, error) {
+	name, args := args[0], args[1:]
+	run, ok := commands[name]
+	if name == "deadletter" && len(args) > 0 {
+		name += " " + args[0]
+		run, ok = deadLetterCommands[args[0]]
+		args = args[1:]
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown command %q", name)
+	}
+	return run, args, nil
+}
+
+// options are the flags shared by the commands
+type options struct {
+	queue string
+	json  bool
+}
+
+func newFlagSet(name string, queue string, opts *options) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&opts.queue, "queue", queue, "queue name")
+	flags.BoolVar(&opts.json, "json", false, "print JSON instead of text")
+	return flags
+}
+
+func send(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("send", defaultQueue, &opts)
+	msgType := flags.String("type", string(serviceBus.MessageProcessAudio), "message type")
+	sessionID := flags.String("session", "", "session ID, required by the lane queues")
+	messageID := flags.String("id", "", "message ID, used by duplicate detection")
+	at := flags.String("at", "", "RFC 3339 time to schedule the message for")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: manic-queue send [flags] [payload], the JSON payload is read from stdin when left out")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var payload []byte
+	if flags.NArg() > 0 {
+		payload = []byte(flags.Arg(0))
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("could not read payload: %w", err)
+		}
+		payload = data
+	}
+	msg, err := newMsg(serviceBus.MessageType(*msgType), payload)
+	if err != nil {
+		return err
+	}
+	msg.SessionID, msg.MessageID = *sessionID, *messageID
+
+	if *at != "" {
+		scheduledAt, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("invalid -at: %w", err)
+		}
+		sequenceNumbers, errs, err := bus.ScheduleMessages([]serviceBus.Msg{msg}, opts.queue, scheduledAt)
+		if err == nil && errs[0] != nil {
+			err = errs[0]
+		}
+		if err != nil {
+			return fmt.Errorf("could not schedule message: %w", err)
+		}
+		return printSent(opts, msg, sequenceNumbers[0])
+	}
+	if err := bus.SendMessage(msg, opts.queue); err != nil {
+		return fmt.Errorf("could not send message: %w", err)
+	}
+	return printSent(opts, msg, 0)
+}
+
+func peek(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("peek", defaultQueue, &opts)
+	from := flags.Int64("from", 0, "sequence number to start at")
+	max := flags.Int("max", 50, "maximum number of messages")
+	sessionID := flags.String("session", "", "session to peek, required for the lane queues on Service Bus")
+	flags.Parse(args)
+
+	messages, err := bus.Peek(opts.queue, serviceBus.PeekOptions{FromSequenceNumber: *from, Max: *max, SessionID: *sessionID})
+	if err != nil {
+		return err
+	}
+	return printPeeked(opts, messages)
+}
+
+func receive(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("receive", defaultQueue, &opts)
+	max := flags.Int("max", 1, "maximum number of messages")
+	wait := flags.Duration("wait", 5*time.Second, "how long to wait for messages")
+	sessionID := flags.String("session", "", "session to receive from, required for the lane queues")
+	flags.Parse(args)
+
+	var deliveries []serviceBus.Delivery
+	var err error
+	handle := func(delivery serviceBus.Delivery) error {
+		deliveries = append(deliveries, delivery)
+		return nil
+	}
+	if *sessionID != "" {
+		err = bus.ReceiveSession(ctx, opts.queue, *sessionID, *max, *wait, handle)
+	} else {
+		err = bus.Receive(ctx, opts.queue, *max, *wait, handle)
+	}
+	if err != nil {
+		return err
+	}
+	return printDeliveries(opts, deliveries)
+}
+
+func stats(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("stats", "", &opts)
+	flags.Lookup("queue").Usage = "comma separated queue names, all known queues when left out"
+	flags.Parse(args)
+
+	queues := knownQueues
+	if opts.queue != "" {
+		queues = splitList(opts.queue)
+	}
+	// a queue that is missing or can't be read is reported and skipped, the others are still printed
+	all := []serviceBus.QueueStats{}
+	failed := 0
+	for _, queue := range queues {
+		queueStats, err := bus.QueueStats(queue)
+		if err != nil {
+			fmt.Fprintf(stderr, "could not get stats of %s: %v\n", queue, err)
+			failed++
+			continue
+		}
+		all = append(all, queueStats)
+	}
+	if err := printStats(opts, all); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not get stats of %d of %d queues", failed, len(queues))
+	}
+	return nil
+}
+
+func purge(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("purge", defaultQueue, &opts)
+	flags.Parse(args)
+
+	if err := bus.ClearQueue(opts.queue); err != nil {
+		return err
+	}
+	return printPurged(opts)
+}
+
+func listDeadLetters(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("deadletter list", defaultQueue, &opts)
+	max := flags.Int("max", 100, "maximum number of messages")
+	flags.Parse(args)
+
+	deadLetters, err := bus.PeekDeadLetters(opts.queue, *max)
+	if err != nil {
+		return err
+	}
+	return printDeadLetters(opts, deadLetters)
+}
+
+// deadLetterFilter adds the flags selecting dead lettered messages, the returned function reads them
+func deadLetterFilter(flags *flag.FlagSet) func() (serviceBus.DeadLetterFilter, error) {
+	sequenceNumbers := flags.String("seq", "", "comma separated sequence numbers")
+	reason := flags.String("reason", "", "dead letter reason")
+	olderThan := flags.Duration("older-than", 0, "only messages enqueued at least this long ago, e.g. 72h")
+	all := flags.Bool("all", false, "select every message when no other filter is given")
+
+	return func() (serviceBus.DeadLetterFilter, error) {
+		filter := serviceBus.DeadLetterFilter{Reason: *reason, OlderThan: *olderThan}
+		for _, item := range splitList(*sequenceNumbers) {
+			n, err := strconv.ParseInt(item, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid sequence number %q", item)
+			}
+			filter.SequenceNumbers = append(filter.SequenceNumbers, n)
+		}
+		if filter.IsZero() && !*all {
+			return filter, fmt.Errorf("select messages with -seq, -reason or -older-than, or pass -all")
+		}
+		return filter, nil
+	}
+}
+
+func resubmitDeadLetters(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("deadletter resubmit", defaultQueue, &opts)
+	readFilter := deadLetterFilter(flags)
+	flags.Parse(args)
+
+	filter, err := readFilter()
+	if err != nil {
+		return err
+	}
+	resubmitted, err := bus.ResubmitDeadLetters(opts.queue, filter)
+	printSequenceNumbers(opts, "resubmitted", resubmitted)
+	return err
+}
+
+func purgeDeadLetters(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("deadletter purge", defaultQueue, &opts)
+	readFilter := deadLetterFilter(flags)
+	flags.Parse(args)
+
+	filter, err := readFilter()
+	if err != nil {
+		return err
+	}
+	purged, err := bus.PurgeDeadLetters(opts.queue, filter)
+	printSequenceNumbers(opts, "purged", purged)
+	return err
+}
+
+// tail polls the queue with Peek and prints the messages enqueued since the last poll, until interrupted
+func tail(ctx context.Context, bus serviceBus.Broker, args []string) error {
+	var opts options
+	flags := newFlagSet("tail", defaultQueue, &opts)
+	interval := flags.Duration("interval", 2*time.Second, "how often to poll the queue")
+	sessionID := flags.String("session", "", "session to follow, required for the lane queues on Service Bus")
+	all := flags.Bool("all", false, "start with the messages already in the queue")
+	flags.Parse(args)
+
+	peekOptions := serviceBus.PeekOptions{SessionID: *sessionID}
+	if !*all {
+		// skip to the end of the queue
+		for {
+			messages, err := bus.Peek(opts.queue, peekOptions)
+			if err != nil {
+				return err
+			}
+			if len(messages) == 0 {
+				break
+			}
+			peekOptions.FromSequenceNumber = messages[len(messages)-1].SequenceNumber + 1
+		}
+	}
+
+	for {
+		messages, err := bus.Peek(opts.queue, peekOptions)
+		if err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			if err := printTail(opts, messages); err != nil {
+				return err
+			}
+			peekOptions.FromSequenceNumber = messages[len(messages)-1].SequenceNumber + 1
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+const testTask = `{"taskID": "t1", "clientID": "client", "inputFile": "a.wav", "status": "Queued"}`
+
+func newTestBroker(t *testing.T) *serviceBus.MemoryBroker {
+	t.Helper()
+	bus := serviceBus.NewMemoryBroker()
+	t.Cleanup(func() { bus.Close(context.Background()) })
+	return bus
+}
+
+// runCommand runs a command line against bus and returns what it printed to stdout and stderr
+func runCommand(t *testing.T, bus serviceBus.Broker, args ...string) (string, string, error) {
+	t.Helper()
+	return run(t, bus, nil, args)
+}
+
+// run looks up the command in args and runs it with flags ahead of its own arguments
+func run(t *testing.T, bus serviceBus.Broker, flags, args []string) (string, string, error) {
+	t.Helper()
+	cmd, args, err := lookupCommand(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args = append(flags, args...)
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	prevOut, prevErr := stdout, stderr
+	stdout, stderr = out, errOut
+	t.Cleanup(func() { stdout, stderr = prevOut, prevErr })
+	err = cmd(context.Background(), bus, args)
+	return out.String(), errOut.String(), err
+}
+
+// runJSON runs a command with -json and decodes its output into v
+func runJSON(t *testing.T, bus serviceBus.Broker, v any, args ...string) {
+	t.Helper()
+	out, _, err := run(t, bus, []string{"-json"}, args)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		t.Fatalf("%s printed %q: %v", strings.Join(args, " "), out, err)
+	}
+}
+
+func TestLookupCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		rest int
+		ok   bool
+	}{
+		{[]string{"stats"}, 0, true},
+		{[]string{"peek", "-queue", "x"}, 2, true},
+		{[]string{"deadletter", "list", "-json"}, 1, true},
+		{[]string{"deadletter"}, 0, false},
+		{[]string{"deadletter", "nope"}, 0, false},
+		{[]string{"nope"}, 0, false},
+	} {
+		run, rest, err := lookupCommand(tc.args)
+		if tc.ok != (err == nil) || tc.ok && (run == nil || len(rest) != tc.rest) {
+			t.Errorf("lookupCommand(%v) returned %d args, %v", tc.args, len(rest), err)
+		}
+	}
+}
+
+func TestSendPeekReceiveJSON(t *testing.T) {
+	bus := newTestBroker(t)
+
+	var sent sentMessage
+	runJSON(t, bus, &sent, "send", "-id", "m1", testTask)
+	if sent.Queue != defaultQueue || sent.Msg.CorrelationID != "t1" {
+		t.Errorf("sent %+v", sent)
+	}
+
+	var peeked []serviceBus.PeekedMessage
+	runJSON(t, bus, &peeked, "peek")
+	if len(peeked) != 1 || peeked[0].MessageID != "m1" || peeked[0].Task == nil || peeked[0].Task.InputFile != "a.wav" {
+		t.Fatalf("peeked %+v", peeked)
+	}
+
+	var received []receivedMessage
+	runJSON(t, bus, &received, "receive", "-wait", "0")
+	if len(received) != 1 || received[0].Task == nil || received[0].Task.TaskID != "t1" {
+		t.Errorf("received %+v", received)
+	}
+
+	var stats []serviceBus.QueueStats
+	runJSON(t, bus, &stats, "stats", "-queue", defaultQueue)
+	if len(stats) != 1 || stats[0].ActiveMessages != 0 {
+		t.Errorf("stats %+v after receiving the message", stats)
+	}
+}
+
+func TestDeadLetterCommands(t *testing.T) {
+	bus := newTestBroker(t)
+	if _, _, err := runCommand(t, bus, "send", testTask); err != nil {
+		t.Fatal(err)
+	}
+	err := bus.Receive(context.Background(), defaultQueue, 1, 0, func(serviceBus.Delivery) error {
+		return serviceBus.DeadLetter("bad task", "for the test")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deadLetters []serviceBus.DeadLetteredMessage
+	runJSON(t, bus, &deadLetters, "deadletter", "list")
+	if len(deadLetters) != 1 || deadLetters[0].Reason != "bad task" || deadLetters[0].Task == nil {
+		t.Fatalf("dead letters %+v", deadLetters)
+	}
+
+	if _, _, err := runCommand(t, bus, "deadletter", "resubmit"); err == nil {
+		t.Error("resubmit without a filter was accepted")
+	}
+	var resubmitted struct {
+		Resubmitted []int64 `json:"resubmitted"`
+	}
+	runJSON(t, bus, &resubmitted, "deadletter", "resubmit", "-all")
+	if len(resubmitted.Resubmitted) != 1 {
+		t.Errorf("resubmitted %v", resubmitted)
+	}
+	var stats []serviceBus.QueueStats
+	runJSON(t, bus, &stats, "stats", "-queue", defaultQueue)
+	if len(stats) != 1 || stats[0].ActiveMessages != 1 || stats[0].DeadLetterMessages != 0 {
+		t.Errorf("stats %+v after the resubmit", stats)
+	}
+}
+
+// missingQueueBroker fails the stats of one queue, like Service Bus does for a queue that doesn't exist
+type missingQueueBroker struct {
+	serviceBus.Broker
+	missing string
+}
+
+func (b missingQueueBroker) QueueStats(queue string) (serviceBus.QueueStats, error) {
+	if queue == b.missing {
+		return serviceBus.QueueStats{}, errors.New("queue not found")
+	}
+	return b.Broker.QueueStats(queue)
+}
+
+func TestStatsSkipsMissingQueues(t *testing.T) {
+	bus := missingQueueBroker{Broker: newTestBroker(t), missing: "audiotasks-low"}
+	out, errOut, err := runCommand(t, bus, "stats", "-json")
+	if err == nil {
+		t.Error("a missing queue wasn't reported")
+	}
+	if !strings.Contains(errOut, "audiotasks-low") {
+		t.Errorf("stderr %q doesn't name the missing queue", errOut)
+	}
+	var stats []serviceBus.QueueStats
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != len(knownQueues)-1 {
+		t.Errorf("printed the stats of %d queues, want %d", len(stats), len(knownQueues)-1)
+	}
+}
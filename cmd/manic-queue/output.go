@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+// maxContentLength truncates payloads that aren't audio tasks in the text output
+const maxContentLength = 80
+
+// stdout and stderr are where the commands print, replaced by the tests
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// newMsg wraps payload, which has to be JSON, in a message of the given type
+func newMsg(msgType serviceBus.MessageType, payload []byte) (serviceBus.Msg, error) {
+	payload = []byte(strings.TrimSpace(string(payload)))
+	if !json.Valid(payload) {
+		return serviceBus.Msg{}, fmt.Errorf("payload is not valid JSON")
+	}
+	msg, err := serviceBus.NewMsg(msgType, json.RawMessage(payload))
+	if err != nil {
+		return msg, err
+	}
+	// a task keeps its ID as the correlation ID, like the tasks sent by manic-server
+	if task := decodeTask(msg); task != nil && task.TaskID != "" {
+		msg.CorrelationID = task.TaskID
+	}
+	return msg, nil
+}
+
+// decodeTask returns the audio task carried by msg, nil for other payloads
+func decodeTask(msg serviceBus.Msg) *audioTypes.AudioTask {
+	if !msg.Type.Known() {
+		return nil
+	}
+	var task audioTypes.AudioTask
+	if err := msg.DecodePayload(&task); err != nil {
+		return nil
+	}
+	return &task
+}
+
+// describe summarizes a message in one line, audio tasks by their fields and anything else by its payload
+func describe(msg *serviceBus.Msg, task *audioTypes.AudioTask, body string) string {
+	if msg == nil {
+		return "unreadable body: " + truncate(body)
+	}
+	if task == nil {
+		return fmt.Sprintf("%s %s", msg.Type, truncate(msg.Content))
+	}
+	summary := fmt.Sprintf("%s task %s %s %s", msg.Type, task.TaskID, task.Status, task.InputFile)
+	if len(task.AudioFunctionPipeline) > 0 {
+		summary += " [" + strings.Join(task.AudioFunctionPipeline, ", ") + "]"
+	}
+	if task.Error != "" {
+		summary += fmt.Sprintf(" failed at %s: %s", task.FailedStep, task.Error)
+	}
+	return summary
+}
+
+func truncate(s string) string {
+	if len(s) <= maxContentLength {
+		return s
+	}
+	return s[:maxContentLength-3] + "..."
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+}
+
+type sentMessage struct {
+	Queue          string         `json:"queue"`
+	SequenceNumber int64          `json:"sequenceNumber,omitempty"` // only known for scheduled messages
+	Msg            serviceBus.Msg `json:"msg"`
+}
+
+func printSent(opts options, msg serviceBus.Msg, sequenceNumber int64) error {
+	if opts.json {
+		return printJSON(sentMessage{Queue: opts.queue, SequenceNumber: sequenceNumber, Msg: msg})
+	}
+	if sequenceNumber != 0 {
+		fmt.Fprintf(stdout, "scheduled %s on %s as sequence number %d\n", msg.ID, opts.queue, sequenceNumber)
+		return nil
+	}
+	fmt.Fprintf(stdout, "sent %s to %s\n", msg.ID, opts.queue)
+	return nil
+}
+
+func printPeeked(opts options, messages []serviceBus.PeekedMessage) error {
+	if opts.json {
+		return printJSON(messages)
+	}
+	if len(messages) == 0 {
+		fmt.Fprintf(stdout, "no messages in %s\n", opts.queue)
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "SEQ\tSTATE\tENQUEUED\tDELIVERIES\tSESSION\tMESSAGE")
+	printPeekedRows(table, messages)
+	return table.Flush()
+}
+
+// printTail prints messages as tail finds them, one JSON object per line with -json
+func printTail(opts options, messages []serviceBus.PeekedMessage) error {
+	if opts.json {
+		encoder := json.NewEncoder(stdout)
+		for _, message := range messages {
+			if err := encoder.Encode(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	table := newTable()
+	printPeekedRows(table, messages)
+	return table.Flush()
+}
+
+func printPeekedRows(table *tabwriter.Writer, messages []serviceBus.PeekedMessage) {
+	for _, message := range messages {
+		state := message.State
+		if message.ScheduledAt != nil && state == serviceBus.MessageScheduled {
+			state += " for " + formatTime(*message.ScheduledAt)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%d\t%s\t%s\n", message.SequenceNumber, state, formatTime(message.EnqueuedAt),
+			message.DeliveryCount, orDash(message.SessionID), describe(message.Msg, message.Task, message.Body))
+	}
+}
+
+type receivedMessage struct {
+	MessageID     string                `json:"messageID"`
+	SessionID     string                `json:"sessionID,omitempty"`
+	DeliveryCount uint32                `json:"deliveryCount"`
+	Msg           serviceBus.Msg        `json:"msg"`
+	Task          *audioTypes.AudioTask `json:"task,omitempty"`
+}
+
+func printDeliveries(opts options, deliveries []serviceBus.Delivery) error {
+	received := []receivedMessage{}
+	for _, delivery := range deliveries {
+		received = append(received, receivedMessage{
+			MessageID:     delivery.MessageID,
+			SessionID:     delivery.Msg.SessionID,
+			DeliveryCount: delivery.DeliveryCount,
+			Msg:           delivery.Msg,
+			Task:          decodeTask(delivery.Msg),
+		})
+	}
+	if opts.json {
+		return printJSON(received)
+	}
+	if len(received) == 0 {
+		fmt.Fprintf(stdout, "no messages received from %s\n", opts.queue)
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "MESSAGE ID\tDELIVERIES\tSESSION\tMESSAGE")
+	for _, message := range received {
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", message.MessageID, message.DeliveryCount, orDash(message.SessionID),
+			describe(&message.Msg, message.Task, ""))
+	}
+	return table.Flush()
+}
+
+func printStats(opts options, stats []serviceBus.QueueStats) error {
+	if opts.json {
+		return printJSON(stats)
+	}
+	table := newTable()
+	fmt.Fprintln(table, "QUEUE\tACTIVE\tSCHEDULED\tDEAD LETTER\tTRANSFER\tTRANSFER DEAD LETTER\tSIZE")
+	for _, s := range stats {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", s.Queue, s.ActiveMessages, s.ScheduledMessages,
+			s.DeadLetterMessages, s.TransferMessages, s.TransferDeadLetterMessages, s.SizeBytes)
+	}
+	return table.Flush()
+}
+
+func printPurged(opts options) error {
+	if opts.json {
+		return printJSON(map[string]string{"queue": opts.queue})
+	}
+	fmt.Fprintf(stdout, "purged %s\n", opts.queue)
+	return nil
+}
+
+func printDeadLetters(opts options, deadLetters []serviceBus.DeadLetteredMessage) error {
+	if opts.json {
+		return printJSON(deadLetters)
+	}
+	if len(deadLetters) == 0 {
+		fmt.Fprintf(stdout, "no dead lettered messages in %s\n", opts.queue)
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "SEQ\tENQUEUED\tDELIVERIES\tREASON\tMESSAGE")
+	for _, dl := range deadLetters {
+		reason := dl.Reason
+		if dl.Description != "" {
+			reason += ": " + truncate(dl.Description)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%d\t%s\t%s\n", dl.SequenceNumber, formatTime(dl.EnqueuedAt), dl.DeliveryCount,
+			orDash(reason), describe(dl.Msg, dl.Task, dl.Body))
+	}
+	return table.Flush()
+}
+
+// printSequenceNumbers reports the dead lettered messages that were handled, which may be some even after an error
+func printSequenceNumbers(opts options, action string, sequenceNumbers []int64) {
+	if opts.json {
+		if sequenceNumbers == nil {
+			sequenceNumbers = []int64{}
+		}
+		printJSON(map[string]any{"queue": opts.queue, action: sequenceNumbers})
+		return
+	}
+	fmt.Fprintf(stdout, "%s %d messages of %s %v\n", action, len(sequenceNumbers), opts.queue, sequenceNumbers)
+}
@@ -2,6 +2,7 @@ import logging
 import os
 from azure.storage.blob import BlobClient
 from os import path
+from shared_code import blob_crypto
 from pedalboard import Pedalboard, Distortion
 from pedalboard.io import AudioFile
 
@@ -22,10 +23,9 @@ def main(input) -> str:
     # create client
     blob = BlobClient.from_connection_string(conn_str=storageConnectionString, container_name=sourceContainer, blob_name=inputFile)
 
-    # download file
-    with open('/tmp/' + inputFile, "wb") as my_blob:
-        blob_data = blob.download_blob()
-        blob_data.readinto(my_blob)
+    # download file, decrypted when it was stored encrypted
+    keys = blob_crypto.load_keys()
+    clientID = blob_crypto.download(blob, '/tmp/' + inputFile, keys)
 
     # Make a Pedalboard object, containing multiple audio plugins:
     board = Pedalboard([Distortion(drive_db=40)])
@@ -48,8 +48,8 @@ def main(input) -> str:
 
     # upload new file
     uploadBlob = BlobClient.from_connection_string(conn_str=storageConnectionString, container_name=outputContainer, blob_name=inputFile)
-    with open('/tmp/' + outputFile, "rb") as data:
-        uploadBlob.upload_blob(data=data, overwrite=True)
+    # encrypted for the client of the input, plain if the input was
+    blob_crypto.upload(uploadBlob, '/tmp/' + outputFile, keys, clientID)
 
     # clean up
     os.remove('/tmp/' + inputFile)
@@ -1,8 +1,8 @@
 import logging
-import json
 import os
 import azure.durable_functions as df
 from azure.servicebus import ServiceBusClient, ServiceBusMessage
+from shared_code import envelope
 
 # get properties
 serviceBusConnectionString = os.environ["AZURE_SERVICEBUS_CONNECTION_STRING"]
@@ -10,28 +10,48 @@ serviceBusConnectionString = os.environ["AZURE_SERVICEBUS_CONNECTION_STRING"]
 # constants
 RESULTS_QUEUE_NAME = "audiotaskresults"
 
-def send_result_to_queue(task):
+# exceptions that retrying the task can't fix, anything else is reported as retryable and the
+# server re-enqueues the task according to the failing function's retry policy
+FATAL_ERRORS = ("CouldntDecodeError", "ResourceNotFoundError", "KeyError", "ValueError", "FileNotFoundError")
 
-    # create message
-    msg = {
-        "type": "processAudioResult",
-        "content": json.dumps(task)
-    }
+
+def classify_error(error):
+    # activity exceptions reach the orchestrator wrapped, with the original type in the message
+    message = str(error)
+    if any(name in message for name in FATAL_ERRORS):
+        return "fatal"
+    return "retryable"
+
+def send_result_to_queue(context, message, task):
+
+    # the result joins the task's flow, messages from older servers have no correlation id
+    if not message.get("correlationID"):
+        message = dict(message, correlationID=task.get("taskID"))
+    body = envelope.reply(
+        message,
+        envelope.PROCESS_AUDIO_RESULT,
+        task,
+        str(context.new_uuid()),
+        context.current_utc_datetime,
+    )
 
     service_bus_client = ServiceBusClient.from_connection_string(serviceBusConnectionString)
     with service_bus_client:
         sender = service_bus_client.get_queue_sender(queue_name=RESULTS_QUEUE_NAME)
         with sender:
-            results_message = ServiceBusMessage(json.dumps(msg))
+            results_message = ServiceBusMessage(body)
             sender.send_messages(results_message)
             logging.info("Results sent to the results-queue.")
 
 
 def orchestrator_function(context: df.DurableOrchestrationContext):
     message_content_raw = context.get_input()
-    message = json.loads(message_content_raw)
+    message = envelope.decode(message_content_raw)
 
-    task = json.loads(message['content'])
+    if message["type"] != envelope.PROCESS_AUDIO:
+        logging.error(f"ignoring message of type {message['type']}")
+        return None
+    task = message["payload"]
 
     inputFile = task["inputFile"]
     audioFunctionPipeline = task['audioFunctionPipeline']
@@ -47,7 +67,17 @@ def orchestrator_function(context: df.DurableOrchestrationContext):
     for function_name in audioFunctionPipeline:
         # call the activity function and pass the input file
         payload = {"inputFile": current_input, "sourceContainer": current_source_container}
-        current_output = yield context.call_activity(function_name, payload)
+        try:
+            current_output = yield context.call_activity(function_name, payload)
+        except Exception as e:
+            # report the failure, the server decides whether the task is retried
+            logging.error(f"{function_name} failed for task {task.get('taskID')}: {e}")
+            task["status"] = "Failed"
+            task["failedStep"] = function_name
+            task["error"] = str(e)
+            task["errorClass"] = classify_error(e)
+            send_result_to_queue(context, message, task)
+            return None
         # set the current output as the input for the next activity function
         current_input = current_output
         current_source_container = outputContainer
@@ -57,7 +87,7 @@ def orchestrator_function(context: df.DurableOrchestrationContext):
     task["outputFile"] = current_input
 
     # send the results to the results queue
-    send_result_to_queue(task)
+    send_result_to_queue(context, message, task)
 
     return current_input
 
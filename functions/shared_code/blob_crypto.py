@@ -0,0 +1,150 @@
+# envelope encryption of stored audio, the same format as pkg/file_system/encryption.go. a blob with
+# "manicenc" metadata has its own data key, wrapped with its client's key ("manicclient") and stored
+# in "manickey", and its data sealed in AES-GCM chunks of "manicchunk" bytes. every chunk's
+# associated data is its index and whether it is the last chunk:
+#
+#   <8 byte big endian index><1 if last else 0>
+#
+# client keys come from the ManicKeys app setting, the same JSON as the server's MANIC_KEYFILE:
+# {"<clientID>": "<base64 32 byte key>", ...}. the functions encrypt an output for the client of
+# its input, an output of a plain input is stored plain
+import base64
+import json
+import os
+import struct
+
+from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+
+VERSION = "v1"
+CHUNK_SIZE = 64 * 1024
+OVERHEAD = 16  # AES-GCM tag appended to every chunk
+DEFAULT_CLIENT = "default"
+
+META_ENCRYPTION = "manicenc"
+META_CLIENT = "manicclient"
+META_WRAPPED_KEY = "manickey"
+META_NONCE = "manicnonce"
+META_CHUNK_SIZE = "manicchunk"
+
+
+class EncryptionError(ValueError):
+    pass
+
+
+def load_keys(setting=None):
+    # returns the client keys of the ManicKeys setting, empty when it isn't set
+    if setting is None:
+        setting = os.environ.get("ManicKeys", "")
+    if not setting:
+        return {}
+    keys = {}
+    for client_id, value in json.loads(setting).items():
+        key = base64.b64decode(value)
+        if len(key) != 32:
+            raise EncryptionError(f"key for client {client_id} must be 32 bytes, got {len(key)}")
+        keys[client_id] = key
+    return keys
+
+
+def metadata_value(metadata, key):
+    # case insensitive, the service may return canonicalized header names
+    for k, v in (metadata or {}).items():
+        if k.lower() == key:
+            return v
+    return ""
+
+
+def client_of(metadata):
+    # the client an encrypted blob belongs to, None for plain blobs
+    if not metadata_value(metadata, META_ENCRYPTION):
+        return None
+    return metadata_value(metadata, META_CLIENT) or DEFAULT_CLIENT
+
+
+def _client_key(keys, client_id):
+    key = keys.get(client_id or DEFAULT_CLIENT)
+    if key is None:
+        raise EncryptionError(f"no encryption key for client {client_id!r}")
+    return key
+
+
+def _chunk_nonce(nonce, index):
+    counter = int.from_bytes(nonce[4:], "big") ^ index
+    return nonce[:4] + counter.to_bytes(8, "big")
+
+
+def _chunk_aad(index, final):
+    return struct.pack(">QB", index, 1 if final else 0)
+
+
+def decrypt(keys, metadata, data):
+    # returns the plaintext of a stored blob, data as is when the blob isn't encrypted
+    version = metadata_value(metadata, META_ENCRYPTION)
+    if not version:
+        return data
+    if version != VERSION:
+        raise EncryptionError(f"unsupported blob encryption version {version!r}")
+
+    client_id = metadata_value(metadata, META_CLIENT)
+    wrapped = base64.b64decode(metadata_value(metadata, META_WRAPPED_KEY))
+    nonce = base64.b64decode(metadata_value(metadata, META_NONCE))
+    chunk_size = int(metadata_value(metadata, META_CHUNK_SIZE) or 0)
+    if len(wrapped) < 12 or len(nonce) != 12 or chunk_size <= 0:
+        raise EncryptionError("invalid encryption metadata")
+    if len(data) < OVERHEAD:
+        raise EncryptionError("encrypted blob is truncated")
+
+    data_key = AESGCM(_client_key(keys, client_id)).decrypt(wrapped[:12], wrapped[12:], client_id.encode())
+    aead = AESGCM(data_key)
+    sealed_size = chunk_size + OVERHEAD
+    last = (len(data) + sealed_size - 1) // sealed_size - 1
+    plain = []
+    for index in range(last + 1):
+        sealed = data[index * sealed_size:(index + 1) * sealed_size]
+        plain.append(aead.decrypt(_chunk_nonce(nonce, index), sealed, _chunk_aad(index, index == last)))
+    return b"".join(plain)
+
+
+def encrypt(keys, client_id, data):
+    # returns the sealed data and the metadata to store it with
+    client_id = client_id or DEFAULT_CLIENT
+    client_key = _client_key(keys, client_id)
+    data_key = AESGCM.generate_key(bit_length=256)
+    nonce = os.urandom(12)
+    wrap_nonce = os.urandom(12)
+    wrapped = wrap_nonce + AESGCM(client_key).encrypt(wrap_nonce, data_key, client_id.encode())
+
+    aead = AESGCM(data_key)
+    chunks = [data[i:i + CHUNK_SIZE] for i in range(0, len(data), CHUNK_SIZE)] or [b""]
+    sealed = b"".join(
+        aead.encrypt(_chunk_nonce(nonce, index), chunk, _chunk_aad(index, index == len(chunks) - 1))
+        for index, chunk in enumerate(chunks)
+    )
+    metadata = {
+        META_ENCRYPTION: VERSION,
+        META_CLIENT: client_id,
+        META_WRAPPED_KEY: base64.b64encode(wrapped).decode(),
+        META_NONCE: base64.b64encode(nonce).decode(),
+        META_CHUNK_SIZE: str(CHUNK_SIZE),
+    }
+    return sealed, metadata
+
+
+def download(blob, path, keys):
+    # writes the plaintext of blob (a BlobClient) to path and returns its client, None if it is plain
+    downloader = blob.download_blob()
+    metadata = downloader.properties.metadata
+    with open(path, "wb") as f:
+        f.write(decrypt(keys, metadata, downloader.readall()))
+    return client_of(metadata)
+
+
+def upload(blob, path, keys, client_id):
+    # uploads the file at path to blob, encrypted for client_id unless it is None
+    with open(path, "rb") as f:
+        if client_id is None:
+            blob.upload_blob(data=f, overwrite=True)
+            return
+        data = f.read()
+    sealed, metadata = encrypt(keys, client_id, data)
+    blob.upload_blob(data=sealed, overwrite=True, metadata=metadata)
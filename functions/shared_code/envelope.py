@@ -0,0 +1,75 @@
+# the task protocol shared with the Go server (pkg/service_bus/envelope.go). a message body is an
+# envelope:
+#
+#   {"schemaVersion": 1, "type": "processAudio", "id": "...", "correlationID": "<task id>",
+#    "causationID": "<id of the message handled when this one was sent>",
+#    "createdAt": "...", "sentAt": "...", "payload": {...}}
+#
+# version 0, {"type": "...", "content": "<payload as a JSON string>"}, is still decoded
+import json
+from datetime import timezone
+
+SCHEMA_VERSION = 1
+
+# message types
+PROCESS_AUDIO = "processAudio"              # payload is the task to run
+PROCESS_AUDIO_RESULT = "processAudioResult" # payload is the task with its outcome
+
+
+class UnsupportedSchemaVersion(ValueError):
+    pass
+
+
+def decode(body):
+    # returns the envelope of a message body (str or bytes) as a dict with the payload decoded,
+    # a version 0 message comes back with schemaVersion 0 and its content as payload
+    message = json.loads(body)
+    version = message.get("schemaVersion", 0)
+    if version < 0 or version > SCHEMA_VERSION:
+        raise UnsupportedSchemaVersion(f"unsupported message schema version {version}")
+    if version > 0:
+        return message
+
+    content = message.get("content", "")
+    try:
+        payload = json.loads(content)
+    except ValueError:
+        # version 0 allowed any string
+        payload = content
+    return {"schemaVersion": 0, "type": message.get("type", ""), "payload": payload}
+
+
+def format_time(moment):
+    # RFC 3339 like Go writes it, datetimes without a timezone are taken as UTC
+    if moment.tzinfo is None:
+        moment = moment.replace(tzinfo=timezone.utc)
+    return moment.astimezone(timezone.utc).isoformat().replace("+00:00", "Z")
+
+
+def encode(message_type, payload, message_id, created_at, correlation_id=None, causation_id=None):
+    # returns the body of a current version message. ids and times are passed in because
+    # orchestrators have to be deterministic (use context.new_uuid() and context.current_utc_datetime)
+    message = {
+        "schemaVersion": SCHEMA_VERSION,
+        "type": message_type,
+        "id": message_id,
+        "correlationID": correlation_id or message_id,
+        "createdAt": format_time(created_at),
+        "sentAt": format_time(created_at),
+        "payload": payload,
+    }
+    if causation_id:
+        message["causationID"] = causation_id
+    return json.dumps(message)
+
+
+def reply(message, message_type, payload, message_id, created_at):
+    # encodes a message sent while handling message, it joins the same flow
+    return encode(
+        message_type,
+        payload,
+        message_id,
+        created_at,
+        correlation_id=message.get("correlationID"),
+        causation_id=message.get("id"),
+    )
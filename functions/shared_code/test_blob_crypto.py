@@ -0,0 +1,58 @@
+# tests of the blob encryption against the fixture shared with the Go server in
+# pkg/file_system/testdata/encryption. run from functions/ with
+#
+#   python -m unittest shared_code.test_blob_crypto
+import base64
+import json
+import os
+import unittest
+
+from cryptography.exceptions import InvalidTag
+
+from shared_code import blob_crypto
+
+FIXTURE = os.path.join(os.path.dirname(__file__), "..", "..", "pkg", "file_system", "testdata", "encryption", "v1.json")
+
+
+def read_fixture():
+    with open(FIXTURE, encoding="utf-8") as f:
+        fixture = json.load(f)
+    keys = blob_crypto.load_keys(json.dumps(fixture["keys"]))
+    return fixture, keys, base64.b64decode(fixture["sealed"])
+
+
+class BlobCryptoTest(unittest.TestCase):
+    def test_decrypts_go(self):
+        fixture, keys, sealed = read_fixture()
+        plain = blob_crypto.decrypt(keys, fixture["metadata"], sealed)
+        self.assertEqual(plain.decode(), fixture["plaintext"])
+        self.assertEqual(blob_crypto.client_of(fixture["metadata"]), "client-1")
+
+    def test_detects_truncation(self):
+        fixture, keys, sealed = read_fixture()
+        # the fixture has 16 byte chunks, without the last one the chunk before it isn't final
+        with self.assertRaises(InvalidTag):
+            blob_crypto.decrypt(keys, fixture["metadata"], sealed[:2 * (16 + blob_crypto.OVERHEAD)])
+        with self.assertRaises(blob_crypto.EncryptionError):
+            blob_crypto.decrypt(keys, fixture["metadata"], b"")
+
+    def test_round_trip(self):
+        _, keys, _ = read_fixture()
+        for size in (0, 1, blob_crypto.CHUNK_SIZE, blob_crypto.CHUNK_SIZE + 1):
+            data = bytes(i * 31 % 256 for i in range(size))
+            sealed, metadata = blob_crypto.encrypt(keys, "client-1", data)
+            self.assertEqual(len(sealed), size + blob_crypto.OVERHEAD * max(1, -(-size // blob_crypto.CHUNK_SIZE)))
+            self.assertEqual(blob_crypto.decrypt(keys, metadata, sealed), data)
+
+    def test_plain_blobs(self):
+        self.assertEqual(blob_crypto.decrypt({}, {}, b"plain"), b"plain")
+        self.assertIsNone(blob_crypto.client_of({"other": "x"}))
+
+    def test_unknown_client(self):
+        fixture, _, sealed = read_fixture()
+        with self.assertRaises(blob_crypto.EncryptionError):
+            blob_crypto.decrypt({}, fixture["metadata"], sealed)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,70 @@
+# tests of the task protocol against the fixtures shared with the Go server in
+# pkg/service_bus/testdata/envelope: go_v1.json is what the server writes and python_v1.json what
+# reply writes, each side decodes the other's. run from functions/ with
+#
+#   python -m unittest shared_code.test_envelope
+import json
+import os
+import unittest
+from datetime import datetime
+
+from shared_code import envelope
+
+FIXTURES = os.path.join(os.path.dirname(__file__), "..", "..", "pkg", "service_bus", "testdata", "envelope")
+
+
+def read_fixture(name):
+    with open(os.path.join(FIXTURES, name), encoding="utf-8") as f:
+        return f.read()
+
+
+class EnvelopeTest(unittest.TestCase):
+    def test_decodes_go(self):
+        message = envelope.decode(read_fixture("go_v1.json"))
+        self.assertEqual(message["schemaVersion"], 1)
+        self.assertEqual(message["type"], envelope.PROCESS_AUDIO)
+        self.assertEqual(message["id"], "5b7f3c2e-8d1a-4f6b-9c0e-2a4d6e8f1b3c")
+        self.assertEqual(message["correlationID"], "task-1")
+        self.assertEqual(message["causationID"], "0f9e8d7c-6b5a-4938-8271-6a5b4c3d2e1f")
+        self.assertEqual(message["sentAt"], "2024-05-01T10:00:01.5Z")
+        self.assertEqual(message["payload"]["taskID"], "task-1")
+        self.assertEqual(message["payload"]["audioFunctionPipeline"], ["WAV to MP3", "Apply Effect 1"])
+
+    def test_reply_matches_fixture(self):
+        message = envelope.decode(read_fixture("go_v1.json"))
+        task = dict(
+            message["payload"],
+            status="Failed",
+            failedStep="Apply Effect 1",
+            error="CouldntDecodeError: could not decode client-1/song.wav",
+            errorClass="fatal",
+        )
+        body = envelope.reply(
+            message,
+            envelope.PROCESS_AUDIO_RESULT,
+            task,
+            "c4d5e6f7-1a2b-4c3d-8e9f-0a1b2c3d4e5f",
+            datetime(2024, 5, 1, 10, 0, 3),
+        )
+        self.assertEqual(json.loads(body), json.loads(read_fixture("python_v1.json")))
+
+        # and decodes back to the flow of the Go message
+        decoded = envelope.decode(body)
+        self.assertEqual(decoded["correlationID"], message["correlationID"])
+        self.assertEqual(decoded["causationID"], message["id"])
+
+    def test_decodes_version_0(self):
+        message = envelope.decode(read_fixture("v0.json"))
+        self.assertEqual(message["schemaVersion"], 0)
+        self.assertEqual(message["type"], envelope.PROCESS_AUDIO)
+        self.assertEqual(message["payload"]["taskID"], "task-1")
+
+    def test_rejects_unknown_version(self):
+        with self.assertRaises(envelope.UnsupportedSchemaVersion):
+            envelope.decode(read_fixture("unsupported_version.json"))
+        with self.assertRaises(envelope.UnsupportedSchemaVersion):
+            envelope.decode('{"schemaVersion": -1, "type": "processAudio"}')
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,83 @@
+package audioTypes
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// audio container formats recognised by DetectFormat
+const (
+	FormatWAV  = "wav"
+	FormatMP3  = "mp3"
+	FormatFLAC = "flac"
+	FormatOGG  = "ogg"
+	FormatAIFF = "aiff"
+)
+
+var AllFormats = []string{FormatWAV, FormatMP3, FormatFLAC, FormatOGG, FormatAIFF}
+
+// SniffLength is the number of leading bytes DetectFormat needs to see
+const SniffLength = 12
+
+// DetectFormat identifies an audio file from its magic bytes, returning "" for anything else
+func DetectFormat(header []byte) string {
+	switch {
+	case len(header) >= 12 && bytes.Equal(header[0:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return FormatWAV
+	case len(header) >= 12 && bytes.Equal(header[0:4], []byte("FORM")) &&
+		(bytes.Equal(header[8:12], []byte("AIFF")) || bytes.Equal(header[8:12], []byte("AIFC"))):
+		return FormatAIFF
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return FormatFLAC
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return FormatOGG
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return FormatMP3
+	case isMPEGFrame(header):
+		return FormatMP3
+	}
+	return ""
+}
+
+// isMPEGFrame checks for an MPEG audio frame header: 11 bit sync, a valid version and layer,
+// and a bitrate / sample rate index that isn't reserved
+func isMPEGFrame(header []byte) bool {
+	if len(header) < 4 {
+		return false
+	}
+	if header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return false
+	}
+	version := (header[1] >> 3) & 0x03
+	layer := (header[1] >> 1) & 0x03
+	bitrate := header[2] >> 4
+	sampleRate := (header[2] >> 2) & 0x03
+	return version != 0x01 && layer != 0x00 && bitrate != 0x0F && sampleRate != 0x03
+}
+
+// ParseFormats parses a comma separated list of formats, e.g. "wav,mp3"
+func ParseFormats(list string) ([]string, error) {
+	formats := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, format := range AllFormats {
+			if name == format {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown audio format %q", name)
+		}
+		formats = append(formats, name)
+	}
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("no audio formats given")
+	}
+	return formats, nil
+}
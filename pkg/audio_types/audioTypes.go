@@ -2,17 +2,26 @@ package audioTypes
 
 import (
 	"encoding/json"
+	"time"
 )
 
 // audio job specifies the input file and the audio functions to be applied to it, this will be serialized into
 // a message and sent to the service bus for processing by Azure Durable Functions
 type AudioTask struct {
-	ClientID              string   `json:"clientID"`
-	TaskID                string   `json:"taskID"`
-	Status                string   `json:"status"`
-	InputFile             string   `json:"inputFile"`
-	OutputFile            string   `json:"outputFile"`
-	AudioFunctionPipeline []string `json:"audioFunctionPipeline"`
+	ClientID              string     `json:"clientID"`
+	TaskID                string     `json:"taskID"`
+	Status                string     `json:"status"`
+	InputFile             string     `json:"inputFile"`
+	OutputFile            string     `json:"outputFile"`
+	AudioFunctionPipeline []string   `json:"audioFunctionPipeline"`
+	Priority              string     `json:"priority,omitempty"`          // lane the task is queued in, see Priorities
+	DeliveryCount         int        `json:"deliveryCount"`               // times the task has been enqueued, 1 on the first run
+	ScheduledAt           *time.Time `json:"scheduledAt,omitempty"`       // set for tasks started at a later time
+	ScheduledSequence     int64      `json:"scheduledSequence,omitempty"` // sequence number of the scheduled message, cancels it
+	FailedStep            string     `json:"failedStep,omitempty"`        // set with Error and ErrorClass when a pipeline step failed
+	Error                 string     `json:"error,omitempty"`
+	ErrorClass            string     `json:"errorClass,omitempty"`
+	IdempotencyKey        string     `json:"idempotencyKey,omitempty"` // Idempotency-Key of the start request that created the task
 }
 
 const (
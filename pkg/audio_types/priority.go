@@ -0,0 +1,30 @@
+package audioTypes
+
+import (
+	"fmt"
+	"strings"
+)
+
+// task priorities, each has its own lane (queue) in front of the functions
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Priorities in order, highest first
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ParsePriority validates a priority, "" is PriorityNormal
+func ParsePriority(priority string) (string, error) {
+	priority = strings.ToLower(strings.TrimSpace(priority))
+	if priority == "" {
+		return PriorityNormal, nil
+	}
+	for _, known := range Priorities {
+		if priority == known {
+			return priority, nil
+		}
+	}
+	return "", fmt.Errorf("unknown priority %q, expected high, normal or low", priority)
+}
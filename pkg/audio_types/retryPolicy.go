@@ -0,0 +1,52 @@
+package audioTypes
+
+import "time"
+
+// classes of pipeline step failures, reported by the orchestrator with a Failed result
+const (
+	ErrorRetryable = "retryable" // transient, e.g. storage or network errors
+	ErrorFatal     = "fatal"     // retrying can't help, e.g. the input isn't decodable audio
+)
+
+// RetryPolicy decides how often a task whose pipeline step failed with a retryable error is
+// enqueued again, and how long to wait before each retry
+type RetryPolicy struct {
+	MaxAttempts    int // deliveries in total, including the first
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: 30 * time.Second, MaxBackoff: 10 * time.Minute}
+
+// retry policies by activity name, functions not listed use DefaultRetryPolicy
+var retryPolicies = map[string]RetryPolicy{
+	"WavToMP3":     {MaxAttempts: 5, InitialBackoff: 30 * time.Second, MaxBackoff: 15 * time.Minute},
+	"ApplyEffect1": DefaultRetryPolicy,
+	"ApplyEffect2": DefaultRetryPolicy,
+}
+
+// RetryPolicyFor returns the policy of an audio function, by activity or display name
+func RetryPolicyFor(audioFunction string) RetryPolicy {
+	if activityName, ok := audioFunctionMap[audioFunction]; ok {
+		audioFunction = activityName
+	}
+	if policy, ok := retryPolicies[audioFunction]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy
+}
+
+// Backoff is the delay before the retry that follows the given delivery, doubling from
+// InitialBackoff up to MaxBackoff
+func (p RetryPolicy) Backoff(deliveryCount int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < deliveryCount && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, p.MaxBackoff)
+}
+
+// ShouldRetry reports whether a task failed with errorClass on its deliveryCount'th delivery gets another attempt
+func (p RetryPolicy) ShouldRetry(errorClass string, deliveryCount int) bool {
+	return errorClass != ErrorFatal && deliveryCount < p.MaxAttempts
+}
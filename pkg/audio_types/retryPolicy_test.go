@@ -0,0 +1,60 @@
+package audioTypes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: 30 * time.Second, MaxBackoff: 3 * time.Minute}
+	for _, tc := range []struct {
+		deliveryCount int
+		want          time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 3 * time.Minute}, // capped, 4 minutes uncapped
+		{100, 3 * time.Minute},
+	} {
+		if got := policy.Backoff(tc.deliveryCount); got != tc.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tc.deliveryCount, got, tc.want)
+		}
+	}
+
+	// an initial backoff over the cap is capped too
+	if got := (RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Minute}).Backoff(1); got != time.Minute {
+		t.Errorf("capped initial backoff %s", got)
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Minute}
+	for _, tc := range []struct {
+		errorClass    string
+		deliveryCount int
+		want          bool
+	}{
+		{ErrorRetryable, 1, true},
+		{ErrorRetryable, 2, true},
+		{ErrorRetryable, 3, false},
+		{ErrorRetryable, 4, false},
+		{"", 1, true}, // results of older orchestrators have no class
+		{ErrorFatal, 1, false},
+		{ErrorFatal, 2, false},
+	} {
+		if got := policy.ShouldRetry(tc.errorClass, tc.deliveryCount); got != tc.want {
+			t.Errorf("ShouldRetry(%q, %d) = %v, want %v", tc.errorClass, tc.deliveryCount, got, tc.want)
+		}
+	}
+}
+
+func TestRetryPolicyFor(t *testing.T) {
+	if RetryPolicyFor("WavToMP3") != retryPolicies["WavToMP3"] || RetryPolicyFor(AudioFunctionWAVToMp3) != retryPolicies["WavToMP3"] {
+		t.Error("WavToMP3 doesn't get its own policy by activity and display name")
+	}
+	if RetryPolicyFor("") != DefaultRetryPolicy || RetryPolicyFor("Unknown") != DefaultRetryPolicy {
+		t.Error("unknown steps don't get the default policy")
+	}
+}
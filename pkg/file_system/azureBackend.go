@@ -0,0 +1,198 @@
+package fileSystem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// AzureBackend stores blobs in Azure Blob Storage
+type AzureBackend struct {
+	ServiceClient *azblob.Client
+}
+
+func NewAzureBackend(serviceClient *azblob.Client) *AzureBackend {
+	return &AzureBackend{ServiceClient: serviceClient}
+}
+
+func (ab *AzureBackend) Upload(ctx context.Context, container string, name string, r io.Reader, metadata map[string]string, cond UploadCondition) error {
+	// files are uploaded in parallel blocks, anything else is streamed
+	var err error
+	if f, ok := r.(*os.File); ok {
+		_, err = ab.ServiceClient.UploadFile(ctx, container, name, f, &azblob.UploadFileOptions{
+			Metadata:         toAzureMetadata(metadata),
+			AccessConditions: toAzureConditions(cond),
+		})
+	} else {
+		_, err = ab.ServiceClient.UploadStream(ctx, container, name, r, &azblob.UploadStreamOptions{
+			Metadata:         toAzureMetadata(metadata),
+			AccessConditions: toAzureConditions(cond),
+		})
+	}
+	if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+		return fmt.Errorf("%w: %v", ErrConditionNotMet, err)
+	}
+	return err
+}
+
+func (ab *AzureBackend) Download(ctx context.Context, container string, name string, offset int64, count int64, ifMatch string) (io.ReadCloser, error) {
+	// DownloadStream returns an intelligent retryable stream around a blob
+	response, err := ab.ServiceClient.DownloadStream(ctx, container, name, &azblob.DownloadStreamOptions{
+		Range:            azblob.HTTPRange{Offset: offset, Count: count},
+		AccessConditions: toAzureConditions(UploadCondition{IfMatch: ifMatch}),
+	})
+	if bloberror.HasCode(err, bloberror.ConditionNotMet) {
+		return nil, fmt.Errorf("%w: %v", ErrConditionNotMet, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (ab *AzureBackend) Properties(ctx context.Context, container string, name string) (BlobProperties, error) {
+	props, err := ab.ServiceClient.ServiceClient().
+		NewContainerClient(container).
+		NewBlobClient(name).
+		GetProperties(ctx, nil)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+
+	result := BlobProperties{Metadata: map[string]string{}}
+	if props.ContentLength != nil {
+		result.Size = *props.ContentLength
+	}
+	if props.ETag != nil {
+		result.ETag = string(*props.ETag)
+	}
+	if props.LastModified != nil {
+		result.LastModified = *props.LastModified
+	}
+	for key, value := range props.Metadata {
+		if value != nil {
+			result.Metadata[key] = *value
+		}
+	}
+	return result, nil
+}
+
+// copyPollInterval is how often a pending copy is checked, copies within an account usually finish right away
+const copyPollInterval = 500 * time.Millisecond
+
+func (ab *AzureBackend) Copy(ctx context.Context, container string, src string, dst string, cond UploadCondition) error {
+	containerClient := ab.ServiceClient.ServiceClient().NewContainerClient(container)
+	dstClient := containerClient.NewBlobClient(dst)
+
+	// the source is in the same account, so the request's own credentials authorize reading it
+	resp, err := dstClient.StartCopyFromURL(ctx, containerClient.NewBlobClient(src).URL(), &blob.StartCopyFromURLOptions{
+		AccessConditions: toAzureConditions(cond),
+	})
+	if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+		return fmt.Errorf("%w: %v", ErrConditionNotMet, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	status := resp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(copyPollInterval):
+		}
+		props, err := dstClient.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus
+		if status != nil && *status != blob.CopyStatusTypePending && *status != blob.CopyStatusTypeSuccess {
+			description := ""
+			if props.CopyStatusDescription != nil {
+				description = *props.CopyStatusDescription
+			}
+			return fmt.Errorf("copy of %s to %s %s: %s", src, dst, *status, description)
+		}
+	}
+	return nil
+}
+
+func (ab *AzureBackend) List(ctx context.Context, container string) ([]BlobInfo, error) {
+
+	pager := ab.ServiceClient.NewListBlobsFlatPager(container, &azblob.ListBlobsFlatOptions{
+		Include: azblob.ListBlobsInclude{Metadata: true},
+	})
+
+	blob_list := []BlobInfo{}
+
+	for pager.More() {
+		resp, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, _blob := range resp.Segment.BlobItems {
+			element := &BlobInfo{
+				Name:     *_blob.Name,
+				Size:     *_blob.Properties.ContentLength,
+				Metadata: map[string]string{},
+			}
+			for key, value := range _blob.Metadata {
+				if value != nil {
+					element.Metadata[strings.ToLower(key)] = *value
+				}
+			}
+			if _blob.Properties.LastModified != nil {
+				element.LastModified = *_blob.Properties.LastModified
+			}
+			if _blob.Properties.ETag != nil {
+				element.ETag = string(*_blob.Properties.ETag)
+			}
+			blob_list = append(blob_list, *element)
+		}
+	}
+
+	return blob_list, nil
+}
+
+func (ab *AzureBackend) Delete(ctx context.Context, container string, name string) error {
+	_, err := ab.ServiceClient.DeleteBlob(ctx, container, name, nil)
+	return err
+}
+
+func toAzureMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	result := make(map[string]*string, len(metadata))
+	for key, value := range metadata {
+		value := value
+		result[key] = &value
+	}
+	return result
+}
+
+// toAzureConditions maps an upload condition onto the blob access conditions, which apply to the final block list commit
+func toAzureConditions(cond UploadCondition) *blob.AccessConditions {
+	if !cond.IfNoneMatch && cond.IfMatch == "" {
+		return nil
+	}
+	modified := &blob.ModifiedAccessConditions{}
+	if cond.IfNoneMatch {
+		etag := azcore.ETagAny
+		modified.IfNoneMatch = &etag
+	}
+	if cond.IfMatch != "" {
+		etag := azcore.ETag(cond.IfMatch)
+		modified.IfMatch = &etag
+	}
+	return &blob.AccessConditions{ModifiedAccessConditions: modified}
+}
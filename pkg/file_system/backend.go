@@ -0,0 +1,73 @@
+package fileSystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// Backend is the object store underneath a FileSystem. containers map to Azure blob containers
+// or S3 buckets, blob names to blob names or object keys
+type Backend interface {
+	// Upload writes the full contents of r to a blob, replacing any existing blob of that name unless
+	// cond says otherwise, in which case a mismatch fails with ErrConditionNotMet
+	Upload(ctx context.Context, container string, name string, r io.Reader, metadata map[string]string, cond UploadCondition) error
+	// Download streams count bytes of a blob starting at offset, a count of 0 reads to the end.
+	// with ifMatch set it fails with ErrConditionNotMet unless the blob still has that ETag
+	Download(ctx context.Context, container string, name string, offset int64, count int64, ifMatch string) (io.ReadCloser, error)
+	Properties(ctx context.Context, container string, name string) (BlobProperties, error)
+	// Copy duplicates a blob within a container on the server side, metadata included. cond applies
+	// to the destination like it does for Upload
+	Copy(ctx context.Context, container string, src string, dst string, cond UploadCondition) error
+	List(ctx context.Context, container string) ([]BlobInfo, error)
+	Delete(ctx context.Context, container string, name string) error
+}
+
+// UploadCondition makes an upload conditional on the blob already stored under the name,
+// the zero value always writes
+type UploadCondition struct {
+	IfNoneMatch bool   // only write when no blob exists (If-None-Match: *)
+	IfMatch     string // only write when the stored blob still has this ETag (If-Match)
+}
+
+// ErrConditionNotMet is returned by a conditional upload or download that lost to an existing or changed blob
+var ErrConditionNotMet = errors.New("blob does not match the upload condition")
+
+type BlobProperties struct {
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// NewBackendFromEnv picks the object store from STORAGE_BACKEND (azure, the default, or s3).
+// azure reads AZURE_STORAGE_CONNECTION_STRING, s3 reads S3_ENDPOINT, S3_REGION, S3_ACCESS_KEY
+// and S3_SECRET_KEY; for s3 the container names are used as bucket names
+func NewBackendFromEnv() (Backend, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "azure":
+		serviceClient, err := azblob.NewClientFromConnectionString(os.Getenv("AZURE_STORAGE_CONNECTION_STRING"), nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewAzureBackend(serviceClient), nil
+	case "s3":
+		s3Backend, err := NewS3Backend(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s3Backend, nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q, expected azure or s3", backend)
+	}
+}
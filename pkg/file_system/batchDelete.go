@@ -0,0 +1,146 @@
+package fileSystem
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDeleteConcurrency = 8
+	maxDeleteConcurrency     = 32
+)
+
+// DeleteFilter selects which blobs a batch delete applies to, an empty filter matches everything
+type DeleteFilter struct {
+	Prefix    string        `json:"prefix,omitempty"`
+	Glob      string        `json:"glob,omitempty"`      // path.Match pattern against the full blob name
+	OlderThan time.Duration `json:"olderThan,omitempty"` // only blobs last modified before now - OlderThan
+}
+
+type BatchDeleteOptions struct {
+	Filter      DeleteFilter
+	DryRun      bool // report what would be deleted without deleting anything
+	Concurrency int  // number of parallel deletes, defaults to defaultDeleteConcurrency and is capped at maxDeleteConcurrency
+}
+
+type DeleteFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+type BatchDeleteReport struct {
+	Matched  []BlobInfo      `json:"matched"`
+	Deleted  int             `json:"deleted"`
+	Failures []DeleteFailure `json:"failures"`
+}
+
+// Validate checks the glob pattern up front so a bad pattern fails the request instead of matching nothing
+func (f DeleteFilter) Validate() error {
+	if f.Glob != "" {
+		if _, err := path.Match(f.Glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", f.Glob, err)
+		}
+	}
+	if f.OlderThan < 0 {
+		return fmt.Errorf("olderThan must not be negative")
+	}
+	return nil
+}
+
+func (f DeleteFilter) Matches(blob BlobInfo, now time.Time) bool {
+	if f.Prefix != "" && !strings.HasPrefix(blob.Name, f.Prefix) {
+		return false
+	}
+	if f.Glob != "" {
+		if ok, _ := path.Match(f.Glob, blob.Name); !ok {
+			return false
+		}
+	}
+	if f.OlderThan > 0 && !blob.LastModified.Before(now.Add(-f.OlderThan)) {
+		return false
+	}
+	return true
+}
+
+// BatchDelete deletes every blob matching the filter using a bounded pool of workers.
+// progress (optional) is called once with done == nil after listing, then once per blob as it
+// finishes. per blob failures are collected in the report rather than aborting the batch,
+// the returned error is only for listing failures or a cancelled context
+func (fs *FileSystem) BatchDelete(
+	ctx context.Context,
+	opts BatchDeleteOptions,
+	progress func(matched []BlobInfo, done *BlobInfo, err error),
+) (BatchDeleteReport, error) {
+	report := BatchDeleteReport{Matched: []BlobInfo{}, Failures: []DeleteFailure{}}
+
+	if err := opts.Filter.Validate(); err != nil {
+		return report, err
+	}
+
+	blobs, err := fs.List(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	now := time.Now()
+	for _, blob := range blobs {
+		if opts.Filter.Matches(blob, now) {
+			report.Matched = append(report.Matched, blob)
+		}
+	}
+	if progress != nil {
+		progress(report.Matched, nil, nil)
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	concurrency := min(opts.Concurrency, maxDeleteConcurrency)
+	if concurrency <= 0 {
+		concurrency = defaultDeleteConcurrency
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan BlobInfo)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blob := range work {
+				err := fs.Delete(ctx, blob.Name)
+
+				mu.Lock()
+				if err != nil {
+					report.Failures = append(report.Failures, DeleteFailure{Name: blob.Name, Error: err.Error()})
+				} else {
+					report.Deleted++
+				}
+				if progress != nil {
+					progress(report.Matched, &blob, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, blob := range report.Matched {
+		select {
+		case work <- blob:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return report, ctx.Err()
+}
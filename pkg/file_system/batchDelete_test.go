@@ -0,0 +1,205 @@
+package fileSystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deleteBackend lists a fixed set of blobs and records deletes. deletes of blobs in fail fail, and
+// while release is open every delete waits for it to be closed
+type deleteBackend struct {
+	blobs   []BlobInfo
+	fail    map[string]bool
+	release chan struct{}
+
+	mu       sync.Mutex
+	deleted  []string
+	inFlight int
+	peak     int
+}
+
+func (db *deleteBackend) Upload(ctx context.Context, container string, name string, r io.Reader, metadata map[string]string, cond UploadCondition) error {
+	return errors.New("not implemented")
+}
+
+func (db *deleteBackend) Download(ctx context.Context, container string, name string, offset int64, count int64, ifMatch string) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (db *deleteBackend) Properties(ctx context.Context, container string, name string) (BlobProperties, error) {
+	return BlobProperties{}, errors.New("not implemented")
+}
+
+func (db *deleteBackend) Copy(ctx context.Context, container string, src string, dst string, cond UploadCondition) error {
+	return errors.New("not implemented")
+}
+
+func (db *deleteBackend) List(ctx context.Context, container string) ([]BlobInfo, error) {
+	return db.blobs, nil
+}
+
+func (db *deleteBackend) Delete(ctx context.Context, container string, name string) error {
+	db.mu.Lock()
+	db.inFlight++
+	db.peak = max(db.peak, db.inFlight)
+	db.mu.Unlock()
+	if db.release != nil {
+		<-db.release
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.inFlight--
+	if db.fail[name] {
+		return fmt.Errorf("could not delete %s", name)
+	}
+	db.deleted = append(db.deleted, name)
+	return nil
+}
+
+func (db *deleteBackend) deletedNames() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	names := append([]string{}, db.deleted...)
+	sort.Strings(names)
+	return names
+}
+
+func blobNames(blobs []BlobInfo) []string {
+	names := []string{}
+	for _, blob := range blobs {
+		names = append(names, blob.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBatchDeleteFilters(t *testing.T) {
+	now := time.Now()
+	blobs := []BlobInfo{
+		{Name: "a.wav", LastModified: now.Add(-48 * time.Hour)},
+		{Name: "b.mp3", LastModified: now.Add(-48 * time.Hour)},
+		{Name: "mixes/c.wav", LastModified: now},
+		{Name: "mixes/d.mp3", LastModified: now.Add(-48 * time.Hour)},
+	}
+	for name, tc := range map[string]struct {
+		filter DeleteFilter
+		want   string
+	}{
+		"everything": {DeleteFilter{}, "[a.wav b.mp3 mixes/c.wav mixes/d.mp3]"},
+		"prefix":     {DeleteFilter{Prefix: "mixes/"}, "[mixes/c.wav mixes/d.mp3]"},
+		"glob":       {DeleteFilter{Glob: "*.wav"}, "[a.wav]"}, // * doesn't match /
+		"nested":     {DeleteFilter{Glob: "mixes/*.wav"}, "[mixes/c.wav]"},
+		"age":        {DeleteFilter{OlderThan: 24 * time.Hour}, "[a.wav b.mp3 mixes/d.mp3]"},
+		"combined":   {DeleteFilter{Prefix: "mixes/", Glob: "*/*.mp3", OlderThan: time.Hour}, "[mixes/d.mp3]"},
+		"none":       {DeleteFilter{Prefix: "drafts/"}, "[]"},
+	} {
+		for _, dryRun := range []bool{false, true} {
+			backend := &deleteBackend{blobs: blobs}
+			fs := &FileSystem{Backend: backend, ContainerName: testBucket}
+			report, err := fs.BatchDelete(context.Background(), BatchDeleteOptions{Filter: tc.filter, DryRun: dryRun}, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got := fmt.Sprint(blobNames(report.Matched)); got != tc.want {
+				t.Errorf("%s: matched %s, want %s", name, got, tc.want)
+			}
+
+			// a dry run only reports what it would delete
+			want, wantDeleted := tc.want, len(report.Matched)
+			if dryRun {
+				want, wantDeleted = "[]", 0
+			}
+			if got := fmt.Sprint(backend.deletedNames()); got != want || report.Deleted != wantDeleted {
+				t.Errorf("%s, dry run %v: deleted %s (%d), want %s", name, dryRun, got, report.Deleted, want)
+			}
+		}
+	}
+
+	fs := &FileSystem{Backend: &deleteBackend{}, ContainerName: testBucket}
+	for _, filter := range []DeleteFilter{{Glob: "["}, {OlderThan: -time.Hour}} {
+		if _, err := fs.BatchDelete(context.Background(), BatchDeleteOptions{Filter: filter}, nil); err == nil {
+			t.Errorf("invalid filter %+v was accepted", filter)
+		}
+	}
+}
+
+func TestBatchDeleteFailures(t *testing.T) {
+	backend := &deleteBackend{
+		blobs: []BlobInfo{{Name: "a.wav"}, {Name: "b.wav"}, {Name: "c.wav"}},
+		fail:  map[string]bool{"b.wav": true},
+	}
+	fs := &FileSystem{Backend: backend, ContainerName: testBucket}
+	done := []string{}
+	report, err := fs.BatchDelete(context.Background(), BatchDeleteOptions{}, func(matched []BlobInfo, blob *BlobInfo, err error) {
+		if blob != nil {
+			done = append(done, fmt.Sprintf("%s:%v", blob.Name, err != nil))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one failure doesn't stop the others
+	if report.Deleted != 2 || fmt.Sprint(backend.deletedNames()) != "[a.wav c.wav]" {
+		t.Errorf("deleted %d: %v", report.Deleted, backend.deletedNames())
+	}
+	if len(report.Failures) != 1 || report.Failures[0].Name != "b.wav" || report.Failures[0].Error == "" {
+		t.Errorf("failures %+v", report.Failures)
+	}
+	sort.Strings(done)
+	if fmt.Sprint(done) != "[a.wav:false b.wav:true c.wav:false]" {
+		t.Errorf("progress %v", done)
+	}
+}
+
+func TestBatchDeleteConcurrency(t *testing.T) {
+	blobs := []BlobInfo{}
+	for i := 0; i < 2*maxDeleteConcurrency; i++ {
+		blobs = append(blobs, BlobInfo{Name: fmt.Sprintf("%d.wav", i)})
+	}
+	for _, tc := range []struct {
+		concurrency int
+		want        int
+	}{
+		{0, defaultDeleteConcurrency},
+		{4, 4},
+		{maxDeleteConcurrency, maxDeleteConcurrency},
+		{10 * maxDeleteConcurrency, maxDeleteConcurrency},
+	} {
+		backend := &deleteBackend{blobs: blobs, release: make(chan struct{})}
+		fs := &FileSystem{Backend: backend, ContainerName: testBucket}
+		result := make(chan BatchDeleteReport)
+		go func() {
+			report, _ := fs.BatchDelete(context.Background(), BatchDeleteOptions{Concurrency: tc.concurrency}, nil)
+			result <- report
+		}()
+
+		// wait for the pool to fill up, then give it a moment to exceed its size
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			backend.mu.Lock()
+			inFlight := backend.inFlight
+			backend.mu.Unlock()
+			if inFlight >= tc.want {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(backend.release)
+
+		if report := <-result; report.Deleted != len(blobs) {
+			t.Errorf("concurrency %d: deleted %d of %d", tc.concurrency, report.Deleted, len(blobs))
+		}
+		if backend.peak != tc.want {
+			t.Errorf("concurrency %d: %d deletes at once, want %d", tc.concurrency, backend.peak, tc.want)
+		}
+	}
+}
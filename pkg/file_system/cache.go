@@ -0,0 +1,328 @@
+package fileSystem
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cacheValidateTTL is how long a blob's checked properties are trusted before they're fetched again
+	cacheValidateTTL = 30 * time.Second
+	// cacheFillAttempts bounds the retries of a download that lost to a concurrent write
+	cacheFillAttempts = 3
+)
+
+// DiskCache is a size limited LRU cache of downloaded blobs on local disk.
+// entries are keyed by container, blob name and ETag and filled by downloads conditional on that ETag,
+// so an entry always holds the blob its key names. the properties of a blob are trusted for
+// cacheValidateTTL though, a blob changed by another writer can be served stale for that long
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // front is most recently used
+	size     int64
+	inflight map[string]*cacheFill
+	checked  map[string]checkedBlob // by container/blob, saves a properties call on every hit
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type cacheEntry struct {
+	file string
+	size int64
+}
+
+type checkedBlob struct {
+	props BlobProperties
+	at    time.Time
+}
+
+// cacheFill lets concurrent readers of the same key wait on a single download
+type cacheFill struct {
+	done chan struct{}
+	err  error
+}
+
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"maxBytes"`
+}
+
+// NewDiskCache creates a cache in dir, adopting any entries left over from a previous run
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	dc := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*cacheFill),
+		checked:  make(map[string]checkedBlob),
+	}
+
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// oldest first, so the most recently written files end up at the front
+	infos := []os.FileInfo{}
+	for _, item := range items {
+		info, err := item.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if filepath.Ext(info.Name()) == ".tmp" {
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+
+	for _, info := range infos {
+		dc.entries[info.Name()] = dc.lru.PushFront(&cacheEntry{file: info.Name(), size: info.Size()})
+		dc.size += info.Size()
+	}
+	dc.mu.Lock()
+	dc.evictLocked()
+	dc.mu.Unlock()
+
+	return dc, nil
+}
+
+func cacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Open returns the cached file for key, calling fill to populate it on a miss.
+// only one fill runs per key at a time, other callers wait for it and then read the result
+func (dc *DiskCache) Open(key string, fill func(w io.Writer) error) (*os.File, error) {
+	name := cacheFileName(key)
+
+	for {
+		dc.mu.Lock()
+		if elem, ok := dc.entries[name]; ok {
+			dc.lru.MoveToFront(elem)
+			// open while holding the lock so the file can't be evicted in between
+			f, err := os.Open(filepath.Join(dc.dir, name))
+			dc.mu.Unlock()
+			if err == nil {
+				dc.hits.Add(1)
+			}
+			return f, err
+		}
+
+		// wait for a fill already in progress, then read what it cached
+		if pending, ok := dc.inflight[name]; ok {
+			dc.mu.Unlock()
+			<-pending.done
+			if pending.err != nil {
+				return nil, pending.err
+			}
+			continue
+		}
+
+		pending := &cacheFill{done: make(chan struct{})}
+		dc.inflight[name] = pending
+		dc.mu.Unlock()
+		dc.misses.Add(1)
+
+		f, err := dc.fill(name, fill)
+
+		dc.mu.Lock()
+		delete(dc.inflight, name)
+		dc.mu.Unlock()
+		pending.err = err
+		close(pending.done)
+
+		return f, err
+	}
+}
+
+func (dc *DiskCache) fill(name string, fill func(w io.Writer) error) (*os.File, error) {
+	tmp, err := os.CreateTemp(dc.dir, name+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := fill(tmp); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dc.dir, name)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dc.entries[name] = dc.lru.PushFront(&cacheEntry{file: name, size: size})
+	dc.size += size
+	dc.evictLocked()
+
+	return f, nil
+}
+
+// evictLocked drops least recently used entries until the cache fits, dc.mu must be held
+func (dc *DiskCache) evictLocked() {
+	for dc.size > dc.maxBytes && dc.lru.Len() > 0 {
+		elem := dc.lru.Back()
+		entry := elem.Value.(*cacheEntry)
+		dc.lru.Remove(elem)
+		delete(dc.entries, entry.file)
+		dc.size -= entry.size
+		dc.evictions.Add(1)
+		// open readers keep their handle, the file goes away once they close it
+		os.Remove(filepath.Join(dc.dir, entry.file))
+	}
+}
+
+func (dc *DiskCache) Stats() CacheStats {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	return CacheStats{
+		Hits:      dc.hits.Load(),
+		Misses:    dc.misses.Load(),
+		Evictions: dc.evictions.Load(),
+		Entries:   dc.lru.Len(),
+		Bytes:     dc.size,
+		MaxBytes:  dc.maxBytes,
+	}
+}
+
+// properties returns a blob's properties, reusing ones fetched within cacheValidateTTL
+func (dc *DiskCache) properties(backend Backend, container string, blobName string) (BlobProperties, error) {
+	blob := container + "/" + blobName
+
+	dc.mu.Lock()
+	checked, ok := dc.checked[blob]
+	dc.mu.Unlock()
+	if ok && time.Since(checked.at) < cacheValidateTTL {
+		return checked.props, nil
+	}
+
+	props, err := backend.Properties(context.TODO(), container, blobName)
+	if err != nil {
+		dc.forget(container, blobName)
+		return BlobProperties{}, err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	// drop stale checks so the map doesn't grow with every blob ever read
+	for key, c := range dc.checked {
+		if time.Since(c.at) >= cacheValidateTTL {
+			delete(dc.checked, key)
+		}
+	}
+	dc.checked[blob] = checkedBlob{props: props, at: time.Now()}
+	return props, nil
+}
+
+// forget drops the checked properties of a blob, so the next read sees a change made through this process
+func (dc *DiskCache) forget(container string, blobName string) {
+	dc.mu.Lock()
+	delete(dc.checked, container+"/"+blobName)
+	dc.mu.Unlock()
+}
+
+// openCached returns a blob's full contents through the disk cache.
+// the stored bytes are cached as they are, an encrypted blob stays encrypted on disk and is decrypted on read
+func (fs *FileSystem) openCached(blobName string) (io.ReadCloser, error) {
+	for attempt := 1; ; attempt++ {
+		stream, err := fs.openCachedVersion(blobName)
+		if errors.Is(err, ErrConditionNotMet) && attempt < cacheFillAttempts {
+			// the blob changed after its properties were read, read them again
+			fs.Cache.forget(fs.ContainerName, blobName)
+			continue
+		}
+		return stream, err
+	}
+}
+
+// openCachedVersion reads the version of a blob named by its checked properties, the download
+// fails with ErrConditionNotMet if the blob changed since
+func (fs *FileSystem) openCachedVersion(blobName string) (io.ReadCloser, error) {
+	props, err := fs.Cache.properties(fs.Backend, fs.ContainerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	env, err := fs.KeyRing.openEnvelope(props.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	key := fs.ContainerName + "/" + blobName + "@" + props.ETag
+
+	f, err := fs.Cache.Open(key, func(w io.Writer) error {
+		stream, err := fs.Backend.Download(context.TODO(), fs.ContainerName, blobName, 0, 0, props.ETag)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		_, err = io.Copy(w, stream)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		return f, nil
+	}
+
+	if props.Size < encryptionOverhead {
+		f.Close()
+		return nil, fmt.Errorf("encrypted blob %s is truncated", blobName)
+	}
+	plain := env.decryptReader(f, 0, env.lastChunk(props.Size), 0)
+	return limitedReadCloser{Reader: io.LimitReader(plain, env.plaintextSize(props.Size)), Closer: plain}, nil
+}
+
+// forgetCached is called after a blob is written or removed through fs
+func (fs *FileSystem) forgetCached(blobName string) {
+	if fs.Cache != nil {
+		fs.Cache.forget(fs.ContainerName, blobName)
+	}
+}
@@ -0,0 +1,233 @@
+package fileSystem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func openCacheEntry(t *testing.T, dc *DiskCache, key string, data []byte) []byte {
+	t.Helper()
+	f, err := dc.Open(key, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := NewDiskCache(dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openCacheEntry(t, dc, "a", testData(10))
+	openCacheEntry(t, dc, "b", testData(10))
+	// touch a so b is the oldest
+	if got := openCacheEntry(t, dc, "a", nil); !bytes.Equal(got, testData(10)) {
+		t.Fatalf("read %v from a hit", got)
+	}
+	openCacheEntry(t, dc, "c", testData(10))
+
+	stats := dc.Stats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 || stats.Entries != 2 || stats.Bytes != 20 {
+		t.Errorf("cache stats %+v", stats)
+	}
+	if got := openCacheEntry(t, dc, "b", []byte("refilled")); string(got) != "refilled" {
+		t.Errorf("read %q, want b to have been evicted", got)
+	}
+
+	// a new cache adopts the files left in dir
+	reopened, err := NewDiskCache(dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := reopened.Stats(); stats.Entries != dc.Stats().Entries || stats.Bytes != dc.Stats().Bytes {
+		t.Errorf("reopened cache stats %+v, want %+v", stats, dc.Stats())
+	}
+}
+
+func TestDiskCacheSharesFills(t *testing.T) {
+	dc, err := NewDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fills atomic.Int64
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := dc.Open("key", func(w io.Writer) error {
+				fills.Add(1)
+				<-release
+				_, err := w.Write([]byte("shared"))
+				return err
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			if got, _ := io.ReadAll(f); string(got) != "shared" {
+				t.Errorf("read %q", got)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if n := fills.Load(); n != 1 {
+		t.Errorf("filled %d times, want 1", n)
+	}
+}
+
+func TestDiskCacheDropsFailedFills(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("download failed")
+	_, err = dc.Open("key", func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("open returned %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 || dc.Stats().Entries != 0 {
+		t.Errorf("a failed fill left %d files and %d entries", len(files), dc.Stats().Entries)
+	}
+	if got := openCacheEntry(t, dc, "key", []byte("complete")); string(got) != "complete" {
+		t.Errorf("read %q", got)
+	}
+}
+
+func readCached(fs *FileSystem, name string) ([]byte, error) {
+	stream, err := fs.openCached(name)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func TestCacheKeepsEncryptedBlobsEncrypted(t *testing.T) {
+	fs := newTestEncryptedFileSystem(t)
+	dir := t.TempDir()
+	cache, err := NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Cache = cache
+
+	data := testData(encryptionChunkSize + 100)
+	if err := fs.UploadFile(bytes.NewReader(data), "secret.wav"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := readCached(fs, "secret.wav"); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("read %d bytes through the cache, %v", len(got), err)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("cache stats %+v, want 1 hit and 1 miss", stats)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("cache has %d files, %v", len(files), err)
+	}
+	cached, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, readSealed(t, fs, "secret.wav")) {
+		t.Error("the cache doesn't hold the stored ciphertext")
+	}
+
+	// the cached ciphertext still needs the key
+	plain := &FileSystem{Backend: fs.Backend, ContainerName: fs.ContainerName, Cache: cache}
+	if got, err := readCached(plain, "secret.wav"); err == nil {
+		t.Errorf("read %d bytes from the cache without a keyring", len(got))
+	}
+}
+
+func TestCacheTrustsCheckedProperties(t *testing.T) {
+	sb, fake := newTestS3Backend(t, S3Config{})
+	cache, err := NewDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileSystem{Backend: sb, ContainerName: testBucket, Cache: cache}
+	if err := fs.UploadFile(bytes.NewReader([]byte("first")), "a.wav"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := fake.countRequests("HEAD", "")
+	for i := 0; i < 3; i++ {
+		if got, err := readCached(fs, "a.wav"); err != nil || string(got) != "first" {
+			t.Fatalf("read %q, %v", got, err)
+		}
+	}
+	if n := fake.countRequests("HEAD", "") - before; n != 1 {
+		t.Errorf("looked up the properties %d times, want 1", n)
+	}
+
+	// a write through the file system is seen right away
+	if err := fs.UploadFile(bytes.NewReader([]byte("second")), "a.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readCached(fs, "a.wav"); err != nil || string(got) != "second" {
+		t.Errorf("read %q after overwriting, %v", got, err)
+	}
+}
+
+// a blob overwritten by another writer between the properties check and the download is read again,
+// its new bytes are never cached under the old ETag
+func TestCacheDownloadsTheCheckedVersion(t *testing.T) {
+	sb, _ := newTestS3Backend(t, S3Config{})
+	cache, err := NewDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileSystem{Backend: sb, ContainerName: testBucket, Cache: cache}
+	if err := fs.UploadFile(bytes.NewReader([]byte("first")), "a.wav"); err != nil {
+		t.Fatal(err)
+	}
+	old, err := cache.properties(sb, testBucket, "a.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sb.Upload(context.Background(), testBucket, "a.wav", bytes.NewReader([]byte("second")), nil, UploadCondition{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.Download(context.Background(), testBucket, "a.wav", 0, 0, old.ETag); !errors.Is(err, ErrConditionNotMet) {
+		t.Fatalf("download of a changed blob returned %v", err)
+	}
+	if got, err := readCached(fs, "a.wav"); err != nil || string(got) != "second" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Misses != 2 {
+		t.Errorf("cache stats %+v, want the failed fill not to be cached", stats)
+	}
+	if got, err := readCached(fs, "a.wav"); err != nil || string(got) != "second" {
+		t.Errorf("read %q from the cache, %v", got, err)
+	}
+}
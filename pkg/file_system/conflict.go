@@ -0,0 +1,123 @@
+package fileSystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ConflictPolicy decides what an upload does when a blob of the same name already exists
+type ConflictPolicy string
+
+const (
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictRename    ConflictPolicy = "rename" // store as "name (2).wav", "name (3).wav" ...
+	ConflictReject    ConflictPolicy = "reject"
+)
+
+const (
+	maxRenameAttempts    = 100
+	maxOverwriteAttempts = 5
+)
+
+var ErrUploadConflict = errors.New("a blob with that name already exists")
+
+// ParseConflictPolicy reads an onConflict value, empty keeps the old overwrite behaviour
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(value)); policy {
+	case "":
+		return ConflictOverwrite, nil
+	case ConflictOverwrite, ConflictRename, ConflictReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q, expected overwrite, rename or reject", value)
+	}
+}
+
+// renamedBlob returns the nth candidate name, e.g. "mixes/take (2).wav" for "mixes/take.wav"
+func renamedBlob(filename string, n int) string {
+	dir, base := path.Split(filename)
+	ext := path.Ext(base)
+	return fmt.Sprintf("%s%s (%d)%s", dir, strings.TrimSuffix(base, ext), n, ext)
+}
+
+// UploadFileWithPolicy uploads a file using conditional writes so a concurrent upload of the same
+// name is never silently replaced, and returns the name the file was stored under.
+// reject fails with ErrUploadConflict (wrapping ErrConditionNotMet) if the name is taken, rename picks
+// the first free "name (n).ext" and overwrite only replaces the version it saw (retrying if that
+// changes underneath it)
+func (fs *FileSystem) UploadFileWithPolicy(ctx context.Context, r io.Reader, filename string, clientID string, policy ConflictPolicy) (string, error) {
+	fmt.Println("Uploading " + filename)
+
+	// a conditional write can lose and be retried, so the contents have to be readable more than once
+	src, ok := r.(io.ReadSeeker)
+	if !ok {
+		tmpFile, err := os.CreateTemp("", "upload-*")
+		if err != nil {
+			return "", err
+		}
+		defer tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+		if _, err := io.Copy(tmpFile, r); err != nil {
+			return "", err
+		}
+		src = tmpFile
+	}
+
+	attempt := func(name string, cond UploadCondition) error {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return fs.upload(ctx, src, name, uploadOptions{clientID: clientID, cond: cond})
+	}
+
+	switch policy {
+	case ConflictReject:
+		err := attempt(filename, UploadCondition{IfNoneMatch: true})
+		if errors.Is(err, ErrConditionNotMet) {
+			return "", fmt.Errorf("%w: %s: %w", ErrUploadConflict, filename, err)
+		}
+		if err != nil {
+			return "", err
+		}
+		return filename, nil
+
+	case ConflictRename:
+		for n := 1; n <= maxRenameAttempts; n++ {
+			name := filename
+			if n > 1 {
+				name = renamedBlob(filename, n)
+			}
+			err := attempt(name, UploadCondition{IfNoneMatch: true})
+			if errors.Is(err, ErrConditionNotMet) {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			return name, nil
+		}
+		return "", fmt.Errorf("%w: no free name for %s after %d attempts", ErrUploadConflict, filename, maxRenameAttempts)
+
+	default:
+		for i := 0; i < maxOverwriteAttempts; i++ {
+			cond := UploadCondition{IfNoneMatch: true}
+			if props, err := fs.Backend.Properties(ctx, fs.ContainerName, filename); err == nil {
+				cond = UploadCondition{IfMatch: props.ETag}
+			}
+			err := attempt(filename, cond)
+			if errors.Is(err, ErrConditionNotMet) {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			return filename, nil
+		}
+		return "", fmt.Errorf("%s kept changing during the upload, gave up after %d attempts", filename, maxOverwriteAttempts)
+	}
+}
@@ -0,0 +1,112 @@
+package fileSystem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// racingBackend uploads another version of a blob right after its properties are looked up,
+// like a concurrent upload between the lookup and the conditional write
+type racingBackend struct {
+	Backend
+	races int
+}
+
+func (rb *racingBackend) Properties(ctx context.Context, container string, name string) (BlobProperties, error) {
+	props, err := rb.Backend.Properties(ctx, container, name)
+	if err == nil && rb.races > 0 {
+		rb.races--
+		err = rb.Backend.Upload(ctx, container, name, strings.NewReader(fmt.Sprintf("concurrent %d", rb.races)), nil, UploadCondition{})
+	}
+	return props, err
+}
+
+func readBlob(t *testing.T, fs *FileSystem, name string) string {
+	t.Helper()
+	data, err := readRange(fs, name, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUploadFileWithPolicy(t *testing.T) {
+	sb, _ := newTestS3Backend(t, S3Config{})
+	fs := &FileSystem{Backend: sb, ContainerName: testBucket}
+	ctx := context.Background()
+	upload := func(name string, data string, policy ConflictPolicy) (string, error) {
+		return fs.UploadFileWithPolicy(ctx, bytes.NewBufferString(data), name, "client", policy)
+	}
+	if _, err := upload("take.wav", "first", ConflictReject); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := upload("take.wav", "second", ConflictReject)
+	if !errors.Is(err, ErrUploadConflict) || !errors.Is(err, ErrConditionNotMet) {
+		t.Errorf("rejected upload returned %v", err)
+	}
+	if got := readBlob(t, fs, "take.wav"); got != "first" {
+		t.Errorf("rejected upload replaced the blob with %q", got)
+	}
+
+	for _, want := range []string{"take (2).wav", "take (3).wav"} {
+		name, err := upload("take.wav", want, ConflictRename)
+		if err != nil || name != want {
+			t.Errorf("renamed upload stored as %q, %v, want %q", name, err, want)
+		}
+	}
+	// a free name is used as is
+	if name, err := upload("mixes/new.wav", "new", ConflictRename); err != nil || name != "mixes/new.wav" {
+		t.Errorf("renamed upload of a free name stored as %q, %v", name, err)
+	}
+
+	if _, err := upload("take.wav", "overwritten", ConflictOverwrite); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, fs, "take.wav"); got != "overwritten" {
+		t.Errorf("overwrite stored %q", got)
+	}
+}
+
+func TestUploadOverwriteRechecksTheVersion(t *testing.T) {
+	sb, _ := newTestS3Backend(t, S3Config{})
+	rb := &racingBackend{Backend: sb}
+	fs := &FileSystem{Backend: rb, ContainerName: testBucket}
+	ctx := context.Background()
+	if err := fs.UploadFile(bytes.NewReader([]byte("first")), "take.wav"); err != nil {
+		t.Fatal(err)
+	}
+	props, err := sb.Properties(ctx, testBucket, "take.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a write conditional on a stale ETag fails
+	err = sb.Upload(ctx, testBucket, "take.wav", bytes.NewReader([]byte("stale")), nil, UploadCondition{IfMatch: `"stale"`})
+	if !errors.Is(err, ErrConditionNotMet) {
+		t.Errorf("upload with a stale ETag returned %v", err)
+	}
+
+	// the version changes between the lookup and the write, the overwrite looks it up again
+	rb.races = 2
+	if _, err := fs.UploadFileWithPolicy(ctx, bytes.NewBufferString("mine"), "take.wav", "", ConflictOverwrite); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, fs, "take.wav"); got != "mine" {
+		t.Errorf("overwrite stored %q", got)
+	}
+	if current, _ := sb.Properties(ctx, testBucket, "take.wav"); current.ETag == props.ETag {
+		t.Error("the ETag didn't change")
+	}
+
+	// it gives up if the blob keeps changing
+	rb.races = maxOverwriteAttempts
+	_, err = fs.UploadFileWithPolicy(ctx, bytes.NewBufferString("lost"), "take.wav", "", ConflictOverwrite)
+	if err == nil || readBlob(t, fs, "take.wav") != "concurrent 0" {
+		t.Errorf("overwrite of a blob that kept changing returned %v", err)
+	}
+}
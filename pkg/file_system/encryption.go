@@ -0,0 +1,408 @@
+package fileSystem
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envelope encryption for stored audio: every blob gets its own random data key, which is
+// wrapped (AES-GCM) with the owning client's key from a local keyfile and stored in the blob metadata.
+// the data itself is sealed in fixed size AES-GCM chunks so ranged reads only need the chunks they touch.
+// the last chunk is sealed as final, so a blob cut short at a chunk boundary fails to decrypt, and an
+// empty blob still has one (empty) chunk. functions/shared_code/blob_crypto.py implements the same format
+
+const (
+	encryptionVersion   = "v1"
+	encryptionChunkSize = 64 * 1024
+	encryptionOverhead  = 16 // AES-GCM tag appended to every chunk
+	defaultClientID     = "default"
+
+	metaEncryption = "manicenc"
+	metaClientID   = "manicclient"
+	metaWrappedKey = "manickey"
+	metaNonce      = "manicnonce"
+	metaChunkSize  = "manicchunk"
+)
+
+var ErrUnknownClientKey = errors.New("no encryption key for client")
+
+// KeyRing holds the per-client key encryption keys loaded from a keyfile
+type KeyRing struct {
+	keys map[string][]byte
+}
+
+// LoadKeyRing reads a keyfile of the form {"<clientID>": "<base64 32 byte key>", ...}.
+// the "default" entry, if present, is used for uploads that don't name a client
+func LoadKeyRing(path string) (*KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := map[string]string{}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("could not parse keyfile %s: %w", path, err)
+	}
+
+	kr := &KeyRing{keys: make(map[string][]byte)}
+	for clientID, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode key for client %s: %w", clientID, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key for client %s must be 32 bytes, got %d", clientID, len(key))
+		}
+		kr.keys[clientID] = key
+	}
+
+	return kr, nil
+}
+
+func (kr *KeyRing) key(clientID string) ([]byte, error) {
+	if clientID == "" {
+		clientID = defaultClientID
+	}
+	key, ok := kr.keys[clientID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownClientKey, clientID)
+	}
+	return key, nil
+}
+
+// checksumKey derives the key of the HMAC that replaces plain checksums of clientID's blobs, so
+// stored metadata doesn't fingerprint encrypted content
+func (kr *KeyRing) checksumKey(clientID string) ([]byte, error) {
+	clientKey, err := kr.key(clientID)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, clientKey)
+	mac.Write([]byte("manic checksum"))
+	return mac.Sum(nil), nil
+}
+
+// blobEnvelope is the decoded encryption metadata of a single blob
+type blobEnvelope struct {
+	aead      cipher.AEAD
+	nonce     []byte
+	chunkSize int64
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newEnvelope generates a fresh data key for clientID and returns it along with the metadata to store on the blob
+func (kr *KeyRing) newEnvelope(clientID string) (*blobEnvelope, map[string]string, error) {
+	if clientID == "" {
+		clientID = defaultClientID
+	}
+	clientKey, err := kr.key(clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	nonce := make([]byte, 12)
+	wrapNonce := make([]byte, 12)
+	for _, b := range [][]byte{dataKey, nonce, wrapNonce} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	wrapper, err := newGCM(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped := wrapper.Seal(wrapNonce, wrapNonce, dataKey, []byte(clientID))
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := map[string]string{
+		metaEncryption: encryptionVersion,
+		metaClientID:   clientID,
+		metaWrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		metaNonce:      base64.StdEncoding.EncodeToString(nonce),
+		metaChunkSize:  strconv.Itoa(encryptionChunkSize),
+	}
+
+	return &blobEnvelope{aead: aead, nonce: nonce, chunkSize: encryptionChunkSize}, metadata, nil
+}
+
+// openEnvelope unwraps the data key described by a blob's metadata, returning nil if the blob isn't encrypted
+func (kr *KeyRing) openEnvelope(metadata map[string]string) (*blobEnvelope, error) {
+	version := metadataValue(metadata, metaEncryption)
+	if version == "" {
+		return nil, nil
+	}
+	if version != encryptionVersion {
+		return nil, fmt.Errorf("unsupported blob encryption version %q", version)
+	}
+	if kr == nil {
+		return nil, errors.New("blob is encrypted but no keyring is configured")
+	}
+
+	clientID := metadataValue(metadata, metaClientID)
+	clientKey, err := kr.key(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(metadataValue(metadata, metaWrappedKey))
+	if err != nil || len(wrapped) < 12 {
+		return nil, fmt.Errorf("invalid wrapped key in blob metadata")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(metadataValue(metadata, metaNonce))
+	if err != nil || len(nonce) != 12 {
+		return nil, fmt.Errorf("invalid nonce in blob metadata")
+	}
+	chunkSize, err := strconv.ParseInt(metadataValue(metadata, metaChunkSize), 10, 64)
+	if err != nil || chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size in blob metadata")
+	}
+
+	wrapper, err := newGCM(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := wrapper.Open(nil, wrapped[:12], wrapped[12:], []byte(clientID))
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key for client %s: %w", clientID, err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobEnvelope{aead: aead, nonce: nonce, chunkSize: chunkSize}, nil
+}
+
+// chunkNonce derives a unique nonce per chunk from the blob's base nonce
+func (env *blobEnvelope) chunkNonce(index int64) []byte {
+	nonce := make([]byte, len(env.nonce))
+	copy(nonce, env.nonce)
+	counter := binary.BigEndian.Uint64(nonce[4:]) ^ uint64(index)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func (env *blobEnvelope) sealedChunkSize() int64 {
+	return env.chunkSize + encryptionOverhead
+}
+
+// plaintextSize recovers the original size of an encrypted blob from its stored size
+func (env *blobEnvelope) plaintextSize(ciphertextSize int64) int64 {
+	chunks := (ciphertextSize + env.sealedChunkSize() - 1) / env.sealedChunkSize()
+	return ciphertextSize - chunks*encryptionOverhead
+}
+
+// chunkAAD authenticates the position of a chunk and whether it is the last one
+func (env *blobEnvelope) chunkAAD(index int64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(index))
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// lastChunk is the index of the last chunk of a blob of the given stored size
+func (env *blobEnvelope) lastChunk(ciphertextSize int64) int64 {
+	return max((ciphertextSize+env.sealedChunkSize()-1)/env.sealedChunkSize()-1, 0)
+}
+
+// encryptReader seals plaintext from src chunk by chunk as it is read, looking one byte ahead to
+// seal the last chunk as final
+type encryptReader struct {
+	env   *blobEnvelope
+	src   *bufio.Reader
+	index int64
+	plain []byte
+	out   []byte
+	done  bool
+}
+
+func (env *blobEnvelope) encryptReader(src io.Reader) io.Reader {
+	return &encryptReader{env: env, src: bufio.NewReader(src), plain: make([]byte, env.chunkSize)}
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(er.src, er.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		final := err != nil
+		if !final {
+			if _, err := er.src.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		er.done = final
+		er.out = er.env.aead.Seal(er.out[:0], er.env.chunkNonce(er.index), er.plain[:n], er.env.chunkAAD(er.index, final))
+		er.index++
+	}
+
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+// decryptReader opens sealed chunks from src, starting at chunk index and dropping skip leading plaintext bytes.
+// last is the index of the blob's last chunk
+type decryptReader struct {
+	env    *blobEnvelope
+	src    io.ReadCloser
+	index  int64
+	last   int64
+	skip   int64
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+func (env *blobEnvelope) decryptReader(src io.ReadCloser, firstChunk int64, lastChunk int64, skip int64) io.ReadCloser {
+	return &decryptReader{
+		env:    env,
+		src:    src,
+		index:  firstChunk,
+		last:   lastChunk,
+		skip:   skip,
+		sealed: make([]byte, env.sealedChunkSize()),
+	}
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(dr.src, dr.sealed)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			dr.done = true
+		} else if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		plain, err := dr.env.aead.Open(dr.out[:0], dr.env.chunkNonce(dr.index), dr.sealed[:n], dr.env.chunkAAD(dr.index, dr.index == dr.last))
+		if err != nil {
+			return 0, fmt.Errorf("could not decrypt chunk %d: %w", dr.index, err)
+		}
+		dr.index++
+		if dr.skip > 0 {
+			drop := min(dr.skip, int64(len(plain)))
+			plain = plain[drop:]
+			dr.skip -= drop
+		}
+		dr.out = plain
+	}
+
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) Close() error {
+	return dr.src.Close()
+}
+
+// limitedReadCloser caps a ReadCloser at n bytes
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// openDecryptedRange downloads only the sealed chunks covering [offset, offset+count) of the plaintext
+// and returns a reader over exactly that plaintext range. a count of 0 reads to the end of the blob.
+// size and etag are those of the stored blob env was read from, the download fails if it changed since
+func (fs *FileSystem) openDecryptedRange(env *blobEnvelope, blobName string, offset int64, count int64, size int64, etag string) (io.ReadCloser, error) {
+	if size < encryptionOverhead {
+		return nil, fmt.Errorf("encrypted blob %s is truncated", blobName)
+	}
+	plainSize := env.plaintextSize(size)
+	if offset >= plainSize {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if count <= 0 || offset+count > plainSize {
+		count = plainSize - offset
+	}
+
+	firstChunk := offset / env.chunkSize
+	lastChunk := (offset + count - 1) / env.chunkSize
+	sealedOffset := firstChunk * env.sealedChunkSize()
+	sealedEnd := min((lastChunk+1)*env.sealedChunkSize(), size)
+
+	sealed, err := fs.Backend.Download(context.TODO(), fs.ContainerName, blobName, sealedOffset, sealedEnd-sealedOffset, etag)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := env.decryptReader(sealed, firstChunk, env.lastChunk(size), offset-firstChunk*env.chunkSize)
+	return limitedReadCloser{Reader: io.LimitReader(plain, count), Closer: plain}, nil
+}
+
+// blobEnvelope looks up the encryption envelope and stored properties of a blob; env is nil for plain blobs
+func (fs *FileSystem) blobEnvelope(blobName string) (*blobEnvelope, BlobProperties, error) {
+	props, err := fs.Backend.Properties(context.TODO(), fs.ContainerName, blobName)
+	if err != nil {
+		return nil, BlobProperties{}, err
+	}
+
+	env, err := fs.KeyRing.openEnvelope(props.Metadata)
+	return env, props, err
+}
+
+// openBlob returns a reader over the plaintext of a blob range, decrypting when the blob was stored encrypted.
+// the metadata is always checked, so an encrypted blob fails to open without a keyring instead of
+// being streamed as ciphertext
+func (fs *FileSystem) openBlob(blobName string, offset int64, count int64) (io.ReadCloser, error) {
+	env, props, err := fs.blobEnvelope(blobName)
+	if err != nil {
+		return nil, err
+	}
+	if env != nil {
+		return fs.openDecryptedRange(env, blobName, offset, count, props.Size, props.ETag)
+	}
+	return fs.Backend.Download(context.TODO(), fs.ContainerName, blobName, offset, count, "")
+}
+
+// metadataValue does a case insensitive lookup, the service may return canonicalized header names
+func metadataValue(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
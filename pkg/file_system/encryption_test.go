@@ -0,0 +1,199 @@
+package fileSystem
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKeyRing(t *testing.T) *KeyRing {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keyFile := fmt.Sprintf(`{"default": %q}`, base64.StdEncoding.EncodeToString(key))
+	if err := os.WriteFile(path, []byte(keyFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := LoadKeyRing(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func newTestEncryptedFileSystem(t *testing.T) *FileSystem {
+	t.Helper()
+	sb, _ := newTestS3Backend(t, S3Config{})
+	return &FileSystem{Backend: sb, ContainerName: testBucket, KeyRing: newTestKeyRing(t)}
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	return data
+}
+
+func readRange(fs *FileSystem, name string, offset int64, length int64) ([]byte, error) {
+	stream, err := fs.OpenRange(name, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	fs := newTestEncryptedFileSystem(t)
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 2*encryptionChunkSize + 100} {
+		name := fmt.Sprintf("%d.wav", size)
+		data := testData(size)
+		if err := fs.UploadFile(bytes.NewReader(data), name); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fs.Size(name); err != nil || got != int64(size) {
+			t.Errorf("size of %s is %d, %v", name, got, err)
+		}
+		got, err := readRange(fs, name, 0, 0)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("read %d bytes of %s, %v", len(got), name, err)
+		}
+		// a range across the chunk boundary
+		if size >= encryptionChunkSize+10 {
+			offset := int64(encryptionChunkSize - 10)
+			got, err := readRange(fs, name, offset, 20)
+			if err != nil || !bytes.Equal(got, data[offset:offset+20]) {
+				t.Errorf("read %q of %s at %d, %v", got, name, offset, err)
+			}
+		}
+	}
+}
+
+// replaceSealed stores sealed under name with the metadata name already has
+func replaceSealed(t *testing.T, fs *FileSystem, name string, sealed []byte) {
+	t.Helper()
+	ctx := context.Background()
+	props, err := fs.Backend.Properties(ctx, fs.ContainerName, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Backend.Upload(ctx, fs.ContainerName, name, bytes.NewReader(sealed), props.Metadata, UploadCondition{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSealed(t *testing.T, fs *FileSystem, name string) []byte {
+	t.Helper()
+	stream, err := fs.Backend.Download(context.Background(), fs.ContainerName, name, 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	sealed, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestEncryptionDetectsTruncation(t *testing.T) {
+	fs := newTestEncryptedFileSystem(t)
+	data := testData(2*encryptionChunkSize + 100)
+	if err := fs.UploadFile(bytes.NewReader(data), "long.wav"); err != nil {
+		t.Fatal(err)
+	}
+	sealed := readSealed(t, fs, "long.wav")
+	sealedChunk := encryptionChunkSize + encryptionOverhead
+
+	// drop the last chunk, the chunk before it wasn't sealed as final
+	replaceSealed(t, fs, "long.wav", sealed[:2*sealedChunk])
+	if got, err := readRange(fs, "long.wav", 0, 0); err == nil {
+		t.Errorf("read %d bytes of a truncated blob", len(got))
+	}
+	if got, err := readRange(fs, "long.wav", encryptionChunkSize+1, 10); err == nil {
+		t.Errorf("read %q from the new last chunk of a truncated blob", got)
+	}
+	// ranges before the cut aren't affected
+	if got, err := readRange(fs, "long.wav", 10, 10); err != nil || !bytes.Equal(got, data[10:20]) {
+		t.Errorf("read %q, %v", got, err)
+	}
+
+	// an empty blob has a final chunk too
+	if err := fs.UploadFile(bytes.NewReader(nil), "empty.wav"); err != nil {
+		t.Fatal(err)
+	}
+	replaceSealed(t, fs, "empty.wav", nil)
+	if _, err := readRange(fs, "empty.wav", 0, 0); err == nil {
+		t.Error("read an encrypted blob without its chunk")
+	}
+}
+
+// testdata/encryption/v1.json is shared with functions/shared_code/test_blob_crypto.py, both sides
+// have to read what the other writes
+func TestEncryptionFixture(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "encryption", "v1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := struct {
+		Keys      map[string]string `json:"keys"`
+		Metadata  map[string]string `json:"metadata"`
+		Sealed    []byte            `json:"sealed"`
+		Plaintext string            `json:"plaintext"`
+	}{}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	keys, _ := json.Marshal(fixture.Keys)
+	if err := os.WriteFile(keyFile, keys, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestEncryptedFileSystem(t)
+	if fs.KeyRing, err = LoadKeyRing(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Backend.Upload(context.Background(), fs.ContainerName, "fixture.wav", bytes.NewReader(fixture.Sealed), fixture.Metadata, UploadCondition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := readRange(fs, "fixture.wav", 0, 0); err != nil || string(got) != fixture.Plaintext {
+		t.Errorf("read %q, %v", got, err)
+	}
+	// the fixture has 16 byte chunks, this range spans the last two
+	if got, err := readRange(fs, "fixture.wav", 20, 18); err != nil || string(got) != fixture.Plaintext[20:38] {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+func TestEncryptedBlobNeedsKeyRing(t *testing.T) {
+	fs := newTestEncryptedFileSystem(t)
+	if err := fs.UploadFile(bytes.NewReader(testData(100)), "secret.wav"); err != nil {
+		t.Fatal(err)
+	}
+	plain := &FileSystem{Backend: fs.Backend, ContainerName: fs.ContainerName}
+	if got, err := readRange(plain, "secret.wav", 0, 0); err == nil {
+		t.Errorf("read %d bytes of ciphertext without a keyring", len(got))
+	}
+	if _, err := plain.Size("secret.wav"); err == nil {
+		t.Error("got the size of an encrypted blob without a keyring")
+	}
+
+	// plain blobs still read without one
+	if err := plain.UploadFile(bytes.NewReader([]byte("plain")), "plain.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readRange(plain, "plain.wav", 0, 0); err != nil || string(got) != "plain" {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
@@ -0,0 +1,56 @@
+package fileSystem
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxBlobNameLength = 255
+
+var ErrInvalidFileName = errors.New("invalid file name")
+
+// SanitizeFileName reduces a client supplied file name to a safe flat blob name: any directory
+// components are dropped, control characters and characters that could break out of a header
+// or path are removed, and names that end up empty or as dot segments are rejected
+func SanitizeFileName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", ErrInvalidFileName
+	}
+
+	// keep only the last path element, browsers on windows may send backslash separated paths
+	if idx := strings.LastIndexAny(name, `/\`); idx >= 0 {
+		name = name[idx+1:]
+	}
+
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`"<>:|?*;`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	cleaned = strings.TrimSpace(cleaned)
+	cleaned = strings.TrimLeft(cleaned, ".")
+
+	if cleaned == "" {
+		return "", ErrInvalidFileName
+	}
+	if len(cleaned) > maxBlobNameLength {
+		// trim from the front of the stem so the extension survives
+		ext := ""
+		if idx := strings.LastIndex(cleaned, "."); idx > 0 && len(cleaned)-idx <= 10 {
+			ext = cleaned[idx:]
+		}
+		stem := []rune(strings.TrimSuffix(cleaned, ext))
+		for len(string(stem))+len(ext) > maxBlobNameLength {
+			stem = stem[:len(stem)-1]
+		}
+		cleaned = string(stem) + ext
+	}
+
+	return cleaned, nil
+}
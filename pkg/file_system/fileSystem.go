@@ -5,24 +5,32 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 )
 
 type FileSystem struct {
-	ServiceClient *azblob.Client
-	Files         []BlobInfo
-	ContainerName string
+	Backend        Backend
+	Files          []BlobInfo
+	ContainerName  string
+	KeyRing        *KeyRing      // optional, when set uploads are envelope encrypted and downloads decrypted
+	Cache          *DiskCache    // optional read-through cache for whole file downloads
+	TrashRetention time.Duration // when > 0 deletes move blobs to the trash for this long instead of removing them
 }
 
 type BlobInfo struct {
-	Name string
-	Size int64
+	Name         string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	Metadata     map[string]string `json:"-"` // nil when the backend doesn't list metadata (S3)
 }
 
 func handleError(err error) {
@@ -37,26 +45,63 @@ func CreateServiceClient(connectionString string) *azblob.Client {
 	return serviceClient
 }
 
+// UploadFiles imports every file under directory (recursively), blob names are the relative paths
 func (fs *FileSystem) UploadFiles(directory string) []string {
 	fmt.Println("UPLOADING FILES")
-	items, _ := os.ReadDir(directory)
-	inputFiles := []string{}
-	for _, item := range items {
-		fmt.Println("Uploading " + item.Name())
-
-		filePath := directory + "/" + item.Name()
-		f, _ := os.Open(filePath)
-		defer f.Close()
-
-		_, err := fs.ServiceClient.UploadFile(context.TODO(), fs.ContainerName, item.Name(), f, nil)
-		handleError(err)
-		inputFiles = append(inputFiles, item.Name())
+	report, err := fs.Import(context.TODO(), ImportOptions{Directory: directory}, func(event ImportEvent) {
+		if event.Path != "" {
+			fmt.Printf("%s %s\n", event.Status, event.Path)
+		}
+	})
+	handleError(err)
+	for _, failure := range report.Failures {
+		log.Printf("could not upload %s: %s", failure.Path, failure.Error)
 	}
-	return inputFiles
+	return append(report.Uploaded, report.Skipped...)
 }
 
 func (fs *FileSystem) UploadFile(r io.Reader, filename string) error {
+	return fs.UploadFileForClient(r, filename, "")
+}
+
+// UploadFileForClient uploads a file, encrypting it with clientID's key when a keyring is configured
+func (fs *FileSystem) UploadFileForClient(r io.Reader, filename string, clientID string) error {
 	fmt.Println("Uploading " + filename)
+	return fs.upload(context.TODO(), r, filename, uploadOptions{clientID: clientID})
+}
+
+type uploadOptions struct {
+	clientID string
+	metadata map[string]string // stored with the blob alongside any encryption metadata
+	cond     UploadCondition
+}
+
+func (fs *FileSystem) upload(ctx context.Context, r io.Reader, filename string, opts uploadOptions) error {
+	defer fs.forgetCached(filename)
+	metadata := map[string]string{}
+	for key, value := range opts.metadata {
+		metadata[key] = value
+	}
+	// kept on plain blobs too, the usage report attributes blobs by it
+	if opts.clientID != "" {
+		metadata[metaClientID] = opts.clientID
+	}
+
+	if fs.KeyRing != nil {
+		env, envelopeMetadata, err := fs.KeyRing.newEnvelope(opts.clientID)
+		if err != nil {
+			return err
+		}
+		for key, value := range envelopeMetadata {
+			metadata[key] = value
+		}
+		return fs.Backend.Upload(ctx, fs.ContainerName, filename, env.encryptReader(r), metadata, opts.cond)
+	}
+
+	// local files can be uploaded directly
+	if f, ok := r.(*os.File); ok {
+		return fs.Backend.Upload(ctx, fs.ContainerName, filename, f, metadata, opts.cond)
+	}
 
 	// create a temporary file to store the contents of the reader
 	tmpFile, err := os.CreateTemp("", "upload-*")
@@ -78,10 +123,7 @@ func (fs *FileSystem) UploadFile(r io.Reader, filename string) error {
 		return err
 	}
 
-	_, err = fs.ServiceClient.UploadFile(context.TODO(), fs.ContainerName, filename, tmpFile, nil)
-	handleError(err)
-
-	return nil
+	return fs.Backend.Upload(ctx, fs.ContainerName, filename, tmpFile, metadata, opts.cond)
 }
 
 func (fs *FileSystem) DownloadFile(fileName string) {
@@ -94,16 +136,7 @@ func (fs *FileSystem) DownloadFile(fileName string) {
 	}(destFile)
 
 	// Perform download
-	_, err = fs.ServiceClient.DownloadFile(
-		context.TODO(),
-		fs.ContainerName,
-		fileName,
-		destFile,
-		&azblob.DownloadFileOptions{},
-	)
-
-	// Assert download was successful
-	handleError(err)
+	fs.downloadTo(fileName, destFile)
 }
 
 func (fs *FileSystem) DownloadFileToDst(fileName string, dstFileName string) {
@@ -116,38 +149,48 @@ func (fs *FileSystem) DownloadFileToDst(fileName string, dstFileName string) {
 	}(destFile)
 
 	// Perform download
-	_, err = fs.ServiceClient.DownloadFile(
-		context.TODO(),
-		fs.ContainerName,
-		fileName,
-		destFile,
-		&azblob.DownloadFileOptions{},
-	)
+	fs.downloadTo(fileName, destFile)
+}
+
+// downloadTo copies a blob into destFile, from the local cache when one is configured
+func (fs *FileSystem) downloadTo(fileName string, destFile *os.File) {
+	var stream io.ReadCloser
+	var err error
+	if fs.Cache != nil {
+		stream, err = fs.openCached(fileName)
+	} else {
+		stream, err = fs.openBlob(fileName, 0, 0)
+	}
+	handleError(err)
+	defer stream.Close()
 
 	// Assert download was successful
+	_, err = io.Copy(destFile, stream)
 	handleError(err)
 }
 
 func (fs *FileSystem) DownloadHTTPFileStream(w http.ResponseWriter, fileName string) {
 	// set expected headers
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	// FormatMediaType quotes the name (or switches to RFC 2231 encoding) so it can't inject header fields
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(fileName)}))
 	w.Header().Set("Content-Type", "application/octet-stream")
 
-	// open download stream from blob
-	response, err := fs.ServiceClient.DownloadStream(
-		context.Background(),
-		fs.ContainerName,
-		fileName,
-		&azblob.DownloadStreamOptions{},
-	)
+	// open download stream from the cache or blob (decrypted if stored encrypted)
+	var body io.ReadCloser
+	var err error
+	if fs.Cache != nil {
+		body, err = fs.openCached(fileName)
+	} else {
+		body, err = fs.openBlob(fileName, 0, 0)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("could not download blob: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer response.Body.Close()
+	defer body.Close()
 
 	// copy the blob stream over to the response writer
-	if _, err = io.Copy(w, response.Body); err != nil {
+	if _, err = io.Copy(w, body); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -155,37 +198,46 @@ func (fs *FileSystem) DownloadHTTPFileStream(w http.ResponseWriter, fileName str
 }
 
 func (fs *FileSystem) ListBlobs() []BlobInfo {
+	blob_list, err := fs.List(context.TODO())
+	handleError(err)
+	return blob_list
+}
 
-	pager := fs.ServiceClient.NewListBlobsFlatPager(fs.ContainerName, &azblob.ListBlobsFlatOptions{
-		// Include: container.ListBlobsInclude{Deleted: true, Versions: true},
-	})
+// List returns every blob in the container (excluding the trash), unlike ListBlobs it reports failures instead of exiting
+func (fs *FileSystem) List(ctx context.Context) ([]BlobInfo, error) {
+	blobs, err := fs.Backend.List(ctx, fs.ContainerName)
+	if err != nil {
+		return nil, err
+	}
 
 	blob_list := []BlobInfo{}
-
-	for pager.More() {
-		resp, err := pager.NextPage(context.TODO())
-		handleError(err) // if err is not nil, break the loop.
-		for _, _blob := range resp.Segment.BlobItems {
-			element := &BlobInfo{
-				Name: *_blob.Name,
-				Size: *_blob.Properties.ContentLength,
-			}
-			blob_list = append(blob_list, *element)
+	for _, blob := range blobs {
+		if !strings.HasPrefix(blob.Name, trashPrefix) {
+			blob_list = append(blob_list, blob)
 		}
 	}
-
-	return blob_list
+	return blob_list, nil
 }
 
 func (fs *FileSystem) DeleteBlob(blobName string) {
-	_, err := fs.ServiceClient.DeleteBlob(context.TODO(), fs.ContainerName, blobName, nil)
+	err := fs.Delete(context.TODO(), blobName)
 	handleError(err)
 }
 
+// Delete moves a blob to the trash when a retention is configured, otherwise removes it for good
+func (fs *FileSystem) Delete(ctx context.Context, blobName string) error {
+	defer fs.forgetCached(blobName)
+	if fs.TrashRetention > 0 {
+		return fs.moveToTrash(ctx, blobName)
+	}
+	return fs.Backend.Delete(ctx, fs.ContainerName, blobName)
+}
+
 func (fs *FileSystem) ClearContainer() {
-	blob_list := fs.ListBlobs()
-	for _, blob := range blob_list {
-		fs.DeleteBlob(blob.Name)
+	report, err := fs.BatchDelete(context.TODO(), BatchDeleteOptions{}, nil)
+	handleError(err)
+	for _, failure := range report.Failures {
+		log.Printf("could not delete %s: %s", failure.Name, failure.Error)
 	}
 }
 
@@ -193,20 +245,25 @@ func (fs *FileSystem) ClearContainer() {
 func (fs *FileSystem) UploadBlob(blobName string, blobData string) {
 	// could also use bytes
 	// blobContentReader := bytes.NewReader(blobData)
-	_, err := fs.ServiceClient.UploadStream(
-		context.TODO(),
-		fs.ContainerName,
-		blobName,
-		strings.NewReader(blobData),
-		&azblob.UploadStreamOptions{},
-	)
+	var blobContentReader io.Reader = strings.NewReader(blobData)
+	var metadata map[string]string
+
+	if fs.KeyRing != nil {
+		env, envelopeMetadata, err := fs.KeyRing.newEnvelope("")
+		handleError(err)
+		blobContentReader = env.encryptReader(blobContentReader)
+		metadata = envelopeMetadata
+	}
+
+	err := fs.Backend.Upload(context.TODO(), fs.ContainerName, blobName, blobContentReader, metadata, UploadCondition{})
+	fs.forgetCached(blobName)
 
 	handleError(err)
 }
 
 // Download blob from the file system
-// Uses the DownloadStream method to stream a blob's contents to a local file.
-// Uses intelligent retries to download the blob.
+// Uses OpenRange to stream a blob's contents, optionally also saving them to a local file.
+// rangeStart and rangeEnd are inclusive byte offsets like an HTTP Range, pass -1 for the whole blob.
 func (fs *FileSystem) DownloadBlob(
 	blobName string,
 	rangeStart int64,
@@ -214,26 +271,16 @@ func (fs *FileSystem) DownloadBlob(
 	saveToFile bool,
 ) string {
 
-	var downloadStreamOptions blob.DownloadStreamOptions
+	var offset, count int64
 
-	if rangeStart >= 0 && rangeEnd >= 0 {
-		downloadStreamOptions = azblob.DownloadStreamOptions{
-			Range: azblob.HTTPRange{
-				Offset: rangeStart, // specify the start of the range
-				Count:  rangeEnd,   // specify the end of the range
-			},
-		}
+	if rangeStart >= 0 && rangeEnd >= rangeStart {
+		offset = rangeStart               // specify the start of the range
+		count = rangeEnd - rangeStart + 1 // the end is inclusive
 	}
 
-	// Download returns an intelligent retryable stream around a blob; it returns an io.ReadCloser.
-	dr, err := fs.ServiceClient.DownloadStream(
-		context.TODO(),
-		fs.ContainerName,
-		blobName,
-		&downloadStreamOptions,
-	)
+	// OpenRange returns an intelligent retryable stream around a blob (decrypted if stored encrypted); it returns an io.ReadCloser.
+	rs, err := fs.OpenRange(blobName, offset, count)
 	handleError(err)
-	rs := dr.Body
 
 	// NewResponseBodyProgress wraps the GetRetryStream with progress reporting; it returns an io.ReadCloser.
 	stream := streaming.NewResponseProgress(
@@ -249,6 +296,9 @@ func (fs *FileSystem) DownloadBlob(
 		}
 	}(stream) // The client must close the response body when finished with it
 
+	buf := new(strings.Builder)
+	var dst io.Writer = buf
+
 	if saveToFile {
 
 		file, err := os.Create(blobName) // Create the file to hold the downloaded blob contents.
@@ -260,14 +310,15 @@ func (fs *FileSystem) DownloadBlob(
 			}
 		}(file)
 
-		written, err := io.Copy(file, stream) // Write to the file by reading from the blob (with intelligent retries).
-		handleError(err)
-		fmt.Printf("Wrote %d bytes.\n", written)
+		// the stream can only be read once, so write to the file and the returned string together
+		dst = io.MultiWriter(file, buf)
 	}
 
-	buf := new(strings.Builder)
-	_, err = io.Copy(buf, stream)
+	written, err := io.Copy(dst, stream) // Read from the blob (with intelligent retries).
 	handleError(err)
+	if saveToFile {
+		fmt.Printf("Wrote %d bytes.\n", written)
+	}
 
 	return buf.String()
 }
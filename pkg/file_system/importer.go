@@ -0,0 +1,316 @@
+package fileSystem
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	audioTypes "manic-compression/pkg/audio_types"
+)
+
+const (
+	defaultImportConcurrency = 4
+	maxImportConcurrency     = 16
+	metaChecksum             = "manicsha256"
+	metaChecksumHMAC         = "manichmac" // keyed per client, used instead of metaChecksum with a keyring
+)
+
+// import outcomes reported per file
+const (
+	ImportUploaded = "uploaded"
+	ImportSkipped  = "skipped" // already present with the same checksum
+	ImportFailed   = "failed"
+)
+
+// ImportOptions configures a bulk import of a local directory tree. Include and Exclude are
+// path.Match globs tried against both the slash separated path relative to Directory and the
+// base name, so "*.wav" matches at any depth and "drafts/*" only directly under drafts
+type ImportOptions struct {
+	Directory      string
+	Include        []string // when set, only matching files are imported
+	Exclude        []string
+	Prefix         string // prepended to the relative path to form the blob name
+	ClientID       string
+	Concurrency    int      // parallel uploads, capped at maxImportConcurrency
+	AllowedFormats []string // when set, files have to sniff as one of these audio formats
+}
+
+type ImportFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	Total    int             `json:"total"`
+	Uploaded []string        `json:"uploaded"`
+	Skipped  []string        `json:"skipped"`
+	Failures []ImportFailure `json:"failures"`
+}
+
+// ImportEvent is passed to the progress callback, once with Total set after the walk and then once per file
+type ImportEvent struct {
+	Total    int
+	Path     string
+	BlobName string
+	Status   string
+	Err      error
+}
+
+func (opts ImportOptions) Validate() error {
+	if strings.HasPrefix(strings.TrimLeft(opts.Prefix, "/"), trashPrefix) {
+		return fmt.Errorf("prefix %q is reserved for the trash", opts.Prefix)
+	}
+	if opts.Prefix != "" {
+		if _, err := importBlobName(opts.Prefix, "x"); err != nil {
+			return fmt.Errorf("invalid prefix %q: %w", opts.Prefix, err)
+		}
+	}
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(relPath)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// importBlobName turns the prefix and a relative path into a flat blob name like an upload gets:
+// every path element is sanitized and they're joined with "_", so "drafts/take 1.wav" becomes
+// "drafts_take 1.wav". blob names can't contain "/", the file routes take a single path element
+func importBlobName(prefix string, rel string) (string, error) {
+	elements := []string{}
+	for _, element := range strings.Split(prefix+rel, "/") {
+		if element == "" {
+			continue
+		}
+		cleaned, err := SanitizeFileName(element)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q", err, element)
+		}
+		elements = append(elements, cleaned)
+	}
+	// sanitize the result too, it trims overlong names
+	return SanitizeFileName(strings.Join(elements, "_"))
+}
+
+// checkFormat sniffs the magic bytes of a local file against the allowed formats
+func checkFormat(f *os.File, allowed []string) error {
+	header := make([]byte, audioTypes.SniffLength)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	format := audioTypes.DetectFormat(header[:n])
+	if format == "" {
+		return fmt.Errorf("not a recognised audio file")
+	}
+	if !slices.Contains(allowed, format) {
+		return fmt.Errorf("%s files are not allowed (allowed: %s)", format, strings.Join(allowed, ", "))
+	}
+	return nil
+}
+
+// walkImport collects the files to import as slash separated paths relative to the directory
+func walkImport(opts ImportOptions) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(opts.Directory, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(opts.Directory, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if len(opts.Include) > 0 && !matchesAny(opts.Include, rel) {
+			return nil
+		}
+		if matchesAny(opts.Exclude, rel) {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	return files, err
+}
+
+// newChecksum returns the hash used to recognize files already imported and the metadata it is
+// stored under. with a keyring it is an HMAC keyed per client, a plain SHA-256 of an encrypted blob
+// would fingerprint its content
+func (fs *FileSystem) newChecksum(clientID string) (hash.Hash, string, error) {
+	if fs.KeyRing == nil {
+		return sha256.New(), metaChecksum, nil
+	}
+	key, err := fs.KeyRing.checksumKey(clientID)
+	if err != nil {
+		return nil, "", err
+	}
+	return hmac.New(sha256.New, key), metaChecksumHMAC, nil
+}
+
+// fileChecksum hashes a file from its current position and rewinds it for the upload
+func fileChecksum(f *os.File, h hash.Hash) (string, error) {
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// importFile uploads one file unless a blob with the same checksum is already there
+func (fs *FileSystem) importFile(ctx context.Context, opts ImportOptions, rel string, blobName string) (string, error) {
+	f, err := os.Open(filepath.Join(opts.Directory, filepath.FromSlash(rel)))
+	if err != nil {
+		return ImportFailed, err
+	}
+	defer f.Close()
+
+	if len(opts.AllowedFormats) > 0 {
+		if err := checkFormat(f, opts.AllowedFormats); err != nil {
+			return ImportFailed, err
+		}
+	}
+	h, checksumKey, err := fs.newChecksum(opts.ClientID)
+	if err != nil {
+		return ImportFailed, err
+	}
+	checksum, err := fileChecksum(f, h)
+	if err != nil {
+		return ImportFailed, err
+	}
+
+	// a missing blob (or any other lookup failure) just means it gets uploaded
+	if props, err := fs.Backend.Properties(ctx, fs.ContainerName, blobName); err == nil {
+		if metadataValue(props.Metadata, checksumKey) == checksum {
+			return ImportSkipped, nil
+		}
+	}
+
+	err = fs.upload(ctx, f, blobName, uploadOptions{
+		clientID: opts.ClientID,
+		metadata: map[string]string{checksumKey: checksum},
+	})
+	if err != nil {
+		return ImportFailed, err
+	}
+	return ImportUploaded, nil
+}
+
+// Import walks a local directory recursively and uploads the matching files with a bounded
+// number of parallel uploads. files already stored with the same checksum are skipped and per
+// file failures are collected in the report; the returned error is for walk failures or cancellation
+func (fs *FileSystem) Import(ctx context.Context, opts ImportOptions, progress func(ImportEvent)) (ImportReport, error) {
+	report := ImportReport{Uploaded: []string{}, Skipped: []string{}, Failures: []ImportFailure{}}
+
+	if err := opts.Validate(); err != nil {
+		return report, err
+	}
+	files, err := walkImport(opts)
+	if err != nil {
+		return report, err
+	}
+	report.Total = len(files)
+	if progress != nil {
+		progress(ImportEvent{Total: report.Total})
+	}
+
+	concurrency := min(opts.Concurrency, maxImportConcurrency)
+	if concurrency <= 0 {
+		concurrency = defaultImportConcurrency
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan string)
+
+	// files whose names can't be used, or end up the same as an earlier file's, fail up front
+	fail := func(rel string, blobName string, err error) {
+		report.Failures = append(report.Failures, ImportFailure{Path: rel, Error: err.Error()})
+		if progress != nil {
+			progress(ImportEvent{Total: report.Total, Path: rel, BlobName: blobName, Status: ImportFailed, Err: err})
+		}
+	}
+	blobNames := map[string]string{}
+	usedBy := map[string]string{}
+	for _, rel := range files {
+		blobName, err := importBlobName(opts.Prefix, rel)
+		if err != nil {
+			fail(rel, "", err)
+			continue
+		}
+		if other, ok := usedBy[blobName]; ok {
+			fail(rel, blobName, fmt.Errorf("blob name %s is already used by %s", blobName, other))
+			continue
+		}
+		usedBy[blobName] = rel
+		blobNames[rel] = blobName
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range work {
+				blobName := blobNames[rel]
+				status, err := fs.importFile(ctx, opts, rel, blobName)
+
+				mu.Lock()
+				switch status {
+				case ImportUploaded:
+					report.Uploaded = append(report.Uploaded, blobName)
+				case ImportSkipped:
+					report.Skipped = append(report.Skipped, blobName)
+				default:
+					report.Failures = append(report.Failures, ImportFailure{Path: rel, Error: err.Error()})
+				}
+				if progress != nil {
+					progress(ImportEvent{Total: report.Total, Path: rel, BlobName: blobName, Status: status, Err: err})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, rel := range files {
+		if _, ok := blobNames[rel]; !ok {
+			continue
+		}
+		select {
+		case work <- rel:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return report, ctx.Err()
+}
@@ -0,0 +1,114 @@
+package fileSystem
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	audioTypes "manic-compression/pkg/audio_types"
+)
+
+var testWAVHeader = []byte("RIFF\x24\x00\x00\x00WAVEfmt ")
+
+func writeImportFiles(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestImportBlobName(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, rel, want string
+	}{
+		{"", "a.wav", "a.wav"},
+		{"", "drafts/take 1.wav", "drafts_take 1.wav"},
+		{"batch/", "drafts/a.wav", "batch_drafts_a.wav"},
+		{"batch-", "a.wav", "batch-a.wav"},
+		{"", "x/.hidden/a?.wav", "x_hidden_a_.wav"},
+	} {
+		if got, err := importBlobName(tc.prefix, tc.rel); err != nil || got != tc.want {
+			t.Errorf("importBlobName(%q, %q) = %q, %v, want %q", tc.prefix, tc.rel, got, err, tc.want)
+		}
+	}
+}
+
+func TestImportValidatesPrefix(t *testing.T) {
+	for _, prefix := range []string{".trash/", "/.trash/x/", "../", "a/../"} {
+		if err := (ImportOptions{Prefix: prefix}).Validate(); err == nil {
+			t.Errorf("prefix %q was accepted", prefix)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	sb, _ := newTestS3Backend(t, S3Config{})
+	fs := &FileSystem{Backend: sb, ContainerName: testBucket}
+	dir := writeImportFiles(t, map[string][]byte{
+		"a.wav":        testWAVHeader,
+		"drafts/b.wav": testWAVHeader,
+		"drafts_b.wav": testWAVHeader, // the same blob name as drafts/b.wav
+		"notes.wav":    []byte("not audio at all"),
+		"song.flac":    []byte("fLaC\x00\x00\x00\x22"),
+	})
+
+	report, err := fs.Import(context.Background(), ImportOptions{
+		Directory:      dir,
+		Concurrency:    1000,
+		AllowedFormats: []string{audioTypes.FormatWAV, audioTypes.FormatMP3},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(report.Uploaded)
+	if !slices.Equal(report.Uploaded, []string{"a.wav", "drafts_b.wav"}) {
+		t.Errorf("uploaded %v", report.Uploaded)
+	}
+	failed := []string{}
+	for _, failure := range report.Failures {
+		failed = append(failed, failure.Path)
+	}
+	slices.Sort(failed)
+	if !slices.Equal(failed, []string{"drafts_b.wav", "notes.wav", "song.flac"}) {
+		t.Errorf("failed %v", report.Failures)
+	}
+}
+
+// with a keyring the stored checksum is keyed, a plain SHA-256 would fingerprint the encrypted content
+func TestImportEncryptedChecksum(t *testing.T) {
+	fs := newTestEncryptedFileSystem(t)
+	dir := writeImportFiles(t, map[string][]byte{"a.wav": testWAVHeader})
+	opts := ImportOptions{Directory: dir}
+
+	report, err := fs.Import(context.Background(), opts, nil)
+	if err != nil || len(report.Uploaded) != 1 {
+		t.Fatalf("uploaded %v, %v", report.Uploaded, err)
+	}
+	props, err := fs.Backend.Properties(context.Background(), fs.ContainerName, "a.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := sha256.Sum256(testWAVHeader)
+	checksum := metadataValue(props.Metadata, metaChecksumHMAC)
+	if metadataValue(props.Metadata, metaChecksum) != "" || checksum == "" || checksum == hex.EncodeToString(plain[:]) {
+		t.Errorf("stored checksum metadata %v", props.Metadata)
+	}
+
+	// it still recognizes the file
+	report, err = fs.Import(context.Background(), opts, nil)
+	if err != nil || len(report.Skipped) != 1 {
+		t.Errorf("skipped %v on the second import, %v", report.Skipped, err)
+	}
+}
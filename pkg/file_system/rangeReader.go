@@ -0,0 +1,95 @@
+package fileSystem
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrNegativeRange = errors.New("negative offset or length")
+
+// OpenRange streams length bytes of a blob starting at offset, decrypting transparently.
+// a length of 0 reads to the end of the blob. only the requested range is downloaded
+// (for encrypted blobs, the chunks covering it), so long files can be read piecewise
+func (fs *FileSystem) OpenRange(blobName string, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return nil, ErrNegativeRange
+	}
+	return fs.openBlob(blobName, offset, length)
+}
+
+// Size returns the readable size of a blob, i.e. the plaintext size of an encrypted blob
+func (fs *FileSystem) Size(blobName string) (int64, error) {
+	env, props, err := fs.blobEnvelope(blobName)
+	if err != nil {
+		return 0, err
+	}
+	if env != nil {
+		return env.plaintextSize(props.Size), nil
+	}
+	return props.Size, nil
+}
+
+// BlobReaderAt is an io.ReaderAt over one version of a blob, every ReadAt is a ranged download.
+// a ReadAt after the blob changed fails with ErrConditionNotMet.
+// wrap it in io.NewSectionReader(r, 0, r.Size()) when a Seeker is needed
+type BlobReaderAt struct {
+	fs       *FileSystem
+	blobName string
+	env      *blobEnvelope // nil for plain blobs
+	stored   BlobProperties
+	size     int64
+}
+
+// NewReaderAt looks up the blob's properties and encryption envelope once and returns a ReaderAt over it
+func (fs *FileSystem) NewReaderAt(blobName string) (*BlobReaderAt, error) {
+	env, props, err := fs.blobEnvelope(blobName)
+	if err != nil {
+		return nil, err
+	}
+	r := &BlobReaderAt{fs: fs, blobName: blobName, env: env, stored: props, size: props.Size}
+	if env != nil {
+		r.size = env.plaintextSize(props.Size)
+	}
+	return r, nil
+}
+
+func (r *BlobReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt follows the io.ReaderAt contract: it returns io.EOF when fewer than len(p) bytes are left
+func (r *BlobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeRange
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	want := min(int64(len(p)), r.size-off)
+	stream, err := r.open(off, want)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	n, err := io.ReadFull(stream, p[:want])
+	if err != nil {
+		return n, err
+	}
+	if want < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *BlobReaderAt) open(off int64, count int64) (io.ReadCloser, error) {
+	if r.env != nil {
+		return r.fs.openDecryptedRange(r.env, r.blobName, off, count, r.stored.Size, r.stored.ETag)
+	}
+	return r.fs.Backend.Download(context.TODO(), r.fs.ContainerName, r.blobName, off, count, r.stored.ETag)
+}
@@ -0,0 +1,102 @@
+package fileSystem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// newTestRangeFileSystems returns a plain and an encrypted file system over the same fake store
+func newTestRangeFileSystems(t *testing.T) (map[string]*FileSystem, *fakeS3) {
+	t.Helper()
+	sb, fake := newTestS3Backend(t, S3Config{})
+	return map[string]*FileSystem{
+		"plain":     {Backend: sb, ContainerName: testBucket},
+		"encrypted": {Backend: sb, ContainerName: "output", KeyRing: newTestKeyRing(t)},
+	}, fake
+}
+
+func TestOpenRange(t *testing.T) {
+	systems, _ := newTestRangeFileSystems(t)
+	data := testData(2*encryptionChunkSize + 100)
+	size := int64(len(data))
+	for name, fs := range systems {
+		if err := fs.UploadFile(bytes.NewReader(data), "a.wav"); err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			offset, length int64
+			want           []byte
+		}{
+			{0, 0, data},
+			{10, 20, data[10:30]},
+			{encryptionChunkSize - 10, 20, data[encryptionChunkSize-10 : encryptionChunkSize+10]},
+			{encryptionChunkSize - 1, encryptionChunkSize + 2, data[encryptionChunkSize-1 : 2*encryptionChunkSize+1]},
+			{2 * encryptionChunkSize, 0, data[2*encryptionChunkSize:]},
+			{size - 5, 0, data[size-5:]},
+			{size - 5, 5, data[size-5:]},
+		} {
+			got, err := readRange(fs, "a.wav", tc.offset, tc.length)
+			if err != nil || !bytes.Equal(got, tc.want) {
+				t.Errorf("%s: read %d bytes at %d+%d, %v, want %d", name, len(got), tc.offset, tc.length, err, len(tc.want))
+			}
+		}
+		if _, err := fs.OpenRange("a.wav", -1, 10); !errors.Is(err, ErrNegativeRange) {
+			t.Errorf("%s: negative offset returned %v", name, err)
+		}
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	systems, fake := newTestRangeFileSystems(t)
+	data := testData(2*encryptionChunkSize + 100)
+	size := int64(len(data))
+	for name, fs := range systems {
+		if err := fs.UploadFile(bytes.NewReader(data), "a.wav"); err != nil {
+			t.Fatal(err)
+		}
+		heads := fake.countRequests(http.MethodHead, "")
+		r, err := fs.NewReaderAt("a.wav")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Size() != size {
+			t.Fatalf("%s: size %d, want %d", name, r.Size(), size)
+		}
+
+		for _, tc := range []struct {
+			off    int64
+			length int
+			want   []byte
+			err    error
+		}{
+			{encryptionChunkSize - 10, 20, data[encryptionChunkSize-10 : encryptionChunkSize+10], nil},
+			{size - 10, 10, data[size-10:], nil},
+			{size - 10, 20, data[size-10:], io.EOF},
+			{size, 10, nil, io.EOF},
+		} {
+			p := make([]byte, tc.length)
+			n, err := r.ReadAt(p, tc.off)
+			if err != tc.err || !bytes.Equal(p[:n], tc.want) {
+				t.Errorf("%s: ReadAt(%d bytes, %d) = %d, %v", name, tc.length, tc.off, n, err)
+			}
+		}
+		got, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: read %d bytes through a section reader, %v", name, len(got), err)
+		}
+		if n := fake.countRequests(http.MethodHead, "") - heads; n != 1 {
+			t.Errorf("%s: looked up the properties %d times, want once", name, n)
+		}
+
+		// reads stay on the version the reader was opened on
+		if err := fs.UploadFile(bytes.NewReader(data[:100]), "a.wav"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadAt(make([]byte, 10), 0); !errors.Is(err, ErrConditionNotMet) {
+			t.Errorf("%s: ReadAt of a changed blob returned %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package fileSystem
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Backend stores blobs in an S3 compatible object store (MinIO, Ceph, AWS ...) using path style
+// addressing, so containers are buckets at <endpoint>/<bucket>/<key>. requests are signed with
+// AWS signature version 4; no SDK is needed for the handful of calls the file system makes
+type S3Backend struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	parts    sync.Pool // *[]byte of PartSize, the upload buffers
+}
+
+type S3Config struct {
+	Endpoint  string // e.g. http://localhost:9000
+	Region    string
+	AccessKey string
+	SecretKey string
+	PartSize  int64 // uploads larger than this use multipart upload
+}
+
+const (
+	defaultS3Region   = "us-east-1"
+	defaultS3PartSize = 8 << 20 // S3 requires at least 5 MiB for every part but the last
+	s3TimeFormat      = "20060102T150405Z"
+	s3MetadataPrefix  = "X-Amz-Meta-"
+)
+
+// S3Error is a non-2xx response from the object store
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func NewS3Backend(config S3Config) (*S3Backend, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q, expected e.g. http://localhost:9000", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = defaultS3PartSize
+	}
+
+	sb := &S3Backend{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}
+	sb.parts.New = func() any {
+		buf := make([]byte, config.PartSize)
+		return &buf
+	}
+	return sb, nil
+}
+
+func (sb *S3Backend) Upload(ctx context.Context, container string, name string, r io.Reader, metadata map[string]string, cond UploadCondition) error {
+	return s3ConditionError(sb.upload(ctx, container, name, r, metadata, cond))
+}
+
+// s3ConditionError wraps a failed precondition of a conditional write in ErrConditionNotMet
+func s3ConditionError(err error) error {
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) && (s3Err.StatusCode == http.StatusPreconditionFailed || s3Err.Code == "PreconditionFailed") {
+		return fmt.Errorf("%w: %v", ErrConditionNotMet, err)
+	}
+	return err
+}
+
+func (sb *S3Backend) upload(ctx context.Context, container string, name string, r io.Reader, metadata map[string]string, cond UploadCondition) error {
+	buf := sb.parts.Get().(*[]byte)
+	defer sb.parts.Put(buf)
+
+	// read the first part; anything that fits goes up in a single PUT
+	n, err := io.ReadFull(r, *buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if int64(n) < sb.config.PartSize {
+		header := http.Header{}
+		setS3Metadata(header, metadata)
+		setS3Condition(header, cond)
+		resp, err := sb.do(ctx, http.MethodPut, container, name, nil, header, (*buf)[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	return sb.multipartUpload(ctx, container, name, *buf, r, metadata, cond)
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipartUpload uploads part, which holds the first part, and the rest of r. part is reused for
+// the following parts
+func (sb *S3Backend) multipartUpload(ctx context.Context, container string, name string, part []byte, r io.Reader, metadata map[string]string, cond UploadCondition) (err error) {
+	header := http.Header{}
+	setS3Metadata(header, metadata)
+	resp, err := sb.do(ctx, http.MethodPost, container, name, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("could not decode multipart upload response: %w", err)
+	}
+
+	// abort on any failure so the store doesn't keep the orphaned parts around
+	defer func() {
+		if err != nil {
+			if resp, abortErr := sb.do(context.Background(), http.MethodDelete, container, name, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	parts := []s3Part{}
+	n := len(part)
+	for partNumber := 1; n > 0; partNumber++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {initiated.UploadID},
+		}
+		resp, err := sb.do(ctx, http.MethodPut, container, name, query, nil, part[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		parts = append(parts, s3Part{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		var readErr error
+		n, readErr = io.ReadFull(r, part)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	// the condition is checked when the parts are committed
+	completeHeader := http.Header{}
+	setS3Condition(completeHeader, cond)
+	resp, err = sb.do(ctx, http.MethodPost, container, name, url.Values{"uploadId": {initiated.UploadID}}, completeHeader, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// completion can fail after the 200 has been sent, the error is then in the body
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		s3Err := &S3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(result, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+func (sb *S3Backend) Download(ctx context.Context, container string, name string, offset int64, count int64, ifMatch string) (io.ReadCloser, error) {
+	header := http.Header{}
+	setS3Condition(header, UploadCondition{IfMatch: ifMatch})
+	if count > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+count-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := sb.do(ctx, http.MethodGet, container, name, nil, header, nil)
+	if err != nil {
+		return nil, s3ConditionError(err)
+	}
+	return resp.Body, nil
+}
+
+func (sb *S3Backend) Properties(ctx context.Context, container string, name string) (BlobProperties, error) {
+	resp, err := sb.do(ctx, http.MethodHead, container, name, nil, nil, nil)
+	if err != nil {
+		return BlobProperties{}, err
+	}
+	resp.Body.Close()
+
+	props := BlobProperties{
+		Size:     resp.ContentLength,
+		ETag:     resp.Header.Get("ETag"),
+		Metadata: map[string]string{},
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		props.LastModified = lastModified
+	}
+	for key, values := range resp.Header {
+		if strings.HasPrefix(key, s3MetadataPrefix) && len(values) > 0 {
+			props.Metadata[strings.ToLower(strings.TrimPrefix(key, s3MetadataPrefix))] = values[0]
+		}
+	}
+	return props, nil
+}
+
+// Copy uses CopyObject, objects up to 5GB are copied in a single request
+func (sb *S3Backend) Copy(ctx context.Context, container string, src string, dst string, cond UploadCondition) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", s3URIEncode("/"+container+"/"+src, false))
+	setS3Condition(header, cond)
+	resp, err := sb.do(ctx, http.MethodPut, container, dst, nil, header, nil)
+	if err != nil {
+		return s3ConditionError(err)
+	}
+	defer resp.Body.Close()
+
+	// a copy can fail after the 200 status has been sent, the error is in the body then
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		XMLName xml.Name
+		S3Error
+	}
+	if err := xml.Unmarshal(data, &result); err == nil && result.XMLName.Local == "Error" {
+		result.S3Error.StatusCode = resp.StatusCode
+		return s3ConditionError(&result.S3Error)
+	}
+	return nil
+}
+
+func (sb *S3Backend) List(ctx context.Context, container string) ([]BlobInfo, error) {
+	blob_list := []BlobInfo{}
+	continuationToken := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := sb.do(ctx, http.MethodGet, container, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+				ETag         string    `xml:"ETag"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not decode list response: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			blob_list = append(blob_list, BlobInfo{
+				Name:         object.Key,
+				Size:         object.Size,
+				LastModified: object.LastModified,
+				ETag:         object.ETag,
+			})
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = page.NextContinuationToken
+	}
+
+	return blob_list, nil
+}
+
+func (sb *S3Backend) Delete(ctx context.Context, container string, name string) error {
+	resp, err := sb.do(ctx, http.MethodDelete, container, name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func setS3Metadata(header http.Header, metadata map[string]string) {
+	for key, value := range metadata {
+		header.Set(s3MetadataPrefix+key, value)
+	}
+}
+
+func setS3Condition(header http.Header, cond UploadCondition) {
+	if cond.IfNoneMatch {
+		header.Set("If-None-Match", "*")
+	}
+	if cond.IfMatch != "" {
+		header.Set("If-Match", cond.IfMatch)
+	}
+}
+
+// do sends a signed request and turns any non-2xx response into an *S3Error
+func (sb *S3Backend) do(
+	ctx context.Context,
+	method string,
+	bucket string,
+	key string,
+	query url.Values,
+	header http.Header,
+	body []byte,
+) (*http.Response, error) {
+	target := *sb.endpoint
+	target.Path = strings.TrimSuffix(sb.endpoint.Path, "/") + "/" + bucket
+	if key != "" {
+		target.Path += "/" + key
+	}
+	target.RawPath = s3URIEncode(target.Path, false)
+	target.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sb.sign(req, body, time.Now().UTC())
+
+	resp, err := sb.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		s3Err := &S3Error{StatusCode: resp.StatusCode, Code: http.StatusText(resp.StatusCode)}
+		if data, readErr := io.ReadAll(resp.Body); readErr == nil && len(data) > 0 {
+			xml.Unmarshal(data, s3Err)
+		}
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+// sign adds an AWS signature version 4 Authorization header to req
+func (sb *S3Backend) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format(s3TimeFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// sign the host and every x-amz-* header
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + sb.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+sb.config.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, sb.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sb.config.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode percent-encodes everything but the unreserved characters, as signature v4 expects
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,190 @@
+package fileSystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deleted blobs are moved under trashPrefix in their own container as .trash/<deleted at unix nanos>/<name>,
+// so the same name can be in the trash more than once and the deletion time survives restarts.
+// the blob is copied as stored (encrypted blobs stay encrypted) and List hides the trash
+
+const trashPrefix = ".trash/"
+
+var (
+	ErrNotInTrash      = errors.New("not in trash")
+	ErrRestoreConflict = errors.New("a blob with that name already exists")
+)
+
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Container string    `json:"container"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deletedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type TrashFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+func (fs *FileSystem) moveToTrash(ctx context.Context, blobName string) error {
+	if strings.HasPrefix(blobName, trashPrefix) {
+		return fmt.Errorf("%s is already in the trash", blobName)
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10) + "/" + blobName
+	if err := fs.Backend.Copy(ctx, fs.ContainerName, blobName, trashPrefix+id, UploadCondition{}); err != nil {
+		return fmt.Errorf("could not move %s to trash: %w", blobName, err)
+	}
+	return fs.Backend.Delete(ctx, fs.ContainerName, blobName)
+}
+
+// parseTrashID splits an id into its deletion time and original blob name
+func parseTrashID(id string) (time.Time, string, error) {
+	stamp, name, ok := strings.Cut(id, "/")
+	if !ok || name == "" {
+		return time.Time{}, "", fmt.Errorf("%w: invalid id %q", ErrNotInTrash, id)
+	}
+	nanos, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%w: invalid id %q", ErrNotInTrash, id)
+	}
+	return time.Unix(0, nanos), name, nil
+}
+
+func (fs *FileSystem) ListTrash(ctx context.Context) ([]TrashItem, error) {
+	blobs, err := fs.Backend.List(ctx, fs.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []TrashItem{}
+	for _, blob := range blobs {
+		id, ok := strings.CutPrefix(blob.Name, trashPrefix)
+		if !ok {
+			continue
+		}
+		deletedAt, name, err := parseTrashID(id)
+		if err != nil {
+			continue
+		}
+		items = append(items, TrashItem{
+			ID:        id,
+			Container: fs.ContainerName,
+			Name:      name,
+			Size:      blob.Size,
+			DeletedAt: deletedAt,
+			ExpiresAt: deletedAt.Add(fs.TrashRetention),
+		})
+	}
+	return items, nil
+}
+
+// RestoreTrash moves trashed blobs back to their original names. a restore never overwrites, the copy
+// only writes when no blob has the name, so if it has been reused since the item fails with ErrRestoreConflict
+func (fs *FileSystem) RestoreTrash(ctx context.Context, ids []string) ([]string, []TrashFailure, error) {
+	blobs, err := fs.Backend.List(ctx, fs.ContainerName)
+	if err != nil {
+		return nil, nil, err
+	}
+	trashed := map[string]bool{}
+	for _, blob := range blobs {
+		trashed[blob.Name] = true
+	}
+
+	restored := []string{}
+	failures := []TrashFailure{}
+	fail := func(id string, err error) {
+		failures = append(failures, TrashFailure{ID: id, Error: err.Error()})
+	}
+
+	for _, id := range ids {
+		_, name, err := parseTrashID(id)
+		if err != nil {
+			fail(id, err)
+			continue
+		}
+		if !trashed[trashPrefix+id] {
+			fail(id, ErrNotInTrash)
+			continue
+		}
+
+		err = fs.Backend.Copy(ctx, fs.ContainerName, trashPrefix+id, name, UploadCondition{IfNoneMatch: true})
+		fs.forgetCached(name)
+		if errors.Is(err, ErrConditionNotMet) {
+			fail(id, ErrRestoreConflict)
+			continue
+		}
+		if err != nil {
+			fail(id, err)
+			continue
+		}
+		if err := fs.Backend.Delete(ctx, fs.ContainerName, trashPrefix+id); err != nil {
+			fail(id, fmt.Errorf("restored but could not remove from trash: %w", err))
+			continue
+		}
+		restored = append(restored, name)
+	}
+
+	return restored, failures, nil
+}
+
+// PurgeTrash permanently deletes trashed blobs, every item in the trash when ids is empty
+func (fs *FileSystem) PurgeTrash(ctx context.Context, ids []string) (int, []TrashFailure, error) {
+	if len(ids) == 0 {
+		items, err := fs.ListTrash(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+	}
+
+	purged := 0
+	failures := []TrashFailure{}
+	for _, id := range ids {
+		if _, _, err := parseTrashID(id); err != nil {
+			failures = append(failures, TrashFailure{ID: id, Error: err.Error()})
+			continue
+		}
+		if err := fs.Backend.Delete(ctx, fs.ContainerName, trashPrefix+id); err != nil {
+			failures = append(failures, TrashFailure{ID: id, Error: err.Error()})
+			continue
+		}
+		purged++
+	}
+	return purged, failures, nil
+}
+
+// PurgeExpiredTrash permanently deletes trashed blobs older than the retention window
+func (fs *FileSystem) PurgeExpiredTrash(ctx context.Context) (int, error) {
+	items, err := fs.ListTrash(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	expired := []string{}
+	for _, item := range items {
+		if now.After(item.ExpiresAt) {
+			expired = append(expired, item.ID)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	purged, failures, err := fs.PurgeTrash(ctx, expired)
+	if err == nil && len(failures) > 0 {
+		err = fmt.Errorf("could not purge %d expired items, first error: %s", len(failures), failures[0].Error)
+	}
+	return purged, err
+}
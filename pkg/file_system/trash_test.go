@@ -0,0 +1,72 @@
+package fileSystem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTrashRestore(t *testing.T) {
+	sb, fake := newTestS3Backend(t, S3Config{})
+	fs := &FileSystem{Backend: sb, ContainerName: testBucket, KeyRing: newTestKeyRing(t), TrashRetention: time.Hour}
+	ctx := context.Background()
+	data := testData(encryptionChunkSize + 100)
+	for _, name := range []string{"a.wav", "b.wav"} {
+		if err := fs.UploadFile(bytes.NewReader(data), name); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Delete(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := fs.ListTrash(ctx)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("trash has %d items, %v", len(items), err)
+	}
+
+	// b.wav has been reused since it was deleted
+	if err := fs.UploadFile(bytes.NewReader([]byte("new")), "b.wav"); err != nil {
+		t.Fatal(err)
+	}
+	restored, failures, err := fs.RestoreTrash(ctx, []string{items[0].ID, items[1].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored[0] != "a.wav" {
+		t.Errorf("restored %v, want [a.wav]", restored)
+	}
+	if len(failures) != 1 || failures[0].Error != ErrRestoreConflict.Error() {
+		t.Errorf("failures %v, want a conflict for b.wav", failures)
+	}
+
+	// the restored blob keeps its encryption metadata
+	if got, err := readRange(fs, "a.wav", 0, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes of the restored blob, %v", len(got), err)
+	}
+	if got, err := readRange(fs, "b.wav", 0, 0); err != nil || string(got) != "new" {
+		t.Errorf("read %q from the reused name, %v", got, err)
+	}
+
+	// blobs are copied on the server, never downloaded, the only GETs are the reads above and listings
+	if downloads := fake.countRequests("GET", "") - fake.countRequests("GET", "list-type"); downloads != 2 {
+		t.Errorf("%d downloads, want the 2 reads", downloads)
+	}
+}
+
+func TestCopyConditionNotMet(t *testing.T) {
+	sb, _ := newTestS3Backend(t, S3Config{})
+	ctx := context.Background()
+	for _, name := range []string{"src.wav", "dst.wav"} {
+		if err := sb.Upload(ctx, testBucket, name, bytes.NewReader([]byte(name)), nil, UploadCondition{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sb.Copy(ctx, testBucket, "src.wav", "dst.wav", UploadCondition{IfNoneMatch: true}); !errors.Is(err, ErrConditionNotMet) {
+		t.Errorf("copy over an existing blob returned %v", err)
+	}
+	if err := sb.Copy(ctx, testBucket, "src.wav", "new.wav", UploadCondition{IfNoneMatch: true}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,156 @@
+package fileSystem
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	noClient = "(none)"
+	// usageLookupConcurrency bounds the properties lookups of backends that don't list metadata
+	usageLookupConcurrency = 8
+)
+
+type UsageBucket struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (ub *UsageBucket) add(size int64) {
+	ub.Count++
+	ub.Bytes += size
+}
+
+// ContainerUsage summarizes the blobs of one container. ByClient groups by the client ID stored
+// with each blob, blobs uploaded without one are counted as "(none)"
+type ContainerUsage struct {
+	Container   string                 `json:"container"`
+	Total       UsageBucket            `json:"total"`
+	Trash       UsageBucket            `json:"trash"`
+	ByClient    map[string]UsageBucket `json:"byClient"`
+	ByExtension map[string]UsageBucket `json:"byExtension"`
+	ByAge       map[string]UsageBucket `json:"byAge"`
+	Largest     []BlobInfo             `json:"largest"`
+}
+
+// age buckets, in order
+var usageAgeBuckets = []struct {
+	label  string
+	maxAge time.Duration
+}{
+	{"<1d", 24 * time.Hour},
+	{"1-7d", 7 * 24 * time.Hour},
+	{"7-30d", 30 * 24 * time.Hour},
+	{"30-90d", 90 * 24 * time.Hour},
+	{">90d", 0},
+}
+
+func usageAgeBucket(age time.Duration) string {
+	for _, bucket := range usageAgeBuckets {
+		if bucket.maxAge == 0 || age < bucket.maxAge {
+			return bucket.label
+		}
+	}
+	return usageAgeBuckets[len(usageAgeBuckets)-1].label
+}
+
+// SummarizeUsage aggregates a container listing and keeps the top largest blobs
+func SummarizeUsage(container string, blobs []BlobInfo, now time.Time, top int) ContainerUsage {
+	usage := ContainerUsage{
+		Container:   container,
+		ByClient:    map[string]UsageBucket{},
+		ByExtension: map[string]UsageBucket{},
+		ByAge:       map[string]UsageBucket{},
+		Largest:     []BlobInfo{},
+	}
+	for _, bucket := range usageAgeBuckets {
+		usage.ByAge[bucket.label] = UsageBucket{}
+	}
+
+	live := []BlobInfo{}
+	for _, blob := range blobs {
+		if strings.HasPrefix(blob.Name, trashPrefix) {
+			usage.Trash.add(blob.Size)
+			continue
+		}
+		live = append(live, blob)
+		usage.Total.add(blob.Size)
+
+		client := metadataValue(blob.Metadata, metaClientID)
+		if client == "" {
+			client = noClient
+		}
+		bucket := usage.ByClient[client]
+		bucket.add(blob.Size)
+		usage.ByClient[client] = bucket
+
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(blob.Name), "."))
+		bucket = usage.ByExtension[ext]
+		bucket.add(blob.Size)
+		usage.ByExtension[ext] = bucket
+
+		age := usageAgeBucket(now.Sub(blob.LastModified))
+		bucket = usage.ByAge[age]
+		bucket.add(blob.Size)
+		usage.ByAge[age] = bucket
+	}
+
+	sort.Slice(live, func(i, j int) bool { return live[i].Size > live[j].Size })
+	if len(live) > top {
+		live = live[:top]
+	}
+	usage.Largest = append(usage.Largest, live...)
+
+	return usage
+}
+
+// Usage lists the container (trash included) and summarizes it
+func (fs *FileSystem) Usage(ctx context.Context, top int) (ContainerUsage, error) {
+	blobs, err := fs.Backend.List(ctx, fs.ContainerName)
+	if err != nil {
+		return ContainerUsage{}, err
+	}
+	if err := fs.lookupMetadata(ctx, blobs); err != nil {
+		return ContainerUsage{}, err
+	}
+	return SummarizeUsage(fs.ContainerName, blobs, time.Now(), top), nil
+}
+
+// lookupMetadata fills in the metadata of live blobs the listing didn't include it for, which
+// takes a properties request per blob. a blob deleted since the listing keeps nil metadata
+func (fs *FileSystem) lookupMetadata(ctx context.Context, blobs []BlobInfo) error {
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for i := 0; i < usageLookupConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if props, err := fs.Backend.Properties(ctx, fs.ContainerName, blobs[i].Name); err == nil {
+					blobs[i].Metadata = props.Metadata
+				}
+			}
+		}()
+	}
+
+	for i, blob := range blobs {
+		if blob.Metadata != nil || strings.HasPrefix(blob.Name, trashPrefix) {
+			continue
+		}
+		select {
+		case work <- i:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return ctx.Err()
+}
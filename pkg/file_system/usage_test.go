@@ -0,0 +1,76 @@
+package fileSystem
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSummarizeUsage(t *testing.T) {
+	now := time.Now()
+	client := func(id string) map[string]string { return map[string]string{metaClientID: id} }
+	blobs := []BlobInfo{
+		{Name: "a.wav", Size: 10, LastModified: now.Add(-time.Hour), Metadata: client("client-1")},
+		{Name: "b.WAV", Size: 20, LastModified: now.Add(-24 * time.Hour), Metadata: map[string]string{"ManicClient": "client-1"}},
+		{Name: "c.mp3", Size: 30, LastModified: now.Add(-10 * 24 * time.Hour), Metadata: client("client-2")},
+		{Name: "d.mp3", Size: 40, LastModified: now.Add(-60 * 24 * time.Hour)},
+		{Name: "e", Size: 50, LastModified: now.Add(-365 * 24 * time.Hour), Metadata: map[string]string{}},
+		{Name: trashPrefix + "20240101T000000Z/a.wav", Size: 1000, LastModified: now, Metadata: client("client-1")},
+	}
+	usage := SummarizeUsage("input", blobs, now, 2)
+
+	if usage.Total != (UsageBucket{Count: 5, Bytes: 150}) || usage.Trash != (UsageBucket{Count: 1, Bytes: 1000}) {
+		t.Errorf("total %+v, trash %+v", usage.Total, usage.Trash)
+	}
+	for name, tc := range map[string]struct {
+		got  map[string]UsageBucket
+		want map[string]UsageBucket
+	}{
+		"clients": {usage.ByClient, map[string]UsageBucket{
+			"client-1": {2, 30}, "client-2": {1, 30}, noClient: {2, 90},
+		}},
+		"extensions": {usage.ByExtension, map[string]UsageBucket{
+			"wav": {2, 30}, "mp3": {2, 70}, "": {1, 50},
+		}},
+		"ages": {usage.ByAge, map[string]UsageBucket{
+			"<1d": {1, 10}, "1-7d": {1, 20}, "7-30d": {1, 30}, "30-90d": {1, 40}, ">90d": {1, 50},
+		}},
+	} {
+		if len(tc.got) != len(tc.want) {
+			t.Errorf("%s: %v, want %v", name, tc.got, tc.want)
+			continue
+		}
+		for key, want := range tc.want {
+			if tc.got[key] != want {
+				t.Errorf("%s: %q is %+v, want %+v", name, key, tc.got[key], want)
+			}
+		}
+	}
+	if len(usage.Largest) != 2 || usage.Largest[0].Name != "e" || usage.Largest[1].Name != "d.mp3" {
+		t.Errorf("largest %+v", usage.Largest)
+	}
+
+	// every age bucket is reported, empty ones too
+	if empty := SummarizeUsage("input", nil, now, 2); len(empty.ByAge) != len(usageAgeBuckets) {
+		t.Errorf("age buckets of an empty container %v", empty.ByAge)
+	}
+}
+
+// S3 doesn't list metadata, Usage looks up the client of each blob
+func TestUsageLooksUpClients(t *testing.T) {
+	sb, _ := newTestS3Backend(t, S3Config{})
+	fs := &FileSystem{Backend: sb, ContainerName: testBucket}
+	for name, clientID := range map[string]string{"a.wav": "client-1", "b.wav": "client-1", "c.wav": ""} {
+		if err := fs.UploadFileForClient(bytes.NewReader(testData(10)), name, clientID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage, err := fs.Usage(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.ByClient["client-1"].Count != 2 || usage.ByClient[noClient].Count != 1 || len(usage.ByClient) != 2 {
+		t.Errorf("by client %v", usage.ByClient)
+	}
+}
@@ -0,0 +1,57 @@
+package serviceBus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Broker is the message queue between the server and the functions. ServiceBus is the production
+// implementation, MemoryBroker keeps everything in process for local runs
+type Broker interface {
+	SendMessage(message Msg, queue string) error
+	// SendMessageAt sends a message that stays invisible to receivers until the given time
+	SendMessageAt(message Msg, queue string, at time.Time) error
+	SendMessageBatch(messages []Msg, queue string) ([]error, error)
+	ScheduleMessages(messages []Msg, queue string, at time.Time) ([]int64, []error, error)
+	CancelScheduledMessages(queue string, sequenceNumbers []int64) error
+
+	// Receive hands messages without a session to handle, see ServiceBus.Receive for the settlement rules
+	Receive(ctx context.Context, queue string, count int, wait time.Duration, handle func(delivery Delivery) error) error
+	// ReceiveSession hands the messages of one session to handle, holding the session exclusively meanwhile
+	ReceiveSession(ctx context.Context, queue string, sessionID string, count int, wait time.Duration, handle func(delivery Delivery) error) error
+	ClearQueue(queue string) error
+
+	QueueStats(queue string) (QueueStats, error)
+	// Peek pages through a queue without locking or changing its messages
+	Peek(queue string, opts PeekOptions) ([]PeekedMessage, error)
+
+	PeekDeadLetters(queue string, limit int) ([]DeadLetteredMessage, error)
+	ResubmitDeadLetters(queue string, filter DeadLetterFilter) ([]int64, error)
+	PurgeDeadLetters(queue string, filter DeadLetterFilter) ([]int64, error)
+
+	Close(ctx context.Context) error
+}
+
+var (
+	_ Broker = (*ServiceBus)(nil)
+	_ Broker = (*MemoryBroker)(nil)
+	_ Broker = (*JetStreamBroker)(nil)
+)
+
+// NewBrokerFromEnv picks the broker from MESSAGE_BROKER: servicebus (the default) reads
+// AZURE_SERVICEBUS_CONNECTION_STRING, memory needs no configuration but only lives as long as the
+// process, nats uses JetStream at NATS_URL or an embedded server (see NewJetStreamBroker)
+func NewBrokerFromEnv() (Broker, error) {
+	switch broker := os.Getenv("MESSAGE_BROKER"); broker {
+	case "", "servicebus":
+		return NewServiceBus()
+	case "memory":
+		return NewMemoryBroker(), nil
+	case "nats":
+		return NewJetStreamBroker()
+	default:
+		return nil, fmt.Errorf("unknown MESSAGE_BROKER %q, expected servicebus, memory or nats", broker)
+	}
+}
@@ -0,0 +1,247 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+const (
+	deadLetterPageSize = 50
+	deadLetterScanWait = 2 * time.Second
+	// resubmit and purge lock every message they look at until the scan ends, so it is bounded
+	deadLetterScanLimit = 5000
+)
+
+// DeadLetteredMessage is a message in a queue's dead letter sub queue. Task is set when the
+// content decodes as an audio task
+type DeadLetteredMessage struct {
+	SequenceNumber int64                 `json:"sequenceNumber"`
+	MessageID      string                `json:"messageID"`
+	SessionID      string                `json:"sessionID,omitempty"`
+	EnqueuedAt     time.Time             `json:"enqueuedAt"`
+	Reason         string                `json:"reason"`
+	Description    string                `json:"description"`
+	DeliveryCount  uint32                `json:"deliveryCount"`
+	Msg            *Msg                  `json:"msg,omitempty"`
+	Task           *audioTypes.AudioTask `json:"task,omitempty"`
+	Body           string                `json:"body,omitempty"` // raw body when it isn't a Msg
+}
+
+func newDeadLetteredMessage(message *azservicebus.ReceivedMessage) DeadLetteredMessage {
+	received := newReceivedFields(message)
+	dl := DeadLetteredMessage{
+		SequenceNumber: received.SequenceNumber,
+		MessageID:      received.MessageID,
+		SessionID:      received.SessionID,
+		EnqueuedAt:     received.EnqueuedAt,
+		DeliveryCount:  received.DeliveryCount,
+		Msg:            received.Msg,
+		Task:           received.Task,
+		Body:           received.Body,
+	}
+	if message.DeadLetterReason != nil {
+		dl.Reason = *message.DeadLetterReason
+	}
+	if message.DeadLetterErrorDescription != nil {
+		dl.Description = *message.DeadLetterErrorDescription
+	}
+	return dl
+}
+
+// receivedFields are the fields of a received Service Bus message shared by peeked and dead lettered messages
+type receivedFields struct {
+	SequenceNumber int64
+	MessageID      string
+	SessionID      string
+	EnqueuedAt     time.Time
+	DeliveryCount  uint32
+	Msg            *Msg
+	Task           *audioTypes.AudioTask
+	Body           string
+}
+
+func newReceivedFields(message *azservicebus.ReceivedMessage) receivedFields {
+	received := receivedFields{MessageID: message.MessageID, DeliveryCount: message.DeliveryCount}
+	if message.SequenceNumber != nil {
+		received.SequenceNumber = *message.SequenceNumber
+	}
+	if message.EnqueuedTime != nil {
+		received.EnqueuedAt = *message.EnqueuedTime
+	}
+	if message.SessionID != nil {
+		received.SessionID = *message.SessionID
+	}
+	received.Msg, received.Task, received.Body = decodeBody(message.Body, received.MessageID, received.SessionID)
+	return received
+}
+
+// decodeBody decodes body as a Msg and its audio task, or returns it as is when it isn't a Msg
+func decodeBody(body []byte, messageID string, sessionID string) (*Msg, *audioTypes.AudioTask, string) {
+	msg := Msg{}
+	if err := msg.Deserialize(body); err != nil {
+		return nil, nil, string(body)
+	}
+	msg.MessageID, msg.SessionID = messageID, sessionID
+	return &msg, audioTask(msg), ""
+}
+
+// setMsg sets Msg, and Task when the content decodes as an audio task
+func (dl *DeadLetteredMessage) setMsg(msg Msg) {
+	dl.Msg = &msg
+	dl.Task = audioTask(msg)
+}
+
+// audioTask decodes the payload of msg as an audio task, nil if it isn't one
+func audioTask(msg Msg) *audioTypes.AudioTask {
+	task := audioTypes.AudioTask{}
+	if err := msg.DecodePayload(&task); err != nil || task.TaskID == "" {
+		return nil
+	}
+	return &task
+}
+
+// DeadLetterFilter selects dead lettered messages, every set field has to match. the zero value matches everything
+type DeadLetterFilter struct {
+	SequenceNumbers []int64
+	Reason          string
+	OlderThan       time.Duration // enqueued at least this long ago
+}
+
+func (f DeadLetterFilter) IsZero() bool {
+	return len(f.SequenceNumbers) == 0 && f.Reason == "" && f.OlderThan == 0
+}
+
+func (f DeadLetterFilter) Matches(dl DeadLetteredMessage, now time.Time) bool {
+	if len(f.SequenceNumbers) > 0 && !slices.Contains(f.SequenceNumbers, dl.SequenceNumber) {
+		return false
+	}
+	if f.Reason != "" && f.Reason != dl.Reason {
+		return false
+	}
+	if f.OlderThan > 0 && now.Sub(dl.EnqueuedAt) < f.OlderThan {
+		return false
+	}
+	return true
+}
+
+// PeekDeadLetters lists up to limit messages of the queue's dead letter sub queue without changing it
+func (sb *ServiceBus) PeekDeadLetters(queue string, limit int) ([]DeadLetteredMessage, error) {
+	deadLetters := []DeadLetteredMessage{}
+	err := sb.withReceiver(queue, azservicebus.SubQueueDeadLetter, func(receiver *azservicebus.Receiver) error {
+		var next int64
+		for len(deadLetters) < limit {
+			count := min(deadLetterPageSize, limit-len(deadLetters))
+			messages, err := receiver.PeekMessages(context.TODO(), count, &azservicebus.PeekMessagesOptions{
+				FromSequenceNumber: to.Ptr(next),
+			})
+			if err != nil {
+				return err
+			}
+			for _, message := range messages {
+				dl := newDeadLetteredMessage(message)
+				deadLetters = append(deadLetters, dl)
+				next = dl.SequenceNumber + 1
+			}
+			if len(messages) < count {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("peek dead letters", queue, err)
+	}
+	return deadLetters, nil
+}
+
+// ResubmitDeadLetters sends a copy of every matching dead lettered message back to the queue and
+// removes it from the dead letter sub queue, returning the sequence numbers it resubmitted
+func (sb *ServiceBus) ResubmitDeadLetters(queue string, filter DeadLetterFilter) ([]int64, error) {
+	sender, err := sb.sender(queue)
+	if err != nil {
+		return nil, wrapError("resubmit dead letters", queue, err)
+	}
+
+	resubmitted, err := sb.scanDeadLetters(queue, filter, func(receiver *azservicebus.Receiver, message *azservicebus.ReceivedMessage) error {
+		copied := &azservicebus.Message{
+			Body:                  message.Body,
+			ContentType:           message.ContentType,
+			ApplicationProperties: message.ApplicationProperties,
+			SessionID:             message.SessionID,
+		}
+		if err := sender.SendMessage(context.TODO(), copied, nil); err != nil {
+			sb.dropSender(queue, sender)
+			return err
+		}
+		return receiver.CompleteMessage(context.TODO(), message, nil)
+	})
+	return resubmitted, wrapError("resubmit dead letters", queue, err)
+}
+
+// PurgeDeadLetters deletes every matching dead lettered message, returning their sequence numbers
+func (sb *ServiceBus) PurgeDeadLetters(queue string, filter DeadLetterFilter) ([]int64, error) {
+	purged, err := sb.scanDeadLetters(queue, filter, func(receiver *azservicebus.Receiver, message *azservicebus.ReceivedMessage) error {
+		return receiver.CompleteMessage(context.TODO(), message, nil)
+	})
+	return purged, wrapError("purge dead letters", queue, err)
+}
+
+// scanDeadLetters receives the dead letter sub queue and calls action for every matching message.
+// messages that don't match stay locked until the scan ends (so they aren't received twice) and
+// are then abandoned, which puts them back unchanged. the scan stops at the first failing action
+func (sb *ServiceBus) scanDeadLetters(
+	queue string,
+	filter DeadLetterFilter,
+	action func(receiver *azservicebus.Receiver, message *azservicebus.ReceivedMessage) error,
+) ([]int64, error) {
+	done := []int64{}
+	err := sb.withReceiver(queue, azservicebus.SubQueueDeadLetter, func(receiver *azservicebus.Receiver) error {
+		held := []*azservicebus.ReceivedMessage{}
+		defer func() {
+			for _, message := range held {
+				receiver.AbandonMessage(context.Background(), message, nil)
+			}
+		}()
+
+		now := time.Now()
+		for scanned := 0; scanned < deadLetterScanLimit; {
+			if len(filter.SequenceNumbers) > 0 && len(done) == len(filter.SequenceNumbers) {
+				return nil
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), deadLetterScanWait)
+			messages, err := receiver.ReceiveMessages(ctx, deadLetterPageSize, nil)
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) || (err == nil && len(messages) == 0) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			for i, message := range messages {
+				scanned++
+				dl := newDeadLetteredMessage(message)
+				if !filter.Matches(dl, now) {
+					held = append(held, message)
+					continue
+				}
+				if err := action(receiver, message); err != nil {
+					held = append(held, messages[i:]...)
+					return fmt.Errorf("message %d: %w", dl.SequenceNumber, err)
+				}
+				done = append(done, dl.SequenceNumber)
+			}
+		}
+		return nil
+	})
+	return done, err
+}
@@ -0,0 +1,141 @@
+package serviceBus
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// the task protocol shared with the functions (functions/shared_code/envelope.py). a message body
+// is an envelope:
+//
+//	{"schemaVersion": 1, "type": "processAudio", "id": "...", "correlationID": "<task id>",
+//	 "causationID": "<id of the message handled when this one was sent>",
+//	 "createdAt": "...", "sentAt": "...", "payload": {...}}
+//
+// version 0, {"type": "...", "content": "<payload as a JSON string>"}, is still decoded
+
+// SchemaVersion is the envelope version written by Serialize
+const SchemaVersion = 1
+
+// MessageType says what the payload of a message is
+type MessageType string
+
+const (
+	MessageProcessAudio       MessageType = "processAudio"       // payload is the AudioTask to run
+	MessageProcessAudioResult MessageType = "processAudioResult" // payload is the AudioTask with its outcome
+)
+
+// Known reports whether the type is part of the task protocol
+func (t MessageType) Known() bool {
+	return t == MessageProcessAudio || t == MessageProcessAudioResult
+}
+
+// NewMsg creates a message with a new ID and payload encoded as JSON. the correlation ID of a new
+// flow defaults to the message ID, use CausedBy for a message sent while handling another one
+func NewMsg(msgType MessageType, payload any) (Msg, error) {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return Msg{}, err
+	}
+	id := uuid.New().String()
+	return Msg{
+		Type:          msgType,
+		Content:       string(content),
+		ID:            id,
+		CorrelationID: id,
+		CreatedAt:     time.Now().UTC(),
+	}, nil
+}
+
+// CausedBy records that m was sent while handling cause, m joins the flow of cause
+func (m Msg) CausedBy(cause Msg) Msg {
+	m.CausationID = cause.ID
+	if cause.CorrelationID != "" {
+		m.CorrelationID = cause.CorrelationID
+	}
+	return m
+}
+
+// DecodePayload decodes the JSON payload into v
+func (m *Msg) DecodePayload(v any) error {
+	if err := json.Unmarshal([]byte(m.Content), v); err != nil {
+		return fmt.Errorf("could not decode %s payload: %w", m.Type, err)
+	}
+	return nil
+}
+
+// envelope is the wire form of a Msg, Content only appears in version 0
+type envelope struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Type          MessageType     `json:"type"`
+	ID            string          `json:"id,omitempty"`
+	CorrelationID string          `json:"correlationID,omitempty"`
+	CausationID   string          `json:"causationID,omitempty"`
+	CreatedAt     *time.Time      `json:"createdAt,omitempty"`
+	SentAt        *time.Time      `json:"sentAt,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	Content       *string         `json:"content,omitempty"`
+}
+
+// MarshalJSON writes the current envelope version. content that isn't JSON (version 0 allowed
+// any string) is sent as a JSON string payload
+func (m Msg) MarshalJSON() ([]byte, error) {
+	env := envelope{
+		SchemaVersion: SchemaVersion,
+		Type:          m.Type,
+		ID:            m.ID,
+		CorrelationID: m.CorrelationID,
+		CausationID:   m.CausationID,
+		Payload:       json.RawMessage(m.Content),
+	}
+	if !m.CreatedAt.IsZero() {
+		env.CreatedAt = &m.CreatedAt
+	}
+	if !m.SentAt.IsZero() {
+		env.SentAt = &m.SentAt
+	}
+	if !json.Valid(env.Payload) {
+		payload, err := json.Marshal(m.Content)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = payload
+	}
+	return json.Marshal(env)
+}
+
+// UnmarshalJSON reads version 0 and current envelopes, newer versions are rejected
+func (m *Msg) UnmarshalJSON(data []byte) error {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+	if env.SchemaVersion < 0 || env.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("unsupported message schema version %d", env.SchemaVersion)
+	}
+
+	*m = Msg{
+		SchemaVersion: env.SchemaVersion,
+		Type:          env.Type,
+		ID:            env.ID,
+		CorrelationID: env.CorrelationID,
+		CausationID:   env.CausationID,
+	}
+	if env.CreatedAt != nil {
+		m.CreatedAt = *env.CreatedAt
+	}
+	if env.SentAt != nil {
+		m.SentAt = *env.SentAt
+	}
+	if env.SchemaVersion == 0 {
+		if env.Content != nil {
+			m.Content = *env.Content
+		}
+		return nil
+	}
+	m.Content = string(env.Payload)
+	return nil
+}
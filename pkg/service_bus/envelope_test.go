@@ -0,0 +1,134 @@
+package serviceBus
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+)
+
+// the fixtures in testdata/envelope are shared with functions/shared_code/test_envelope.py: go_v1.json
+// is what Serialize writes and python_v1.json what envelope.reply writes, each side decodes the other's
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "envelope", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// goFixtureMsg is the message go_v1.json holds
+func goFixtureMsg(t *testing.T) Msg {
+	t.Helper()
+	msg, err := NewMsg(MessageProcessAudio, audioTypes.AudioTask{
+		ClientID:              "client-1",
+		TaskID:                "task-1",
+		Status:                TaskQueued,
+		InputFile:             "client-1/song.wav",
+		OutputFile:            "client-1/song.mp3",
+		AudioFunctionPipeline: []string{audioTypes.AudioFunctionWAVToMp3, audioTypes.AudioFunctionApplyEffect1},
+		Priority:              "normal",
+		DeliveryCount:         2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.ID = "5b7f3c2e-8d1a-4f6b-9c0e-2a4d6e8f1b3c"
+	msg.CorrelationID = "task-1"
+	msg.CausationID = "0f9e8d7c-6b5a-4938-8271-6a5b4c3d2e1f"
+	msg.CreatedAt = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	msg.SentAt = time.Date(2024, 5, 1, 10, 0, 1, 500_000_000, time.UTC)
+	return msg
+}
+
+func assertSameJSON(t *testing.T, got []byte, want []byte) {
+	t.Helper()
+	var gotValue, wantValue any
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal(want, &wantValue); err != nil {
+		t.Fatalf("invalid fixture: %v", err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestEnvelopeSerializeMatchesFixture(t *testing.T) {
+	msg := goFixtureMsg(t)
+	body, err := msg.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameJSON(t, []byte(body), readFixture(t, "go_v1.json"))
+
+	var decoded Msg
+	if err := decoded.Deserialize([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	msg.SchemaVersion = SchemaVersion
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Errorf("round trip changed the message\ngot  %+v\nwant %+v", decoded, msg)
+	}
+}
+
+func TestEnvelopeDecodesPython(t *testing.T) {
+	var msg Msg
+	if err := msg.Deserialize(readFixture(t, "python_v1.json")); err != nil {
+		t.Fatal(err)
+	}
+	cause := goFixtureMsg(t)
+	if msg.SchemaVersion != 1 || msg.Type != MessageProcessAudioResult || msg.ID != "c4d5e6f7-1a2b-4c3d-8e9f-0a1b2c3d4e5f" {
+		t.Errorf("unexpected envelope %+v", msg)
+	}
+	if msg.CorrelationID != cause.CorrelationID || msg.CausationID != cause.ID {
+		t.Errorf("reply isn't in the flow of its cause: correlation %q, causation %q", msg.CorrelationID, msg.CausationID)
+	}
+	want := time.Date(2024, 5, 1, 10, 0, 3, 0, time.UTC)
+	if !msg.CreatedAt.Equal(want) || !msg.SentAt.Equal(want) {
+		t.Errorf("unexpected times %v, %v", msg.CreatedAt, msg.SentAt)
+	}
+
+	var task audioTypes.AudioTask
+	if err := msg.DecodePayload(&task); err != nil {
+		t.Fatal(err)
+	}
+	if task.TaskID != "task-1" || task.Status != "Failed" || task.FailedStep != audioTypes.AudioFunctionApplyEffect1 ||
+		task.ErrorClass != "fatal" || task.DeliveryCount != 2 {
+		t.Errorf("unexpected task %+v", task)
+	}
+}
+
+func TestEnvelopeDecodesVersion0(t *testing.T) {
+	var msg Msg
+	if err := msg.Deserialize(readFixture(t, "v0.json")); err != nil {
+		t.Fatal(err)
+	}
+	if msg.SchemaVersion != 0 || msg.Type != MessageProcessAudio || msg.ID != "" || msg.CorrelationID != "" {
+		t.Errorf("unexpected envelope %+v", msg)
+	}
+	var task audioTypes.AudioTask
+	if err := msg.DecodePayload(&task); err != nil {
+		t.Fatal(err)
+	}
+	if task.TaskID != "task-1" || len(task.AudioFunctionPipeline) != 1 {
+		t.Errorf("unexpected task %+v", task)
+	}
+}
+
+func TestEnvelopeRejectsUnknownVersion(t *testing.T) {
+	var msg Msg
+	if err := msg.Deserialize(readFixture(t, "unsupported_version.json")); err == nil {
+		t.Errorf("decoded schema version 2: %+v", msg)
+	}
+	if err := msg.Deserialize([]byte(`{"schemaVersion": -1, "type": "processAudio"}`)); err == nil {
+		t.Errorf("decoded schema version -1: %+v", msg)
+	}
+}
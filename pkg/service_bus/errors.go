@@ -0,0 +1,64 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+var ErrMissingConnectionString = errors.New("AZURE_SERVICEBUS_CONNECTION_STRING environment variable not found")
+
+// Error is a failed Service Bus operation. Retryable is set for failures that are likely to go
+// away on their own (lost connections, timeouts), everything else is permanent until fixed
+type Error struct {
+	Op        string
+	Queue     string
+	Retryable bool
+	Err       error
+}
+
+func (e *Error) Error() string {
+	if e.Queue == "" {
+		return fmt.Sprintf("service bus %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("service bus %s on %s: %v", e.Op, e.Queue, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether err (or an error it wraps) is a retryable Service Bus failure
+func IsRetryable(err error) bool {
+	var sbErr *Error
+	if errors.As(err, &sbErr) {
+		return sbErr.Retryable
+	}
+	return isTransient(err)
+}
+
+func isTransient(err error) bool {
+	var azErr *azservicebus.Error
+	if errors.As(err, &azErr) {
+		switch azErr.Code {
+		case azservicebus.CodeConnectionLost, azservicebus.CodeTimeout, azservicebus.CodeLockLost:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || isNATSTransient(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func wrapError(op string, queue string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Queue: queue, Retryable: isTransient(err), Err: err}
+}
@@ -0,0 +1,841 @@
+package serviceBus
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// JetStreamBroker is a Broker on NATS JetStream, to run on premises without Azure. every queue is
+// a work queue stream of the same name, its messages are published on manic.<queue>.messages, or
+// manic.<queue>.sessions.<session> for messages with a SessionID. scheduled messages wait on
+// manic.<queue>.scheduled until they are due and are then moved onto the queue. a message is
+// acked when handled, nak'ed for redelivery on failure and, after jetStreamMaxDeliveries, moved to
+// the dead letter stream <queue>_deadletter (subject manic-deadletter.<queue>) with its reason.
+// every session has its own consumer that hands out one message at a time, so a session is
+// handled in order by one receiver at a time, across all processes using the server
+type JetStreamBroker struct {
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	server  *server.Server // the embedded server, nil when connected to NATS_URL
+	ackWait time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	streams map[string]jetstream.Stream // streams created so far, by name
+
+	advisories *nats.Subscription
+	scans      map[string]*scheduledScan // by queue, only used by promoteScheduled
+	stop       context.CancelFunc
+	done       chan struct{} // closed when promoteScheduled returns
+}
+
+// scheduledScan is what promoteScheduled knows about the scheduled messages of a queue
+type scheduledScan struct {
+	checked uint64               // last sequence number looked at
+	waiting map[uint64]time.Time // scheduled messages that weren't due yet, by sequence number
+}
+
+const (
+	jetStreamMaxDeliveries    = 10
+	jetStreamDuplicateWindow  = 10 * time.Minute
+	jetStreamAckWait          = time.Minute     // like the Service Bus lock duration
+	jetStreamSessionIdle      = 5 * time.Minute // session consumers are removed after being unused this long
+	jetStreamScheduleInterval = time.Second     // how often due scheduled messages are moved onto their queue
+	jetStreamTimeout          = 10 * time.Second
+	defaultNATSStoreDir       = "nats"
+)
+
+// message headers, the message ID is kept apart from Nats-Msg-Id which is only used for duplicate detection
+const (
+	headerMessageID     = "Manic-Message-Id"
+	headerSessionID     = "Manic-Session-Id"
+	headerScheduledAt   = "Manic-Scheduled-At"
+	headerReason        = "Manic-Dead-Letter-Reason"
+	headerDescription   = "Manic-Dead-Letter-Description"
+	headerDeliveryCount = "Manic-Delivery-Count"
+	headerEnqueuedAt    = "Manic-Enqueued-At"
+)
+
+// NewJetStreamBroker connects to NATS_URL. without it an embedded nats-server is started on
+// 127.0.0.1, listening on NATS_PORT or a free port, storing its streams in NATS_STORE_DIR
+// (default ./nats). its URL is logged, other processes such as manic-queue reach it with NATS_URL
+func NewJetStreamBroker() (*JetStreamBroker, error) {
+	storeDir := os.Getenv("NATS_STORE_DIR")
+	if storeDir == "" {
+		storeDir = defaultNATSStoreDir
+	}
+	port := -1 // any free port
+	if value := os.Getenv("NATS_PORT"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, &Error{Op: "connect", Err: fmt.Errorf("invalid NATS_PORT %q", value)}
+		}
+		port = n
+	}
+	return newJetStreamBroker(os.Getenv("NATS_URL"), storeDir, port)
+}
+
+func newJetStreamBroker(url string, storeDir string, port int) (*JetStreamBroker, error) {
+	jb := &JetStreamBroker{
+		ackWait: jetStreamAckWait,
+		streams: map[string]jetstream.Stream{},
+		scans:   map[string]*scheduledScan{},
+		done:    make(chan struct{}),
+	}
+
+	var err error
+	if url == "" {
+		if jb.server, err = startEmbeddedServer(storeDir, port); err != nil {
+			return nil, &Error{Op: "connect", Err: err}
+		}
+		url = jb.server.ClientURL()
+		log.Printf("embedded nats-server listening on %s", url)
+	}
+	jb.conn, err = nats.Connect(url, nats.Name("manic-compression"))
+	if err == nil {
+		jb.js, err = jetstream.New(jb.conn)
+	}
+	if err == nil {
+		jb.advisories, err = jb.conn.Subscribe("$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.>", jb.handleMaxDeliveries)
+	}
+	if err != nil {
+		jb.shutdown()
+		return nil, wrapError("connect", "", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	jb.stop = stop
+	go jb.promoteScheduled(ctx)
+	return jb, nil
+}
+
+func startEmbeddedServer(storeDir string, port int) (*server.Server, error) {
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoSigs:    true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create embedded nats-server: %w", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(jetStreamTimeout) {
+		ns.Shutdown()
+		return nil, errors.New("embedded nats-server did not start")
+	}
+	return ns, nil
+}
+
+func (jb *JetStreamBroker) checkOpen() error {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	if jb.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func messagesSubject(queue string) string {
+	return "manic." + queue + ".messages"
+}
+
+func scheduledSubject(queue string) string {
+	return "manic." + queue + ".scheduled"
+}
+
+// sessionSubject encodes the session ID, which may contain characters that aren't allowed in a subject
+func sessionSubject(queue string, sessionID string) string {
+	return "manic." + queue + ".sessions." + base64.RawURLEncoding.EncodeToString([]byte(sessionID))
+}
+
+// activeSubject is where a message is received from
+func activeSubject(queue string, sessionID string) string {
+	if sessionID == "" {
+		return messagesSubject(queue)
+	}
+	return sessionSubject(queue, sessionID)
+}
+
+func deadLetterSubject(queue string) string {
+	return "manic-deadletter." + queue
+}
+
+func deadLetterStreamName(queue string) string {
+	return queue + "_deadletter"
+}
+
+// stream returns the queue's stream, creating it on first use
+func (jb *JetStreamBroker) stream(ctx context.Context, queue string) (jetstream.Stream, error) {
+	if queue == "" || strings.ContainsAny(queue, ".*> \t\r\n/\\") {
+		return nil, fmt.Errorf("invalid queue name %q", queue)
+	}
+	return jb.ensureStream(ctx, jetstream.StreamConfig{
+		Name:       queue,
+		Subjects:   []string{"manic." + queue + ".>"},
+		Retention:  jetstream.WorkQueuePolicy,
+		Storage:    jetstream.FileStorage,
+		Duplicates: jetStreamDuplicateWindow,
+	})
+}
+
+func (jb *JetStreamBroker) deadLetterStream(ctx context.Context, queue string) (jetstream.Stream, error) {
+	if _, err := jb.stream(ctx, queue); err != nil {
+		return nil, err
+	}
+	return jb.ensureStream(ctx, jetstream.StreamConfig{
+		Name:      deadLetterStreamName(queue),
+		Subjects:  []string{deadLetterSubject(queue)},
+		Retention: jetstream.LimitsPolicy,
+		Storage:   jetstream.FileStorage,
+	})
+}
+
+func (jb *JetStreamBroker) ensureStream(ctx context.Context, cfg jetstream.StreamConfig) (jetstream.Stream, error) {
+	jb.mu.Lock()
+	stream, ok := jb.streams[cfg.Name]
+	jb.mu.Unlock()
+	if ok {
+		return stream, nil
+	}
+
+	stream, err := jb.js.CreateOrUpdateStream(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	jb.mu.Lock()
+	jb.streams[cfg.Name] = stream
+	jb.mu.Unlock()
+	return stream, nil
+}
+
+// publish sends message to the queue, held on the scheduled subject when at is in the future, and
+// returns its sequence number. a MessageID that was sent within jetStreamDuplicateWindow is dropped
+// by the stream, which returns the sequence number of the first one
+func (jb *JetStreamBroker) publish(op string, queue string, message Msg, at time.Time) (int64, error) {
+	if err := jb.checkOpen(); err != nil {
+		return 0, wrapError(op, queue, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+	if _, err := jb.stream(ctx, queue); err != nil {
+		return 0, wrapError(op, queue, err)
+	}
+
+	messageID := message.MessageID
+	if messageID == "" {
+		messageID = uuid.New().String()
+	}
+	message.SentAt = time.Now().UTC()
+	body, err := json.Marshal(message)
+	if err != nil {
+		return 0, &Error{Op: op, Queue: queue, Err: err}
+	}
+
+	out := nats.NewMsg(activeSubject(queue, message.SessionID))
+	out.Data = body
+	out.Header.Set(headerMessageID, messageID)
+	if message.SessionID != "" {
+		out.Header.Set(headerSessionID, message.SessionID)
+	}
+	if at.After(time.Now()) {
+		out.Subject = scheduledSubject(queue)
+		out.Header.Set(headerScheduledAt, at.UTC().Format(time.RFC3339Nano))
+	}
+	ack, err := jb.js.PublishMsg(ctx, out, jetstream.WithMsgID(messageID))
+	if err != nil {
+		return 0, wrapError(op, queue, err)
+	}
+	return int64(ack.Sequence), nil
+}
+
+func (jb *JetStreamBroker) SendMessage(message Msg, queue string) error {
+	_, err := jb.publish("send", queue, message, time.Time{})
+	return err
+}
+
+func (jb *JetStreamBroker) SendMessageAt(message Msg, queue string, at time.Time) error {
+	_, err := jb.publish("schedule", queue, message, at)
+	return err
+}
+
+// SendMessageBatch publishes the messages one by one, JetStream has no batches
+func (jb *JetStreamBroker) SendMessageBatch(messages []Msg, queue string) ([]error, error) {
+	errs := make([]error, len(messages))
+	for i, message := range messages {
+		if _, errs[i] = jb.publish("send batch", queue, message, time.Time{}); errs[i] != nil {
+			for j := i + 1; j < len(messages); j++ {
+				errs[j] = errs[i]
+			}
+			break
+		}
+	}
+	return errs, batchError(errs)
+}
+
+func (jb *JetStreamBroker) ScheduleMessages(messages []Msg, queue string, at time.Time) ([]int64, []error, error) {
+	sequenceNumbers := make([]int64, len(messages))
+	errs := make([]error, len(messages))
+	for i, message := range messages {
+		if sequenceNumbers[i], errs[i] = jb.publish("schedule", queue, message, at); errs[i] != nil {
+			for j := i + 1; j < len(messages); j++ {
+				errs[j] = errs[i]
+			}
+			break
+		}
+	}
+	return sequenceNumbers, errs, batchError(errs)
+}
+
+// CancelScheduledMessages deletes scheduled messages that haven't been moved onto the queue yet,
+// like Service Bus it fails if any of them isn't (or is no longer) scheduled
+func (jb *JetStreamBroker) CancelScheduledMessages(queue string, sequenceNumbers []int64) error {
+	if err := jb.checkOpen(); err != nil {
+		return wrapError("cancel scheduled", queue, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+	stream, err := jb.stream(ctx, queue)
+	if err != nil {
+		return wrapError("cancel scheduled", queue, err)
+	}
+
+	for _, sequenceNumber := range sequenceNumbers {
+		raw, err := stream.GetMsg(ctx, uint64(sequenceNumber))
+		if errors.Is(err, jetstream.ErrMsgNotFound) || (err == nil && raw.Subject != scheduledSubject(queue)) {
+			return &Error{Op: "cancel scheduled", Queue: queue, Err: fmt.Errorf("scheduled message %d not found", sequenceNumber)}
+		}
+		if err == nil {
+			err = stream.DeleteMsg(ctx, uint64(sequenceNumber))
+		}
+		if err != nil {
+			return wrapError("cancel scheduled", queue, err)
+		}
+	}
+	return nil
+}
+
+// promoteScheduled moves due scheduled messages onto their queue until ctx is cancelled
+func (jb *JetStreamBroker) promoteScheduled(ctx context.Context) {
+	defer close(jb.done)
+	ticker := time.NewTicker(jetStreamScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		names := jb.js.StreamNames(ctx, jetstream.WithStreamListSubject("manic.*.scheduled"))
+		for name := range names.Name() {
+			scan, ok := jb.scans[name]
+			if !ok {
+				scan = &scheduledScan{waiting: map[uint64]time.Time{}}
+				jb.scans[name] = scan
+			}
+			if err := jb.promoteDue(ctx, name, scan); err != nil && ctx.Err() == nil {
+				log.Printf("could not move scheduled messages of %s: %v", name, err)
+			}
+		}
+		if err := names.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("could not list streams with scheduled messages: %v", err)
+		}
+	}
+}
+
+// promoteDue moves the due scheduled messages of one queue. only the messages scheduled since the
+// last call are read, the ones that aren't due yet are remembered in scan. every process using the
+// stream does this, the Nats-Msg-Id derived from the scheduled sequence number keeps a message
+// from being moved twice
+func (jb *JetStreamBroker) promoteDue(ctx context.Context, queue string, scan *scheduledScan) error {
+	stream, err := jb.js.Stream(ctx, queue)
+	if err != nil {
+		return err
+	}
+	for {
+		raw, err := stream.GetMsg(ctx, scan.checked+1, jetstream.WithGetMsgSubject(scheduledSubject(queue)))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		scan.checked = raw.Sequence
+		// a message without a valid time is due right away
+		at, _ := time.Parse(time.RFC3339Nano, raw.Header.Get(headerScheduledAt))
+		scan.waiting[raw.Sequence] = at
+	}
+
+	now := time.Now()
+	for seq, at := range scan.waiting {
+		if at.After(now) {
+			continue
+		}
+		raw, err := stream.GetMsg(ctx, seq)
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			delete(scan.waiting, seq) // cancelled, or moved by another process
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		out := nats.NewMsg(activeSubject(queue, raw.Header.Get(headerSessionID)))
+		out.Data = raw.Data
+		for key, values := range raw.Header {
+			if key != headerScheduledAt && key != nats.MsgIdHdr {
+				out.Header[key] = values
+			}
+		}
+		if _, err := jb.js.PublishMsg(ctx, out, jetstream.WithMsgID(fmt.Sprintf("%s/scheduled/%d", queue, raw.Sequence))); err != nil {
+			return err
+		}
+		if err := stream.DeleteMsg(ctx, raw.Sequence); err != nil && !errors.Is(err, jetstream.ErrMsgNotFound) {
+			return err
+		}
+		delete(scan.waiting, seq)
+	}
+	return nil
+}
+
+// Receive hands up to count messages without a session to handle, settling them like ServiceBus.Receive
+func (jb *JetStreamBroker) Receive(ctx context.Context, queue string, count int, wait time.Duration, handle func(delivery Delivery) error) error {
+	return jb.receive(ctx, "receive", queue, "", count, wait, handle)
+}
+
+// ReceiveSession hands up to count messages of one session to handle, one at a time. a receive for
+// a session that another receiver is waiting on returns like one that has no messages
+func (jb *JetStreamBroker) ReceiveSession(ctx context.Context, queue string, sessionID string, count int, wait time.Duration, handle func(delivery Delivery) error) error {
+	if sessionID == "" {
+		return &Error{Op: "receive session", Queue: queue, Err: errors.New("no session id")}
+	}
+	return jb.receive(ctx, "receive session", queue, sessionID, count, wait, handle)
+}
+
+func (jb *JetStreamBroker) receive(ctx context.Context, op string, queue string, sessionID string, count int, wait time.Duration, handle func(delivery Delivery) error) error {
+	if err := jb.checkOpen(); err != nil {
+		return wrapError(op, queue, err)
+	}
+	consumer, err := jb.consumer(queue, sessionID)
+	if err != nil {
+		return wrapError(op, queue, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return wrapError(op, queue, err)
+	}
+	batch, err := consumer.Fetch(count, jetstream.FetchMaxWait(wait))
+	if err != nil {
+		return wrapError(op, queue, err)
+	}
+	for message := range batch.Messages() {
+		if err := jb.settle(queue, message, handle); err != nil {
+			return wrapError(op, queue, err)
+		}
+	}
+	if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) && !isSessionTaken(err) {
+		return wrapError(op, queue, err)
+	}
+	return nil
+}
+
+// isSessionTaken reports the error of a fetch from a session consumer that another receiver is waiting on
+func isSessionTaken(err error) bool {
+	return strings.Contains(err.Error(), "Exceeded MaxWaiting")
+}
+
+// consumer returns the pull consumer of the queue's messages without a session, or of one session.
+// a session consumer delivers one message at a time to one waiting receiver, which makes the
+// session exclusive, and is removed by the server after jetStreamSessionIdle without a receive
+func (jb *JetStreamBroker) consumer(queue string, sessionID string) (jetstream.Consumer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+	if _, err := jb.stream(ctx, queue); err != nil {
+		return nil, err
+	}
+
+	cfg := jetstream.ConsumerConfig{
+		Durable:       "receiver",
+		FilterSubject: activeSubject(queue, sessionID),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       jb.ackWait,
+		MaxDeliver:    jetStreamMaxDeliveries,
+	}
+	if sessionID != "" {
+		cfg.Durable = "session_" + strings.TrimPrefix(cfg.FilterSubject, "manic."+queue+".sessions.")
+		cfg.InactiveThreshold = jetStreamSessionIdle
+		cfg.MaxAckPending = 1
+		cfg.MaxWaiting = 1
+	}
+	return jb.js.CreateOrUpdateConsumer(ctx, queue, cfg)
+}
+
+// settle runs handle for one message and acks, dead-letters or naks it according to the result,
+// see ServiceBus.Receive. a message that fails its last delivery is dead-lettered
+func (jb *JetStreamBroker) settle(queue string, message jetstream.Msg, handle func(delivery Delivery) error) error {
+	meta, err := message.Metadata()
+	if err != nil {
+		return err
+	}
+	header := message.Headers()
+	delivery := Delivery{MessageID: header.Get(headerMessageID), DeliveryCount: uint32(meta.NumDelivered)}
+
+	err = delivery.Msg.Deserialize(message.Data())
+	if err != nil {
+		err = DeadLetter("unparseable message", err.Error())
+	} else {
+		delivery.Msg.MessageID = delivery.MessageID
+		delivery.Msg.SessionID = header.Get(headerSessionID)
+		err = handle(delivery)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+	var deadLetter *DeadLetterError
+	switch {
+	case err == nil:
+		return message.DoubleAck(ctx)
+	case errors.As(err, &deadLetter):
+	case meta.NumDelivered >= jetStreamMaxDeliveries:
+		deadLetter = maxDeliveriesExceeded()
+	default:
+		return message.Nak()
+	}
+
+	if err := jb.deadLetter(ctx, queue, header, message.Data(), meta.Timestamp, meta.NumDelivered, deadLetter); err != nil {
+		message.Nak()
+		return err
+	}
+	return message.DoubleAck(ctx)
+}
+
+func maxDeliveriesExceeded() *DeadLetterError {
+	return &DeadLetterError{
+		Reason:      "MaxDeliveryCountExceeded",
+		Description: fmt.Sprintf("Message could not be consumed after %d delivery attempts.", jetStreamMaxDeliveries),
+	}
+}
+
+// deadLetter publishes a copy of a message to the queue's dead letter stream, with why and when
+func (jb *JetStreamBroker) deadLetter(ctx context.Context, queue string, header nats.Header, data []byte, enqueuedAt time.Time, deliveryCount uint64, reason *DeadLetterError) error {
+	if _, err := jb.deadLetterStream(ctx, queue); err != nil {
+		return err
+	}
+	out := nats.NewMsg(deadLetterSubject(queue))
+	out.Data = data
+	for _, key := range []string{headerMessageID, headerSessionID} {
+		if value := header.Get(key); value != "" {
+			out.Header.Set(key, value)
+		}
+	}
+	out.Header.Set(headerReason, reason.Reason)
+	out.Header.Set(headerDescription, reason.Description)
+	out.Header.Set(headerDeliveryCount, strconv.FormatUint(deliveryCount, 10))
+	out.Header.Set(headerEnqueuedAt, enqueuedAt.UTC().Format(time.RFC3339Nano))
+	_, err := jb.js.PublishMsg(ctx, out)
+	return err
+}
+
+// handleMaxDeliveries dead-letters a message the server stopped delivering after jetStreamMaxDeliveries,
+// which settle can't do when its last delivery was never settled (the receiving process died)
+func (jb *JetStreamBroker) handleMaxDeliveries(advisory *nats.Msg) {
+	var event struct {
+		Stream     string `json:"stream"`
+		StreamSeq  uint64 `json:"stream_seq"`
+		Deliveries uint64 `json:"deliveries"`
+	}
+	if err := json.Unmarshal(advisory.Data, &event); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+	stream, err := jb.js.Stream(ctx, event.Stream)
+	if err != nil {
+		return
+	}
+	raw, err := stream.GetMsg(ctx, event.StreamSeq)
+	if err != nil || !strings.HasPrefix(raw.Subject, "manic."+event.Stream+".") {
+		return // settled meanwhile, or not a queue of this broker
+	}
+	if err := jb.deadLetter(ctx, event.Stream, raw.Header, raw.Data, raw.Time, event.Deliveries, maxDeliveriesExceeded()); err != nil {
+		log.Printf("could not dead-letter message %d of %s: %v", event.StreamSeq, event.Stream, err)
+		return
+	}
+	stream.DeleteMsg(ctx, event.StreamSeq)
+}
+
+// ClearQueue purges the active messages of all sessions, scheduled messages are kept
+func (jb *JetStreamBroker) ClearQueue(queue string) error {
+	if err := jb.checkOpen(); err != nil {
+		return wrapError("clear", queue, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+	stream, err := jb.stream(ctx, queue)
+	if err != nil {
+		return wrapError("clear", queue, err)
+	}
+	for _, subject := range []string{messagesSubject(queue), "manic." + queue + ".sessions.*"} {
+		if err := stream.Purge(ctx, jetstream.WithPurgeSubject(subject)); err != nil {
+			return wrapError("clear", queue, err)
+		}
+	}
+	return nil
+}
+
+// QueueStats reads the counts from the stream info of the queue and its dead letter stream.
+// scheduled messages count as scheduled until they are moved onto the queue
+func (jb *JetStreamBroker) QueueStats(queue string) (QueueStats, error) {
+	if err := jb.checkOpen(); err != nil {
+		return QueueStats{}, wrapError("stats", queue, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+	stream, err := jb.stream(ctx, queue)
+	if err != nil {
+		return QueueStats{}, wrapError("stats", queue, err)
+	}
+	info, err := stream.Info(ctx, jetstream.WithSubjectFilter(scheduledSubject(queue)))
+	if err != nil {
+		return QueueStats{}, wrapError("stats", queue, err)
+	}
+	deadLetters, err := jb.deadLetterStream(ctx, queue)
+	var deadLetterInfo *jetstream.StreamInfo
+	if err == nil {
+		deadLetterInfo, err = deadLetters.Info(ctx)
+	}
+	if err != nil {
+		return QueueStats{}, wrapError("stats", queue, err)
+	}
+
+	scheduled := info.State.Subjects[scheduledSubject(queue)]
+	return QueueStats{
+		Queue:              queue,
+		ActiveMessages:     int32(info.State.Msgs - scheduled),
+		ScheduledMessages:  int32(scheduled),
+		DeadLetterMessages: int32(deadLetterInfo.State.Msgs),
+		TotalMessages:      int64(info.State.Msgs + deadLetterInfo.State.Msgs),
+		SizeBytes:          int64(info.State.Bytes + deadLetterInfo.State.Bytes),
+		UpdatedAt:          time.Now(),
+	}, nil
+}
+
+// Peek pages through the queue's stream, scheduled messages included. with opts.SessionID only
+// the messages of that session are listed. the stream doesn't know delivery counts, they are 0
+func (jb *JetStreamBroker) Peek(queue string, opts PeekOptions) ([]PeekedMessage, error) {
+	if err := jb.checkOpen(); err != nil {
+		return nil, wrapError("peek", queue, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+	stream, err := jb.stream(ctx, queue)
+	if err != nil {
+		return nil, wrapError("peek", queue, err)
+	}
+
+	subject := "manic." + queue + ".>"
+	if opts.SessionID != "" {
+		subject = sessionSubject(queue, opts.SessionID)
+	}
+	peeked := []PeekedMessage{}
+	seq := uint64(max(opts.FromSequenceNumber, 1))
+	for len(peeked) < opts.max() {
+		raw, err := stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(subject))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, wrapError("peek", queue, err)
+		}
+		peeked = append(peeked, newPeekedJetStreamMessage(queue, raw))
+		seq = raw.Sequence + 1
+	}
+	return peeked, nil
+}
+
+func newPeekedJetStreamMessage(queue string, raw *jetstream.RawStreamMsg) PeekedMessage {
+	peeked := PeekedMessage{
+		SequenceNumber: int64(raw.Sequence),
+		MessageID:      raw.Header.Get(headerMessageID),
+		SessionID:      raw.Header.Get(headerSessionID),
+		State:          MessageActive,
+		EnqueuedAt:     raw.Time,
+	}
+	if raw.Subject == scheduledSubject(queue) {
+		peeked.State = MessageScheduled
+		if at, err := time.Parse(time.RFC3339Nano, raw.Header.Get(headerScheduledAt)); err == nil {
+			peeked.ScheduledAt = &at
+		}
+	}
+
+	peeked.Msg, peeked.Task, peeked.Body = decodeBody(raw.Data, peeked.MessageID, peeked.SessionID)
+	return peeked
+}
+
+func newJetStreamDeadLetter(raw *jetstream.RawStreamMsg) DeadLetteredMessage {
+	dl := DeadLetteredMessage{
+		SequenceNumber: int64(raw.Sequence),
+		MessageID:      raw.Header.Get(headerMessageID),
+		SessionID:      raw.Header.Get(headerSessionID),
+		EnqueuedAt:     raw.Time,
+		Reason:         raw.Header.Get(headerReason),
+		Description:    raw.Header.Get(headerDescription),
+	}
+	if enqueuedAt, err := time.Parse(time.RFC3339Nano, raw.Header.Get(headerEnqueuedAt)); err == nil {
+		dl.EnqueuedAt = enqueuedAt
+	}
+	if count, err := strconv.ParseUint(raw.Header.Get(headerDeliveryCount), 10, 32); err == nil {
+		dl.DeliveryCount = uint32(count)
+	}
+
+	dl.Msg, dl.Task, dl.Body = decodeBody(raw.Data, dl.MessageID, dl.SessionID)
+	return dl
+}
+
+// scanDeadLetters calls action for up to limit matching messages of the dead letter stream, in order
+func (jb *JetStreamBroker) scanDeadLetters(ctx context.Context, queue string, filter DeadLetterFilter, limit int, action func(stream jetstream.Stream, raw *jetstream.RawStreamMsg, dl DeadLetteredMessage) error) error {
+	stream, err := jb.deadLetterStream(ctx, queue)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for seq, found := uint64(1), 0; found < limit; {
+		raw, err := stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(deadLetterSubject(queue)))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seq = raw.Sequence + 1
+		dl := newJetStreamDeadLetter(raw)
+		if !filter.Matches(dl, now) {
+			continue
+		}
+		found++
+		if err := action(stream, raw, dl); err != nil {
+			return fmt.Errorf("message %d: %w", dl.SequenceNumber, err)
+		}
+	}
+	return nil
+}
+
+func (jb *JetStreamBroker) PeekDeadLetters(queue string, limit int) ([]DeadLetteredMessage, error) {
+	if err := jb.checkOpen(); err != nil {
+		return nil, wrapError("peek dead letters", queue, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+
+	deadLetters := []DeadLetteredMessage{}
+	err := jb.scanDeadLetters(ctx, queue, DeadLetterFilter{}, limit, func(stream jetstream.Stream, raw *jetstream.RawStreamMsg, dl DeadLetteredMessage) error {
+		deadLetters = append(deadLetters, dl)
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("peek dead letters", queue, err)
+	}
+	return deadLetters, nil
+}
+
+// ResubmitDeadLetters publishes matching dead lettered messages back to the queue as new messages
+// and deletes them from the dead letter stream, returning the sequence numbers it resubmitted
+func (jb *JetStreamBroker) ResubmitDeadLetters(queue string, filter DeadLetterFilter) ([]int64, error) {
+	return jb.takeDeadLetters("resubmit dead letters", queue, filter, func(ctx context.Context, raw *jetstream.RawStreamMsg) error {
+		out := nats.NewMsg(activeSubject(queue, raw.Header.Get(headerSessionID)))
+		out.Data = raw.Data
+		// like a resubmitted Service Bus message, it isn't a duplicate
+		out.Header.Set(headerMessageID, uuid.New().String())
+		if sessionID := raw.Header.Get(headerSessionID); sessionID != "" {
+			out.Header.Set(headerSessionID, sessionID)
+		}
+		_, err := jb.js.PublishMsg(ctx, out)
+		return err
+	})
+}
+
+func (jb *JetStreamBroker) PurgeDeadLetters(queue string, filter DeadLetterFilter) ([]int64, error) {
+	return jb.takeDeadLetters("purge dead letters", queue, filter, func(ctx context.Context, raw *jetstream.RawStreamMsg) error {
+		return nil
+	})
+}
+
+// takeDeadLetters passes each matching dead lettered message to action and deletes it, it stops at the first failure
+func (jb *JetStreamBroker) takeDeadLetters(op string, queue string, filter DeadLetterFilter, action func(ctx context.Context, raw *jetstream.RawStreamMsg) error) ([]int64, error) {
+	if err := jb.checkOpen(); err != nil {
+		return nil, wrapError(op, queue, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jetStreamTimeout)
+	defer cancel()
+
+	done := []int64{}
+	err := jb.scanDeadLetters(ctx, queue, filter, deadLetterScanLimit, func(stream jetstream.Stream, raw *jetstream.RawStreamMsg, dl DeadLetteredMessage) error {
+		if err := action(ctx, raw); err != nil {
+			return err
+		}
+		if err := stream.DeleteMsg(ctx, raw.Sequence); err != nil {
+			return err
+		}
+		done = append(done, dl.SequenceNumber)
+		return nil
+	})
+	return done, wrapError(op, queue, err)
+}
+
+// Close stops moving scheduled messages, closes the connection and shuts the embedded server down,
+// calls after Close fail with ErrClosed
+func (jb *JetStreamBroker) Close(ctx context.Context) error {
+	jb.mu.Lock()
+	if jb.closed {
+		jb.mu.Unlock()
+		return nil
+	}
+	jb.closed = true
+	jb.mu.Unlock()
+
+	jb.stop()
+	select {
+	case <-jb.done:
+	case <-ctx.Done():
+	}
+	jb.shutdown()
+	return nil
+}
+
+func (jb *JetStreamBroker) shutdown() {
+	if jb.advisories != nil {
+		jb.advisories.Unsubscribe()
+	}
+	if jb.conn != nil {
+		jb.conn.Close()
+	}
+	if jb.server != nil {
+		jb.server.Shutdown()
+		jb.server.WaitForShutdown()
+	}
+}
+
+// isNATSTransient reports NATS failures that are likely to go away on their own
+func isNATSTransient(err error) bool {
+	return errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, nats.ErrNoServers) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrConnectionReconnecting) ||
+		errors.Is(err, jetstream.ErrNoHeartbeat)
+}
@@ -0,0 +1,334 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const testQueue = "audiotasks"
+
+// newTestJetStreamBroker starts an embedded nats-server on a free port, with a short ack wait so
+// unsettled messages come back quickly
+func newTestJetStreamBroker(t *testing.T) *JetStreamBroker {
+	t.Helper()
+	jb, err := newJetStreamBroker("", t.TempDir(), -1)
+	if err != nil {
+		t.Fatalf("could not start broker: %v", err)
+	}
+	jb.ackWait = 200 * time.Millisecond
+	t.Cleanup(func() { jb.Close(context.Background()) })
+	return jb
+}
+
+// connectTestJetStreamBroker is a second broker on the server of jb, like another process
+func connectTestJetStreamBroker(t *testing.T, jb *JetStreamBroker) *JetStreamBroker {
+	t.Helper()
+	other, err := newJetStreamBroker(jb.server.ClientURL(), "", 0)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	other.ackWait = jb.ackWait
+	t.Cleanup(func() { other.Close(context.Background()) })
+	return other
+}
+
+func taskMsg(t *testing.T, taskID string, sessionID string) Msg {
+	t.Helper()
+	msg, err := NewMsg(MessageProcessAudio, audioTypes.AudioTask{TaskID: taskID, ClientID: sessionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.SessionID = sessionID
+	return msg
+}
+
+func taskID(t *testing.T, delivery Delivery) string {
+	t.Helper()
+	var task audioTypes.AudioTask
+	if err := delivery.Msg.DecodePayload(&task); err != nil {
+		t.Fatal(err)
+	}
+	return task.TaskID
+}
+
+// receiveAll receives until the queue has nothing left for a short while
+func receiveAll(t *testing.T, b Broker, sessionID string, handle func(delivery Delivery) error) []Delivery {
+	t.Helper()
+	var deliveries []Delivery
+	for {
+		n := len(deliveries)
+		receive := func(delivery Delivery) error {
+			deliveries = append(deliveries, delivery)
+			return handle(delivery)
+		}
+		var err error
+		if sessionID == "" {
+			err = b.Receive(context.Background(), testQueue, 10, 300*time.Millisecond, receive)
+		} else {
+			err = b.ReceiveSession(context.Background(), testQueue, sessionID, 10, 300*time.Millisecond, receive)
+		}
+		if err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if len(deliveries) == n {
+			return deliveries
+		}
+	}
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func queueStats(t *testing.T, b Broker) QueueStats {
+	t.Helper()
+	stats, err := b.QueueStats(testQueue)
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	return stats
+}
+
+func deadLetters(t *testing.T, b Broker) []DeadLetteredMessage {
+	t.Helper()
+	deadLetters, err := b.PeekDeadLetters(testQueue, 100)
+	if err != nil {
+		t.Fatalf("peek dead letters: %v", err)
+	}
+	return deadLetters
+}
+
+func TestJetStreamSendReceiveAck(t *testing.T) {
+	jb := newTestJetStreamBroker(t)
+	msg := taskMsg(t, "t1", "")
+	msg.MessageID = "t1:0"
+	if err := jb.SendMessage(msg, testQueue); err != nil {
+		t.Fatal(err)
+	}
+	// a resend with the same message ID is dropped
+	if err := jb.SendMessage(msg, testQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := receiveAll(t, jb, "", func(delivery Delivery) error { return nil })
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	delivery := deliveries[0]
+	if delivery.MessageID != "t1:0" || delivery.DeliveryCount != 1 || taskID(t, delivery) != "t1" {
+		t.Errorf("unexpected delivery %+v", delivery)
+	}
+	if delivery.Msg.ID != msg.ID || delivery.Msg.CorrelationID != msg.CorrelationID || delivery.Msg.Type != MessageProcessAudio {
+		t.Errorf("envelope not kept: %+v", delivery.Msg)
+	}
+	if stats := queueStats(t, jb); stats.ActiveMessages != 0 || stats.TotalMessages != 0 {
+		t.Errorf("acked message still counted: %+v", stats)
+	}
+}
+
+func TestJetStreamNakRedeliveryDeadLetters(t *testing.T) {
+	jb := newTestJetStreamBroker(t)
+	if err := jb.SendMessage(taskMsg(t, "t1", ""), testQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := receiveAll(t, jb, "", func(delivery Delivery) error { return errors.New("failed") })
+	if len(deliveries) != jetStreamMaxDeliveries {
+		t.Fatalf("got %d deliveries, want %d", len(deliveries), jetStreamMaxDeliveries)
+	}
+	for i, delivery := range deliveries {
+		if delivery.DeliveryCount != uint32(i+1) {
+			t.Errorf("delivery %d has count %d", i, delivery.DeliveryCount)
+		}
+	}
+
+	dls := deadLetters(t, jb)
+	if len(dls) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(dls))
+	}
+	if dls[0].Reason != "MaxDeliveryCountExceeded" || dls[0].DeliveryCount != jetStreamMaxDeliveries {
+		t.Errorf("unexpected dead letter %+v", dls[0])
+	}
+	if dls[0].Task == nil || dls[0].Task.TaskID != "t1" {
+		t.Errorf("dead letter task not decoded: %+v", dls[0].Task)
+	}
+	if stats := queueStats(t, jb); stats.ActiveMessages != 0 || stats.DeadLetterMessages != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// a receiver that never settles its last delivery leaves the message to the max deliveries advisory
+func TestJetStreamMaxDeliveriesAdvisory(t *testing.T) {
+	jb := newTestJetStreamBroker(t)
+	if err := jb.SendMessage(taskMsg(t, "t1", ""), testQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := jb.consumer(testQueue, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := 0
+	waitFor(t, 20*time.Second, "the advisory", func() bool {
+		batch, err := consumer.Fetch(1, jetstream.FetchMaxWait(100*time.Millisecond))
+		if err == nil {
+			for range batch.Messages() {
+				deliveries++ // and never acked
+			}
+		}
+		return len(deadLetters(t, jb)) == 1
+	})
+
+	if deliveries != jetStreamMaxDeliveries {
+		t.Errorf("got %d deliveries, want %d", deliveries, jetStreamMaxDeliveries)
+	}
+	dl := deadLetters(t, jb)[0]
+	if dl.Reason != "MaxDeliveryCountExceeded" || dl.Task == nil || dl.Task.TaskID != "t1" {
+		t.Errorf("unexpected dead letter %+v", dl)
+	}
+	waitFor(t, 5*time.Second, "the message to leave the queue", func() bool {
+		return queueStats(t, jb).ActiveMessages == 0
+	})
+}
+
+func TestJetStreamScheduledPromotion(t *testing.T) {
+	jb := newTestJetStreamBroker(t)
+	at := time.Now().Add(1500 * time.Millisecond)
+	sequenceNumbers, _, err := jb.ScheduleMessages([]Msg{taskMsg(t, "due", ""), taskMsg(t, "cancelled", "")}, testQueue, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := queueStats(t, jb); stats.ScheduledMessages != 2 || stats.ActiveMessages != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	peeked, err := jb.Peek(testQueue, PeekOptions{})
+	if err != nil || len(peeked) != 2 || peeked[0].State != MessageScheduled || peeked[0].ScheduledAt == nil {
+		t.Fatalf("unexpected peek %+v, %v", peeked, err)
+	}
+
+	if err := jb.CancelScheduledMessages(testQueue, sequenceNumbers[1:]); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if err := jb.CancelScheduledMessages(testQueue, sequenceNumbers[1:]); err == nil {
+		t.Error("cancelling twice succeeded")
+	}
+	if deliveries := receiveAll(t, jb, "", func(Delivery) error { return nil }); len(deliveries) != 0 {
+		t.Fatalf("received %d messages before they were due", len(deliveries))
+	}
+
+	var received []string
+	waitFor(t, 10*time.Second, "the scheduled message", func() bool {
+		for _, delivery := range receiveAll(t, jb, "", func(Delivery) error { return nil }) {
+			received = append(received, taskID(t, delivery))
+		}
+		return len(received) > 0
+	})
+	if time.Now().Before(at) {
+		t.Error("received before the scheduled time")
+	}
+	if len(received) != 1 || received[0] != "due" {
+		t.Errorf("received %v, want [due]", received)
+	}
+	if stats := queueStats(t, jb); stats.ScheduledMessages != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// a session is handed out one message at a time, also to receivers of another process
+func TestJetStreamSessionExclusive(t *testing.T) {
+	jb := newTestJetStreamBroker(t)
+	jb.ackWait = 5 * time.Second // longer than a1 is held
+	other := connectTestJetStreamBroker(t, jb)
+	for _, msg := range []Msg{taskMsg(t, "a1", "a"), taskMsg(t, "a2", "a"), taskMsg(t, "b1", "b")} {
+		if err := jb.SendMessage(msg, testQueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// messages with a session aren't received without one
+	if deliveries := receiveAll(t, jb, "", func(Delivery) error { return nil }); len(deliveries) != 0 {
+		t.Fatalf("received %d session messages without a session", len(deliveries))
+	}
+
+	var order []string
+	err := jb.ReceiveSession(context.Background(), testQueue, "a", 1, time.Second, func(delivery Delivery) error {
+		order = append(order, taskID(t, delivery))
+		if delivery.Msg.SessionID != "a" {
+			t.Errorf("delivery has session %q", delivery.Msg.SessionID)
+		}
+		// while a1 is being handled a2 is held back, from this and the other process
+		for _, b := range []*JetStreamBroker{jb, other} {
+			err := b.ReceiveSession(context.Background(), testQueue, "a", 1, 300*time.Millisecond, func(delivery Delivery) error {
+				t.Errorf("got %s while the session was held", taskID(t, delivery))
+				return nil
+			})
+			if err != nil {
+				t.Errorf("receive of held session: %v", err)
+			}
+		}
+		// other sessions aren't affected
+		got := receiveAll(t, other, "b", func(Delivery) error { return nil })
+		if len(got) != 1 || taskID(t, got[0]) != "b1" {
+			t.Errorf("session b got %d messages while a was held", len(got))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, delivery := range receiveAll(t, other, "a", func(Delivery) error { return nil }) {
+		order = append(order, taskID(t, delivery))
+	}
+	if len(order) != 2 || order[0] != "a1" || order[1] != "a2" {
+		t.Errorf("session a delivered %v, want [a1 a2]", order)
+	}
+}
+
+func TestJetStreamDeadLetterResubmitPurge(t *testing.T) {
+	jb := newTestJetStreamBroker(t)
+	for _, msg := range []Msg{taskMsg(t, "bad", ""), taskMsg(t, "worse", "")} {
+		if err := jb.SendMessage(msg, testQueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries := receiveAll(t, jb, "", func(delivery Delivery) error {
+		return DeadLetter(taskID(t, delivery), "rejected")
+	})
+	if len(deliveries) != 2 {
+		t.Fatalf("got %d deliveries, want 2", len(deliveries))
+	}
+	dls := deadLetters(t, jb)
+	if len(dls) != 2 || dls[0].Reason != "bad" || dls[0].Description != "rejected" || dls[0].DeliveryCount != 1 {
+		t.Fatalf("unexpected dead letters %+v", dls)
+	}
+
+	resubmitted, err := jb.ResubmitDeadLetters(testQueue, DeadLetterFilter{Reason: "bad"})
+	if err != nil || len(resubmitted) != 1 || resubmitted[0] != dls[0].SequenceNumber {
+		t.Fatalf("resubmit returned %v, %v", resubmitted, err)
+	}
+	deliveries = receiveAll(t, jb, "", func(Delivery) error { return nil })
+	if len(deliveries) != 1 || taskID(t, deliveries[0]) != "bad" || deliveries[0].MessageID == dls[0].MessageID {
+		t.Fatalf("resubmitted message not received as a new message: %+v", deliveries)
+	}
+
+	purged, err := jb.PurgeDeadLetters(testQueue, DeadLetterFilter{})
+	if err != nil || len(purged) != 1 || purged[0] != dls[1].SequenceNumber {
+		t.Fatalf("purge returned %v, %v", purged, err)
+	}
+	if dls := deadLetters(t, jb); len(dls) != 0 {
+		t.Errorf("%d dead letters left after purge", len(dls))
+	}
+}
@@ -0,0 +1,459 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// MemoryBroker is a Broker that keeps its queues in process. it follows the Service Bus semantics
+// the server relies on, so it can run (and fairness can be tried out) without Azure: peek-lock
+// delivery with a delivery count, dead-lettering after memoryMaxDeliveries, scheduled messages
+// and sessions. like a session enabled queue, a message with a SessionID is only delivered by
+// ReceiveSession, to one receiver of that session at a time and in order. like a queue with
+// duplicate detection, a message whose MessageID was sent within memoryDuplicateWindow is dropped
+type MemoryBroker struct {
+	mu       sync.Mutex
+	closed   bool
+	queues   map[string]*memoryQueue
+	sequence int64
+	changed  chan struct{} // closed and replaced when messages arrive or are released
+}
+
+// Service Bus' default max delivery count and duplicate detection window
+const (
+	memoryMaxDeliveries   = 10
+	memoryDuplicateWindow = 10 * time.Minute
+)
+
+// how often a waiting receive looks again, scheduled messages become visible without a notification
+const memoryPollInterval = 50 * time.Millisecond
+
+type memoryQueue struct {
+	messages    []*memoryMessage // active and scheduled, in sequence order
+	deadLetters []*memoryMessage
+	sessions    map[string]bool // sessions held by a receiver
+	sent        map[string]sentMessage
+}
+
+// sentMessage is a message ID seen by duplicate detection
+type sentMessage struct {
+	sequenceNumber int64
+	at             time.Time
+}
+
+type memoryMessage struct {
+	msg            Msg
+	messageID      string
+	sequenceNumber int64
+	enqueuedAt     time.Time
+	visibleAt      time.Time
+	deliveryCount  uint32
+	locked         bool
+	reason         string // dead letter reason and description
+	description    string
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{queues: map[string]*memoryQueue{}, changed: make(chan struct{})}
+}
+
+// queue returns the named queue, creating it on first use. mb.mu must be held
+func (mb *MemoryBroker) queue(name string) *memoryQueue {
+	q, ok := mb.queues[name]
+	if !ok {
+		q = &memoryQueue{sessions: map[string]bool{}, sent: map[string]sentMessage{}}
+		mb.queues[name] = q
+	}
+	return q
+}
+
+// notify wakes up waiting receives. mb.mu must be held
+func (mb *MemoryBroker) notify() {
+	close(mb.changed)
+	mb.changed = make(chan struct{})
+}
+
+func (mb *MemoryBroker) enqueue(op string, queue string, message Msg, visibleAt time.Time) (int64, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return 0, &Error{Op: op, Queue: queue, Err: ErrClosed}
+	}
+	q := mb.queue(queue)
+	now := time.Now()
+	for id, sent := range q.sent {
+		if now.Sub(sent.at) >= memoryDuplicateWindow {
+			delete(q.sent, id)
+		}
+	}
+	if sent, ok := q.sent[message.MessageID]; ok {
+		return sent.sequenceNumber, nil // a duplicate, accepted and dropped
+	}
+
+	mb.sequence++
+	message.SentAt = now.UTC()
+	messageID := message.MessageID
+	if messageID == "" {
+		messageID = uuid.New().String()
+	}
+	q.sent[messageID] = sentMessage{sequenceNumber: mb.sequence, at: now}
+	q.messages = append(q.messages, &memoryMessage{
+		msg:            message,
+		messageID:      messageID,
+		sequenceNumber: mb.sequence,
+		enqueuedAt:     now,
+		visibleAt:      visibleAt,
+	})
+	mb.notify()
+	return mb.sequence, nil
+}
+
+func (mb *MemoryBroker) SendMessage(message Msg, queue string) error {
+	_, err := mb.enqueue("send", queue, message, time.Now())
+	return err
+}
+
+func (mb *MemoryBroker) SendMessageAt(message Msg, queue string, at time.Time) error {
+	_, err := mb.enqueue("schedule", queue, message, at)
+	return err
+}
+
+// SendMessageBatch sends the messages one by one, there is no batch size to run into
+func (mb *MemoryBroker) SendMessageBatch(messages []Msg, queue string) ([]error, error) {
+	errs := make([]error, len(messages))
+	for i, message := range messages {
+		if _, errs[i] = mb.enqueue("send batch", queue, message, time.Now()); errs[i] != nil {
+			for j := i + 1; j < len(messages); j++ {
+				errs[j] = errs[i]
+			}
+			break
+		}
+	}
+	return errs, batchError(errs)
+}
+
+func (mb *MemoryBroker) ScheduleMessages(messages []Msg, queue string, at time.Time) ([]int64, []error, error) {
+	sequenceNumbers := make([]int64, len(messages))
+	errs := make([]error, len(messages))
+	for i, message := range messages {
+		if sequenceNumbers[i], errs[i] = mb.enqueue("schedule", queue, message, at); errs[i] != nil {
+			for j := i + 1; j < len(messages); j++ {
+				errs[j] = errs[i]
+			}
+			break
+		}
+	}
+	return sequenceNumbers, errs, batchError(errs)
+}
+
+// CancelScheduledMessages removes scheduled messages that aren't visible yet, like Service Bus it
+// fails if any of them isn't (or is no longer) scheduled
+func (mb *MemoryBroker) CancelScheduledMessages(queue string, sequenceNumbers []int64) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return &Error{Op: "cancel scheduled", Queue: queue, Err: ErrClosed}
+	}
+	q := mb.queue(queue)
+	now := time.Now()
+	for _, sequenceNumber := range sequenceNumbers {
+		i := slices.IndexFunc(q.messages, func(m *memoryMessage) bool {
+			return m.sequenceNumber == sequenceNumber && m.visibleAt.After(now)
+		})
+		if i < 0 {
+			return &Error{Op: "cancel scheduled", Queue: queue, Err: fmt.Errorf("scheduled message %d not found", sequenceNumber)}
+		}
+		q.messages = slices.Delete(q.messages, i, i+1)
+	}
+	return nil
+}
+
+// Receive hands up to count messages without a session to handle, settling them like ServiceBus.Receive
+func (mb *MemoryBroker) Receive(ctx context.Context, queue string, count int, wait time.Duration, handle func(delivery Delivery) error) error {
+	return mb.receive(ctx, "receive", queue, "", count, wait, handle)
+}
+
+// ReceiveSession hands up to count messages of one session to handle. the session is held until
+// the messages are settled, a receive for a session that is held elsewhere waits for it like one
+// that has no messages
+func (mb *MemoryBroker) ReceiveSession(ctx context.Context, queue string, sessionID string, count int, wait time.Duration, handle func(delivery Delivery) error) error {
+	if sessionID == "" {
+		return &Error{Op: "receive session", Queue: queue, Err: errors.New("no session id")}
+	}
+	return mb.receive(ctx, "receive session", queue, sessionID, count, wait, handle)
+}
+
+func (mb *MemoryBroker) receive(ctx context.Context, op string, queue string, sessionID string, count int, wait time.Duration, handle func(delivery Delivery) error) error {
+	deadline := time.Now().Add(wait)
+	var batch []*memoryMessage
+	for {
+		mb.mu.Lock()
+		if mb.closed {
+			mb.mu.Unlock()
+			return &Error{Op: op, Queue: queue, Err: ErrClosed}
+		}
+		q := mb.queue(queue)
+		if sessionID == "" || !q.sessions[sessionID] {
+			batch = q.lock(sessionID, count, time.Now())
+			if sessionID != "" && len(batch) > 0 {
+				q.sessions[sessionID] = true
+			}
+		}
+		changed := mb.changed
+		mb.mu.Unlock()
+
+		if len(batch) > 0 {
+			break
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(min(remaining, memoryPollInterval))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return wrapError(op, queue, ctx.Err())
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	for _, m := range batch {
+		msg := m.msg
+		msg.MessageID = m.messageID
+		err := handle(Delivery{Msg: msg, MessageID: m.messageID, DeliveryCount: m.deliveryCount})
+		mb.settle(queue, m, err)
+	}
+
+	if sessionID != "" {
+		mb.mu.Lock()
+		delete(mb.queue(queue).sessions, sessionID)
+		mb.notify()
+		mb.mu.Unlock()
+	}
+	return nil
+}
+
+// lock takes up to count visible, unlocked messages of the session ("" for messages without one)
+// in sequence order. mb.mu must be held
+func (q *memoryQueue) lock(sessionID string, count int, now time.Time) []*memoryMessage {
+	batch := []*memoryMessage{}
+	for _, m := range q.messages {
+		if len(batch) == count {
+			break
+		}
+		if m.locked || m.visibleAt.After(now) || m.msg.SessionID != sessionID {
+			continue
+		}
+		m.locked = true
+		m.deliveryCount++
+		batch = append(batch, m)
+	}
+	return batch
+}
+
+// settle completes, dead-letters or abandons a handled message, see ServiceBus.Receive
+func (mb *MemoryBroker) settle(queue string, m *memoryMessage, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	q := mb.queue(queue)
+
+	var deadLetter *DeadLetterError
+	switch {
+	case err == nil:
+		q.messages = slices.DeleteFunc(q.messages, func(other *memoryMessage) bool { return other == m })
+		return
+	case errors.As(err, &deadLetter):
+		m.reason, m.description = deadLetter.Reason, deadLetter.Description
+	case m.deliveryCount >= memoryMaxDeliveries:
+		m.reason = "MaxDeliveryCountExceeded"
+		m.description = fmt.Sprintf("Message could not be consumed after %d delivery attempts.", memoryMaxDeliveries)
+	default:
+		m.locked = false
+		mb.notify()
+		return
+	}
+
+	q.messages = slices.DeleteFunc(q.messages, func(other *memoryMessage) bool { return other == m })
+	m.locked = false
+	q.deadLetters = append(q.deadLetters, m)
+}
+
+// ClearQueue removes every visible message that isn't being handled, of all sessions
+func (mb *MemoryBroker) ClearQueue(queue string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return &Error{Op: "clear", Queue: queue, Err: ErrClosed}
+	}
+	q := mb.queue(queue)
+	now := time.Now()
+	q.messages = slices.DeleteFunc(q.messages, func(m *memoryMessage) bool {
+		return !m.locked && !m.visibleAt.After(now)
+	})
+	return nil
+}
+
+// QueueStats counts the queue's messages, size is the total size of their bodies
+func (mb *MemoryBroker) QueueStats(queue string) (QueueStats, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return QueueStats{}, &Error{Op: "stats", Queue: queue, Err: ErrClosed}
+	}
+	q := mb.queue(queue)
+	now := time.Now()
+	stats := QueueStats{Queue: queue, DeadLetterMessages: int32(len(q.deadLetters)), UpdatedAt: now}
+	for _, m := range q.messages {
+		if m.visibleAt.After(now) {
+			stats.ScheduledMessages++
+		} else {
+			stats.ActiveMessages++
+		}
+		stats.SizeBytes += m.size()
+	}
+	for _, m := range q.deadLetters {
+		stats.SizeBytes += m.size()
+	}
+	stats.TotalMessages = int64(len(q.messages) + len(q.deadLetters))
+	return stats, nil
+}
+
+// Peek pages through the queue's messages in sequence order, scheduled ones included. like a
+// session enabled queue, only the messages of opts.SessionID are listed when it is set
+func (mb *MemoryBroker) Peek(queue string, opts PeekOptions) ([]PeekedMessage, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return nil, &Error{Op: "peek", Queue: queue, Err: ErrClosed}
+	}
+	now := time.Now()
+	peeked := []PeekedMessage{}
+	for _, m := range mb.queue(queue).messages {
+		if len(peeked) == opts.max() {
+			break
+		}
+		if m.sequenceNumber < opts.FromSequenceNumber || (opts.SessionID != "" && m.msg.SessionID != opts.SessionID) {
+			continue
+		}
+		msg := m.msg
+		msg.MessageID = m.messageID
+		message := PeekedMessage{
+			SequenceNumber: m.sequenceNumber,
+			MessageID:      m.messageID,
+			SessionID:      m.msg.SessionID,
+			State:          MessageActive,
+			EnqueuedAt:     m.enqueuedAt,
+			DeliveryCount:  m.deliveryCount,
+			Msg:            &msg,
+			Task:           audioTask(msg),
+		}
+		if m.visibleAt.After(now) {
+			message.State = MessageScheduled
+			message.ScheduledAt = &m.visibleAt
+		}
+		peeked = append(peeked, message)
+	}
+	return peeked, nil
+}
+
+// size is the length of the message body as it would be sent
+func (m *memoryMessage) size() int64 {
+	body, err := m.msg.Serialize()
+	if err != nil {
+		return 0
+	}
+	return int64(len(body))
+}
+
+func (m *memoryMessage) deadLettered() DeadLetteredMessage {
+	dl := DeadLetteredMessage{
+		SequenceNumber: m.sequenceNumber,
+		MessageID:      m.messageID,
+		SessionID:      m.msg.SessionID,
+		EnqueuedAt:     m.enqueuedAt,
+		Reason:         m.reason,
+		Description:    m.description,
+		DeliveryCount:  m.deliveryCount,
+	}
+	dl.setMsg(m.msg)
+	return dl
+}
+
+func (mb *MemoryBroker) PeekDeadLetters(queue string, limit int) ([]DeadLetteredMessage, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return nil, &Error{Op: "peek dead letters", Queue: queue, Err: ErrClosed}
+	}
+	deadLetters := []DeadLetteredMessage{}
+	for _, m := range mb.queue(queue).deadLetters {
+		if len(deadLetters) == limit {
+			break
+		}
+		deadLetters = append(deadLetters, m.deadLettered())
+	}
+	return deadLetters, nil
+}
+
+// ResubmitDeadLetters moves matching dead lettered messages back to the queue as new messages
+func (mb *MemoryBroker) ResubmitDeadLetters(queue string, filter DeadLetterFilter) ([]int64, error) {
+	return mb.takeDeadLetters("resubmit dead letters", queue, filter, func(q *memoryQueue, m *memoryMessage) {
+		mb.sequence++
+		q.messages = append(q.messages, &memoryMessage{
+			msg:            m.msg,
+			messageID:      uuid.New().String(), // like a resubmitted Service Bus message, it isn't a duplicate
+			sequenceNumber: mb.sequence,
+			enqueuedAt:     time.Now(),
+			visibleAt:      time.Now(),
+		})
+	})
+}
+
+func (mb *MemoryBroker) PurgeDeadLetters(queue string, filter DeadLetterFilter) ([]int64, error) {
+	return mb.takeDeadLetters("purge dead letters", queue, filter, func(q *memoryQueue, m *memoryMessage) {})
+}
+
+// takeDeadLetters removes the matching dead lettered messages, passing each to action, and returns their sequence numbers
+func (mb *MemoryBroker) takeDeadLetters(op string, queue string, filter DeadLetterFilter, action func(q *memoryQueue, m *memoryMessage)) ([]int64, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return nil, &Error{Op: op, Queue: queue, Err: ErrClosed}
+	}
+	q := mb.queue(queue)
+	now := time.Now()
+	done := []int64{}
+	kept := []*memoryMessage{}
+	for _, m := range q.deadLetters {
+		if !filter.Matches(m.deadLettered(), now) {
+			kept = append(kept, m)
+			continue
+		}
+		action(q, m)
+		done = append(done, m.sequenceNumber)
+	}
+	q.deadLetters = kept
+	mb.notify()
+	return done, nil
+}
+
+// Close drops every queue, calls after Close fail with ErrClosed
+func (mb *MemoryBroker) Close(ctx context.Context) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if !mb.closed {
+		mb.closed = true
+		mb.queues = map[string]*memoryQueue{}
+		mb.notify()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionHeldByOneReceiver(t *testing.T) {
+	mb := NewMemoryBroker()
+	defer mb.Close(context.Background())
+	for _, msg := range []Msg{taskMsg(t, "a1", "a"), taskMsg(t, "a2", "a"), taskMsg(t, "b1", "b"), taskMsg(t, "n1", "")} {
+		if err := mb.SendMessage(msg, testQueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var order []string
+	err := mb.ReceiveSession(context.Background(), testQueue, "a", 1, time.Second, func(delivery Delivery) error {
+		order = append(order, taskID(t, delivery))
+		// a2 waits until a1 is settled, other sessions and messages without one don't
+		held := receiveAll(t, mb, "a", func(delivery Delivery) error {
+			t.Errorf("got %s while the session was held", taskID(t, delivery))
+			return nil
+		})
+		if len(held) != 0 {
+			t.Errorf("session a delivered %d messages to a second receiver", len(held))
+		}
+		if got := receiveAll(t, mb, "b", func(Delivery) error { return nil }); len(got) != 1 {
+			t.Errorf("session b got %d messages while a was held", len(got))
+		}
+		if got := receiveAll(t, mb, "", func(Delivery) error { return nil }); len(got) != 1 || taskID(t, got[0]) != "n1" {
+			t.Errorf("got %d messages without a session, want n1", len(got))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, delivery := range receiveAll(t, mb, "a", func(Delivery) error { return nil }) {
+		order = append(order, taskID(t, delivery))
+	}
+	if len(order) != 2 || order[0] != "a1" || order[1] != "a2" {
+		t.Errorf("session a delivered %v, want [a1 a2]", order)
+	}
+}
+
+// receivers racing for one session handle its messages one at a time, in order, and an abandoned
+// message is the next one handed out
+func TestMemorySessionConcurrentReceivers(t *testing.T) {
+	mb := NewMemoryBroker()
+	defer mb.Close(context.Background())
+	const messages = 20
+	for i := 0; i < messages; i++ {
+		msg := taskMsg(t, string(rune('a'+i)), "client")
+		if err := mb.SendMessage(msg, testQueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var order []string
+	active, maxActive, failed := 0, 0, false
+	handle := func(delivery Delivery) error {
+		mu.Lock()
+		active++
+		maxActive = max(maxActive, active)
+		// fail the third message once, it has to come back before the fourth
+		fail := len(order) == 2 && !failed
+		failed = failed || fail
+		if !fail {
+			order = append(order, taskID(t, delivery))
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for r := 0; r < 5; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				done := len(order) == messages
+				mu.Unlock()
+				if done {
+					return
+				}
+				if err := mb.ReceiveSession(context.Background(), testQueue, "client", 3, 50*time.Millisecond, handle); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxActive != 1 {
+		t.Errorf("%d messages of the session were handled at once", maxActive)
+	}
+	for i, id := range order {
+		if want := string(rune('a' + i)); id != want {
+			t.Fatalf("session delivered %v, out of order at %d", order, i)
+		}
+	}
+}
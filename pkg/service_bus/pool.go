@@ -0,0 +1,145 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// opening an AMQP link costs a round trip or two, so senders and receivers are opened on first
+// use and kept on the ServiceBus. a link that fails is closed and dropped, the next call for that
+// queue opens a fresh one
+
+var ErrClosed = errors.New("service bus client is closed")
+
+type receiverKey struct {
+	queue    string
+	subQueue azservicebus.SubQueue
+}
+
+// pooledReceiver serializes use of a receiver, ReceiveMessages can't be called concurrently
+type pooledReceiver struct {
+	mu       sync.Mutex
+	receiver *azservicebus.Receiver // nil until first use and after a failure
+}
+
+// sender returns the cached sender for queue, opening it if needed
+func (sb *ServiceBus) sender(queue string) (*azservicebus.Sender, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.closed {
+		return nil, ErrClosed
+	}
+	if sender, ok := sb.senders[queue]; ok {
+		return sender, nil
+	}
+	sender, err := sb.client.NewSender(queue, nil)
+	if err != nil {
+		return nil, err
+	}
+	sb.senders[queue] = sender
+	return sender, nil
+}
+
+// dropSender closes sender after a failure and forgets it, unless it was already replaced
+func (sb *ServiceBus) dropSender(queue string, sender *azservicebus.Sender) {
+	sb.mu.Lock()
+	if sb.senders[queue] == sender {
+		delete(sb.senders, queue)
+	}
+	sb.mu.Unlock()
+	sender.Close(context.Background())
+}
+
+// checkOpen fails with ErrClosed after Close, for calls that don't go through the pools
+func (sb *ServiceBus) checkOpen() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// withReceiver runs fn with the cached receiver for queue (and sub queue), holding it exclusively.
+// if fn fails the receiver is closed so the next call starts on a new link
+func (sb *ServiceBus) withReceiver(queue string, subQueue azservicebus.SubQueue, fn func(receiver *azservicebus.Receiver) error) error {
+	sb.mu.Lock()
+	if sb.closed {
+		sb.mu.Unlock()
+		return ErrClosed
+	}
+	key := receiverKey{queue: queue, subQueue: subQueue}
+	pooled, ok := sb.receivers[key]
+	if !ok {
+		pooled = &pooledReceiver{}
+		sb.receivers[key] = pooled
+	}
+	sb.mu.Unlock()
+
+	pooled.mu.Lock()
+	defer pooled.mu.Unlock()
+	if pooled.receiver == nil {
+		// Close may have run while waiting for the receiver
+		sb.mu.Lock()
+		closed := sb.closed
+		sb.mu.Unlock()
+		if closed {
+			return ErrClosed
+		}
+
+		var options *azservicebus.ReceiverOptions
+		if subQueue != 0 {
+			options = &azservicebus.ReceiverOptions{SubQueue: subQueue}
+		}
+		receiver, err := sb.client.NewReceiverForQueue(queue, options)
+		if err != nil {
+			return err
+		}
+		pooled.receiver = receiver
+	}
+
+	err := fn(pooled.receiver)
+	if err != nil {
+		pooled.receiver.Close(context.Background())
+		pooled.receiver = nil
+	}
+	return err
+}
+
+// Close closes every pooled sender and receiver and then the client. receivers in use are
+// closed once the call using them returns; any call after Close fails with ErrClosed
+func (sb *ServiceBus) Close(ctx context.Context) error {
+	sb.mu.Lock()
+	if sb.closed {
+		sb.mu.Unlock()
+		return nil
+	}
+	sb.closed = true
+	senders, receivers := sb.senders, sb.receivers
+	sb.senders, sb.receivers = map[string]*azservicebus.Sender{}, map[receiverKey]*pooledReceiver{}
+	sb.mu.Unlock()
+
+	var errs []error
+	for queue, sender := range senders {
+		if err := sender.Close(ctx); err != nil {
+			errs = append(errs, wrapError("close sender", queue, err))
+		}
+	}
+	for key, pooled := range receivers {
+		pooled.mu.Lock()
+		if pooled.receiver != nil {
+			if err := pooled.receiver.Close(ctx); err != nil {
+				errs = append(errs, wrapError("close receiver", key.queue, err))
+			}
+			pooled.receiver = nil
+		}
+		pooled.mu.Unlock()
+	}
+	if err := sb.client.Close(ctx); err != nil {
+		errs = append(errs, wrapError("close", "", err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,131 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// Delivery is a received message handed to a Receive handler
+type Delivery struct {
+	Msg           Msg
+	MessageID     string
+	DeliveryCount uint32 // 1 on the first delivery
+}
+
+// DeadLetterError is returned by a Receive handler to dead-letter the message instead of retrying it
+type DeadLetterError struct {
+	Reason      string
+	Description string
+}
+
+func (e *DeadLetterError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Description)
+}
+
+func DeadLetter(reason string, description string) error {
+	return &DeadLetterError{Reason: reason, Description: description}
+}
+
+// Receive waits up to wait for up to count messages and passes each to handle, wait also bounds how
+// long it holds the queue's receiver. a message is completed when handle returns nil, dead-lettered
+// when it returns a *DeadLetterError or its body isn't a Msg, and abandoned for redelivery on any
+// other error, so every message is handled at least once. it returns without error when no message
+// arrived in time
+func (sb *ServiceBus) Receive(ctx context.Context, queue string, count int, wait time.Duration, handle func(delivery Delivery) error) error {
+	err := sb.withReceiver(queue, 0, func(receiver *azservicebus.Receiver) error {
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		messages, err := receiver.ReceiveMessages(waitCtx, count, nil)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+
+		for _, message := range messages {
+			if err := settle(receiver, message, handle); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return wrapError("receive", queue, err)
+}
+
+// ReceiveSession is Receive for one session of a session enabled queue. the session is locked to
+// this call, so no other receiver gets its messages meanwhile, and released when it returns.
+// it returns without error when the session had no message in time
+func (sb *ServiceBus) ReceiveSession(ctx context.Context, queue string, sessionID string, count int, wait time.Duration, handle func(delivery Delivery) error) error {
+	if err := sb.checkOpen(); err != nil {
+		return wrapError("receive session", queue, err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	receiver, err := sb.client.AcceptSessionForQueue(waitCtx, queue, sessionID, nil)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return nil
+		}
+		return wrapError("receive session", queue, err)
+	}
+	defer receiver.Close(context.Background())
+
+	messages, err := receiver.ReceiveMessages(waitCtx, count, nil)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return nil
+		}
+		return wrapError("receive session", queue, err)
+	}
+	for _, message := range messages {
+		if err := settle(receiver, message, handle); err != nil {
+			return wrapError("receive session", queue, err)
+		}
+	}
+	return nil
+}
+
+// settler is implemented by both the plain and the session receiver
+type settler interface {
+	CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error
+	AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error
+	DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error
+}
+
+// settle runs handle for one message and settles it according to the result. settlement isn't
+// tied to the receive context so a shutdown doesn't leave handled messages locked
+func settle(receiver settler, message *azservicebus.ReceivedMessage, handle func(delivery Delivery) error) error {
+	ctx := context.Background()
+	delivery := Delivery{MessageID: message.MessageID, DeliveryCount: message.DeliveryCount}
+
+	err := delivery.Msg.Deserialize(message.Body)
+	if err != nil {
+		err = DeadLetter("unparseable message", err.Error())
+	} else {
+		delivery.Msg.MessageID = message.MessageID
+		if message.SessionID != nil {
+			delivery.Msg.SessionID = *message.SessionID
+		}
+		err = handle(delivery)
+	}
+
+	var deadLetter *DeadLetterError
+	switch {
+	case err == nil:
+		return receiver.CompleteMessage(ctx, message, nil)
+	case errors.As(err, &deadLetter):
+		return receiver.DeadLetterMessage(ctx, message, &azservicebus.DeadLetterOptions{
+			Reason:           to.Ptr(deadLetter.Reason),
+			ErrorDescription: to.Ptr(deadLetter.Description),
+		})
+	default:
+		return receiver.AbandonMessage(ctx, message, nil)
+	}
+}
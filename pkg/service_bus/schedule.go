@@ -0,0 +1,83 @@
+package serviceBus
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// scheduled messages go over the management link, one request per chunk
+const scheduleChunkSize = 100
+
+// ScheduleMessages schedules the messages for delivery at the given time. it returns the sequence
+// number of every scheduled message (needed to cancel it, 0 where scheduling failed) and one error
+// per message like SendMessageBatch; after a failed chunk the remaining messages are not attempted
+func (sb *ServiceBus) ScheduleMessages(
+	messages []Msg,
+	queue string,
+	at time.Time,
+) ([]int64, []error, error) {
+	sequenceNumbers := make([]int64, len(messages))
+	errs := make([]error, len(messages))
+	failFrom := func(start int, err error) {
+		for i := start; i < len(messages); i++ {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+
+	sender, err := sb.sender(queue)
+	if err != nil {
+		failFrom(0, wrapError("schedule", queue, err))
+		return sequenceNumbers, errs, batchError(errs)
+	}
+
+	for start := 0; start < len(messages); start += scheduleChunkSize {
+		end := min(start+scheduleChunkSize, len(messages))
+
+		chunk := []*azservicebus.Message{}
+		indexes := []int{}
+		for i := start; i < end; i++ {
+			sbMessage, err := newMessage(messages[i])
+			if err != nil {
+				errs[i] = &Error{Op: "schedule", Queue: queue, Err: err}
+				continue
+			}
+			chunk = append(chunk, sbMessage)
+			indexes = append(indexes, i)
+		}
+		if len(chunk) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		scheduled, err := sender.ScheduleMessages(ctx, chunk, at, nil)
+		cancel()
+		if err != nil {
+			sb.dropSender(queue, sender)
+			failFrom(start, wrapError("schedule", queue, err))
+			return sequenceNumbers, errs, batchError(errs)
+		}
+		for j, i := range indexes {
+			sequenceNumbers[i] = scheduled[j]
+		}
+	}
+	return sequenceNumbers, errs, batchError(errs)
+}
+
+// CancelScheduledMessages cancels scheduled messages that haven't been enqueued yet
+func (sb *ServiceBus) CancelScheduledMessages(queue string, sequenceNumbers []int64) error {
+	sender, err := sb.sender(queue)
+	if err != nil {
+		return wrapError("cancel scheduled", queue, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := sender.CancelScheduledMessages(ctx, sequenceNumbers, nil); err != nil {
+		sb.dropSender(queue, sender)
+		return wrapError("cancel scheduled", queue, err)
+	}
+	return nil
+}
@@ -3,265 +3,402 @@ package serviceBus
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
-	audioTypes "manic-compression/pkg/audio_types"
-
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
 )
 
 // see https://learn.microsoft.com/en-us/azure/service-bus-messaging/service-bus-go-how-to-use-queues
 
+// Msg is a message of the task protocol, encoded as a versioned envelope (see envelope.go)
 type Msg struct {
-	Type    string `json:"type"`
-	Content string `json:"content"`
+	Type          MessageType
+	Content       string // the payload as JSON
+	ID            string
+	CorrelationID string // shared by every message of one task
+	CausationID   string // ID of the message being handled when this one was sent
+	CreatedAt     time.Time
+	SentAt        time.Time // set when the message is handed to the broker
+	SchemaVersion int       // envelope version the message was decoded from
+
+	// SessionID groups messages of session enabled queues, only a receiver holding the session gets
+	// them and in order. it travels as a message property, not in the body
+	SessionID string
+	// MessageID is set to let the broker drop duplicates of a message, empty lets the broker pick one
+	MessageID string
 }
 
-func (m *Msg) Serialize() string {
-	msgBytes, err := json.Marshal(m)
+// sendTimeout bounds a single send, so a caller such as a request handler isn't blocked
+// indefinitely by an unreachable namespace. the deadline error is retryable
+const sendTimeout = 30 * time.Second
+
+// newMessage encodes a Msg as a Service Bus message
+func newMessage(message Msg) (*azservicebus.Message, error) {
+	message.SentAt = time.Now().UTC()
+	body, err := json.Marshal(message)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return string(msgBytes)
+	sbMessage := &azservicebus.Message{Body: body}
+	if message.MessageID != "" {
+		sbMessage.MessageID = to.Ptr(message.MessageID)
+	}
+	if message.SessionID != "" {
+		sbMessage.SessionID = to.Ptr(message.SessionID)
+	}
+	return sbMessage, nil
 }
 
-func (m *Msg) Deserialize(msgBody []byte) {
-	err := json.Unmarshal(msgBody, m)
+func (m *Msg) Serialize() (string, error) {
+	msgBytes, err := json.Marshal(m)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+	return string(msgBytes), nil
 }
 
+func (m *Msg) Deserialize(msgBody []byte) error {
+	return json.Unmarshal(msgBody, m)
+}
+
+// ServiceBus is the Azure Service Bus Broker, it is safe for concurrent use, call Close when done with it
 type ServiceBus struct {
 	client *azservicebus.Client
+	admin  *admin.Client
+
+	mu        sync.Mutex
+	closed    bool
+	senders   map[string]*azservicebus.Sender
+	receivers map[receiverKey]*pooledReceiver
 }
 
 const (
 	TaskCompleted  = "Completed"
 	TaskInProgress = "In Progress"
+	TaskFailed     = "Failed"
+	TaskScheduled  = "Scheduled"
+	TaskCancelled  = "Cancelled"
+	TaskQueued     = "Queued" // waiting in its priority lane
 )
 
-func NewServiceBus() *ServiceBus {
+func NewServiceBus() (*ServiceBus, error) {
 
 	connectionString, ok := os.LookupEnv("AZURE_SERVICEBUS_CONNECTION_STRING")
 	if !ok {
-		panic("AZURE_SERVICEBUS_CONNECTION_STRING environment variable not found")
+		return nil, &Error{Op: "connect", Err: ErrMissingConnectionString}
 	}
 
 	client, err := azservicebus.NewClientFromConnectionString(connectionString, nil)
 	if err != nil {
-		panic(err)
+		return nil, wrapError("connect", "", err)
+	}
+	adminClient, err := admin.NewClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		return nil, wrapError("connect", "", err)
 	}
 
 	return &ServiceBus{
-		client: client,
-	}
+		client:    client,
+		admin:     adminClient,
+		senders:   map[string]*azservicebus.Sender{},
+		receivers: map[receiverKey]*pooledReceiver{},
+	}, nil
 
 }
+
 func (sb *ServiceBus) SendMessage(
 	message Msg,
 	queue string,
-) {
+) error {
 
-	jsonMessage, err := json.Marshal(message)
+	sbMessage, err := newMessage(message)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "send", Queue: queue, Err: err}
 	}
 
-	sender, err := sb.client.NewSender(queue, nil)
+	sender, err := sb.sender(queue)
 	if err != nil {
-		panic(err)
+		return wrapError("send", queue, err)
 	}
-	defer sender.Close(context.TODO())
 
-	sbMessage := &azservicebus.Message{
-		Body: jsonMessage,
-	}
-	err = sender.SendMessage(context.TODO(), sbMessage, nil)
-	if err != nil {
-		panic(err)
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := sender.SendMessage(ctx, sbMessage, nil); err != nil {
+		sb.dropSender(queue, sender)
+		return wrapError("send", queue, err)
 	}
+	return nil
 }
 
-func (sb *ServiceBus) SendMessageBatch(
-	messages []Msg,
+// SendMessageAt schedules a message, it stays invisible to receivers until the given time
+func (sb *ServiceBus) SendMessageAt(
+	message Msg,
 	queue string,
-) {
-	sender, err := sb.client.NewSender(queue, nil)
+	at time.Time,
+) error {
+	sbMessage, err := newMessage(message)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "schedule", Queue: queue, Err: err}
 	}
-	defer sender.Close(context.TODO())
+	sbMessage.ScheduledEnqueueTime = &at
 
-	batch, err := sender.NewMessageBatch(context.TODO(), nil)
+	sender, err := sb.sender(queue)
 	if err != nil {
-		panic(err)
+		return wrapError("schedule", queue, err)
 	}
 
-	for _, message := range messages {
-		jsonMessage, err := json.Marshal(message)
-		if err != nil {
-			panic(err)
-		}
-
-		if err := batch.AddMessage(&azservicebus.Message{Body: jsonMessage}, nil); err != nil {
-			panic(err)
-		}
-	}
-	if err := sender.SendMessageBatch(context.TODO(), batch, nil); err != nil {
-		panic(err)
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := sender.SendMessage(ctx, sbMessage, nil); err != nil {
+		sb.dropSender(queue, sender)
+		return wrapError("schedule", queue, err)
 	}
+	return nil
 }
 
-func (sb *ServiceBus) GetMessage(count int, queue string) {
-	receiver, err := sb.client.NewReceiverForQueue(queue, nil)
+// SendMessageBatch sends the messages in as few batches as possible, starting a new batch whenever
+// the current one is full. it returns one error per message, nil for every message that was enqueued,
+// and an error wrapping the first failure if any message wasn't. once a send fails the remaining
+// messages are not attempted
+func (sb *ServiceBus) SendMessageBatch(
+	messages []Msg,
+	queue string,
+) ([]error, error) {
+	sender, err := sb.sender(queue)
 	if err != nil {
-		panic(err)
+		errs := make([]error, len(messages))
+		for i := range errs {
+			errs[i] = wrapError("send batch", queue, err)
+		}
+		return errs, batchError(errs)
 	}
-	defer receiver.Close(context.TODO())
 
-	messages, err := receiver.ReceiveMessages(context.TODO(), count, nil)
-	if err != nil {
-		panic(err)
+	errs, broken := sendInBatches(azureBatchSender{sender}, messages, queue)
+	if broken {
+		sb.dropSender(queue, sender)
 	}
+	return errs, batchError(errs)
+}
 
-	for _, message := range messages {
-		var messageData Msg
-		if err := json.Unmarshal(message.Body, &messageData); err != nil {
-			fmt.Println("Error unmarshalling message:", err)
-			continue
-		}
+// messageBatch and batchSender are the parts of the azservicebus batch API SendMessageBatch uses
+type messageBatch interface {
+	AddMessage(message *azservicebus.Message, options *azservicebus.AddMessageOptions) error
+}
 
-		fmt.Printf("Received message: %+v\n", messageData)
+type batchSender interface {
+	NewMessageBatch(ctx context.Context) (messageBatch, error)
+	SendMessageBatch(ctx context.Context, batch messageBatch) error
+}
 
-		// CompleteMessage marks the message as complete which removes it from the queue
-		err = receiver.CompleteMessage(context.TODO(), message, nil)
-		if err != nil {
-			panic(err)
-		}
-	}
+type azureBatchSender struct {
+	sender *azservicebus.Sender
 }
 
-// for messages that exceed deadlines, or are otherwise invalid, you can dead letter them
-func (sb *ServiceBus) DeadLetterMessage(queue string) {
-	deadLetterOptions := &azservicebus.DeadLetterOptions{
-		ErrorDescription: to.Ptr("exampleErrorDescription"),
-		Reason:           to.Ptr("exampleReason"),
-	}
+func (s azureBatchSender) NewMessageBatch(ctx context.Context) (messageBatch, error) {
+	return s.sender.NewMessageBatch(ctx, nil)
+}
 
-	receiver, err := sb.client.NewReceiverForQueue(queue, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer receiver.Close(context.TODO())
+func (s azureBatchSender) SendMessageBatch(ctx context.Context, batch messageBatch) error {
+	return s.sender.SendMessageBatch(ctx, batch.(*azservicebus.MessageBatch), nil)
+}
 
-	messages, err := receiver.ReceiveMessages(context.TODO(), 1, nil)
-	if err != nil {
-		panic(err)
+// sendInBatches splits the messages across batches of sender, see SendMessageBatch. broken reports
+// whether a batch couldn't be created or sent, the sender shouldn't be reused then
+func sendInBatches(sender batchSender, messages []Msg, queue string) (errs []error, broken bool) {
+	errs = make([]error, len(messages))
+	failFrom := func(start int, err error) {
+		for i := start; i < len(messages); i++ {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
 	}
 
-	if len(messages) == 1 {
-		err := receiver.DeadLetterMessage(context.TODO(), messages[0], deadLetterOptions)
+	var batch messageBatch
+	inBatch := []int{} // indexes of the messages in the current batch
+
+	flush := func() error {
+		if len(inBatch) == 0 {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		defer cancel()
+		err := sender.SendMessageBatch(ctx, batch)
 		if err != nil {
-			panic(err)
+			broken = true
+			err = wrapError("send batch", queue, err)
+		}
+		for _, i := range inBatch {
+			errs[i] = err
 		}
+		batch, inBatch = nil, []int{}
+		return err
 	}
-}
 
-func (sb *ServiceBus) GetDeadLetterMessage(queue string) {
-	receiver, err := sb.client.NewReceiverForQueue(
-		queue,
-		&azservicebus.ReceiverOptions{
-			SubQueue: azservicebus.SubQueueDeadLetter,
-		},
-	)
-	if err != nil {
-		panic(err)
-	}
-	defer receiver.Close(context.TODO())
+	for i, message := range messages {
+		sbMessage, err := newMessage(message)
+		if err != nil {
+			errs[i] = &Error{Op: "send batch", Queue: queue, Err: err}
+			continue
+		}
 
-	messages, err := receiver.ReceiveMessages(context.TODO(), 1, nil)
-	if err != nil {
-		panic(err)
-	}
+		for {
+			if batch == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+				batch, err = sender.NewMessageBatch(ctx)
+				cancel()
+				if err != nil {
+					failFrom(i, wrapError("send batch", queue, err))
+					return errs, true
+				}
+			}
 
-	for _, message := range messages {
-		fmt.Printf("DeadLetter Reason: %s\nDeadLetter Description: %s\n", *message.DeadLetterReason, *message.DeadLetterErrorDescription) //change to struct an unmarshal into it
-		err := receiver.CompleteMessage(context.TODO(), message, nil)
-		if err != nil {
-			panic(err)
+			err = batch.AddMessage(sbMessage, nil)
+			if errors.Is(err, azservicebus.ErrMessageTooLarge) && len(inBatch) > 0 {
+				// the batch is full, send it and retry the message in a new one
+				if err := flush(); err != nil {
+					failFrom(i, err)
+					return errs, broken
+				}
+				continue
+			}
+			if err != nil {
+				// too large to ever fit a batch, or otherwise invalid
+				errs[i] = wrapError("send batch", queue, err)
+				break
+			}
+			inBatch = append(inBatch, i)
+			break
 		}
 	}
+	flush() // a failure is recorded against the messages of the batch
+	return errs, broken
 }
 
-func (sb *ServiceBus) PeekQueue(queue string) (map[string]audioTypes.AudioTask, error) {
-	tasks := make(map[string]audioTypes.AudioTask)
-
-	receiver, err := sb.client.NewReceiverForQueue(queue, nil)
-	if err != nil {
-		return nil, err
+// batchError summarizes per message errors, nil if every message was sent
+func batchError(errs []error) error {
+	var first error
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
 	}
-	defer receiver.Close(context.TODO())
+	if first == nil {
+		return nil
+	}
+	return fmt.Errorf("%d of %d messages were not sent: %w", failed, len(errs), first)
+}
 
-	for {
-		// peek at the next 10 messages
-		messages, err := receiver.PeekMessages(context.Background(), 10, nil)
+// GetMessage receives up to count messages and completes them, removing them from the queue.
+// messages that can't be decoded are skipped (and also removed)
+func (sb *ServiceBus) GetMessage(count int, queue string) ([]Msg, error) {
+	received := []Msg{}
+	err := sb.withReceiver(queue, 0, func(receiver *azservicebus.Receiver) error {
+		messages, err := receiver.ReceiveMessages(context.TODO(), count, nil)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		for _, message := range messages {
-			msg := Msg{}
-			task := audioTypes.AudioTask{}
-			msg.Deserialize(message.Body)
-			task.Deserialize([]byte(msg.Content))
-			tasks[task.TaskID] = task
-		}
+			var messageData Msg
+			if err := json.Unmarshal(message.Body, &messageData); err != nil {
+				fmt.Println("Error unmarshalling message:", err)
+			} else {
+				received = append(received, messageData)
+			}
 
-		if len(messages) < 10 {
-			// no more messages in the queue
-			break
+			// CompleteMessage marks the message as complete which removes it from the queue
+			if err := receiver.CompleteMessage(context.TODO(), message, nil); err != nil {
+				return err
+			}
 		}
-	}
-
-	return tasks, nil
+		return nil
+	})
+	return received, wrapError("receive", queue, err)
 }
 
+// ClearQueue completes every active message of the queue, session by session if the queue is session enabled
 func (sb *ServiceBus) ClearQueue(queue string) error {
-	receiver, err := sb.client.NewReceiverForQueue(queue, nil)
+	props, err := sb.admin.GetQueue(context.TODO(), queue, nil)
 	if err != nil {
-		return err
+		return wrapError("clear", queue, err)
+	}
+	if props == nil {
+		return &Error{Op: "clear", Queue: queue, Err: errors.New("queue not found")}
+	}
+	if props.RequiresSession != nil && *props.RequiresSession {
+		return wrapError("clear", queue, sb.clearSessions(queue))
 	}
-	defer receiver.Close(context.Background())
 
+	err = sb.withReceiver(queue, 0, func(receiver *azservicebus.Receiver) error {
+		return drain(receiver)
+	})
+	return wrapError("clear", queue, err)
+}
+
+// clearSessions drains the sessions of a queue one at a time until none has messages left
+func (sb *ServiceBus) clearSessions(queue string) error {
 	for {
-		ctxTimeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), clearWait)
+		receiver, err := sb.client.AcceptNextSessionForQueue(ctx, queue, nil)
+		cancel()
+		if err != nil {
+			var azErr *azservicebus.Error
+			if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &azErr) && azErr.Code == azservicebus.CodeTimeout) {
+				return nil // no session has messages
+			}
+			return err
+		}
+		err = drain(receiver)
+		receiver.Close(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// how long clearing waits for more messages before deciding the queue (or session) is empty
+const clearWait = time.Second
 
+// drainer is implemented by both the plain and the session receiver
+type drainer interface {
+	ReceiveMessages(ctx context.Context, maxMessages int, options *azservicebus.ReceiveMessagesOptions) ([]*azservicebus.ReceivedMessage, error)
+	CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error
+}
+
+// drain completes messages until none arrives within clearWait
+func drain(receiver drainer) error {
+	for {
+		ctxTimeout, cancel := context.WithTimeout(context.Background(), clearWait)
 		messages, err := receiver.ReceiveMessages(ctxTimeout, 10, nil)
+		cancel()
 		if err != nil {
-			if err == context.DeadlineExceeded {
-				break // exit if no more messages are received within the timeout
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil // exit if no more messages are received within the timeout
 			}
 			return err
 		}
 
 		for _, message := range messages {
 			// complete each message to remove it from the queue
-			err := receiver.CompleteMessage(context.Background(), message, nil)
-			if err != nil {
+			if err := receiver.CompleteMessage(context.Background(), message, nil); err != nil {
 				return err
 			}
 		}
 
 		if len(messages) < 10 {
 			// no more messages in the queue
-			break
+			return nil
 		}
 	}
-
-	return nil
 }
@@ -0,0 +1,111 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// fakeBatch holds messages up to a total body size, like a batch holds them up to its size limit
+type fakeBatch struct {
+	limit int
+	size  int
+	ids   []string
+}
+
+func (b *fakeBatch) AddMessage(message *azservicebus.Message, options *azservicebus.AddMessageOptions) error {
+	if b.size+len(message.Body) > b.limit {
+		return azservicebus.ErrMessageTooLarge
+	}
+	b.size += len(message.Body)
+	b.ids = append(b.ids, *message.MessageID)
+	return nil
+}
+
+// fakeBatchSender records the messages of every batch it sends, the send of batch failAt fails
+type fakeBatchSender struct {
+	limit  int
+	failAt int
+	sent   [][]string
+}
+
+func (s *fakeBatchSender) NewMessageBatch(ctx context.Context) (messageBatch, error) {
+	return &fakeBatch{limit: s.limit}, nil
+}
+
+func (s *fakeBatchSender) SendMessageBatch(ctx context.Context, batch messageBatch) error {
+	if len(s.sent)+1 == s.failAt {
+		return errors.New("connection lost")
+	}
+	s.sent = append(s.sent, batch.(*fakeBatch).ids)
+	return nil
+}
+
+func batchMessages(sizes ...int) []Msg {
+	messages := []Msg{}
+	for i, size := range sizes {
+		msg := Msg{Type: MessageProcessAudio, Content: `"` + strings.Repeat("x", size) + `"`, MessageID: string(rune('a' + i))}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestSendInBatches(t *testing.T) {
+	// a batch fits two of the small messages but not three
+	small := 100
+	message, err := newMessage(batchMessages(small)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := 2*len(message.Body) + len(message.Body)/2
+
+	for name, tc := range map[string]struct {
+		sizes  []int
+		failAt int
+		sent   []string // messages per sent batch
+		failed string   // messages that got an error
+		broken bool
+	}{
+		"one batch":      {sizes: []int{small, small}, sent: []string{"ab"}},
+		"batch full":     {sizes: []int{small, small, small, small, small}, sent: []string{"ab", "cd", "e"}},
+		"oversized":      {sizes: []int{small, 10 * small, small}, sent: []string{"a", "c"}, failed: "b"}, // tried again in an empty batch
+		"only oversized": {sizes: []int{10 * small}, failed: "a"},
+		"send fails":     {sizes: []int{small, small, small, small, small}, failAt: 2, sent: []string{"ab"}, failed: "cde", broken: true},
+		"last fails":     {sizes: []int{small, small, small}, failAt: 2, sent: []string{"ab"}, failed: "c", broken: true},
+		"empty":          {},
+	} {
+		sender := &fakeBatchSender{limit: limit, failAt: tc.failAt}
+		messages := batchMessages(tc.sizes...)
+		errs, broken := sendInBatches(sender, messages, testQueue)
+
+		sent := []string{}
+		for _, ids := range sender.sent {
+			sent = append(sent, strings.Join(ids, ""))
+		}
+		if strings.Join(sent, ",") != strings.Join(tc.sent, ",") {
+			t.Errorf("%s: sent batches %v, want %v", name, sent, tc.sent)
+		}
+		failed := ""
+		for i, err := range errs {
+			if err != nil {
+				failed += messages[i].MessageID
+				var sbErr *Error
+				if !errors.As(err, &sbErr) || sbErr.Queue != testQueue {
+					t.Errorf("%s: message %s failed with %v", name, messages[i].MessageID, err)
+				}
+			}
+		}
+		if len(errs) != len(messages) || failed != tc.failed || broken != tc.broken {
+			t.Errorf("%s: %d errors, failed %q, broken %v, want failed %q, broken %v", name, len(errs), failed, broken, tc.failed, tc.broken)
+		}
+	}
+
+	// an oversized message fails with the size error
+	errs, _ := sendInBatches(&fakeBatchSender{limit: limit}, batchMessages(10*small), testQueue)
+	if !errors.Is(errs[0], azservicebus.ErrMessageTooLarge) {
+		t.Errorf("oversized message failed with %v", errs[0])
+	}
+}
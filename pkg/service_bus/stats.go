@@ -0,0 +1,147 @@
+package serviceBus
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// QueueStats are the message counts and size of a queue, read without receiving any message
+type QueueStats struct {
+	Queue                      string    `json:"queue"`
+	ActiveMessages             int32     `json:"activeMessages"`
+	ScheduledMessages          int32     `json:"scheduledMessages"`
+	DeadLetterMessages         int32     `json:"deadLetterMessages"`
+	TransferMessages           int32     `json:"transferMessages"`
+	TransferDeadLetterMessages int32     `json:"transferDeadLetterMessages"`
+	TotalMessages              int64     `json:"totalMessages"`
+	SizeBytes                  int64     `json:"sizeBytes"`
+	UpdatedAt                  time.Time `json:"updatedAt"` // when the counts were last updated by the broker
+}
+
+// message states reported by Peek
+const (
+	MessageActive    = "active"
+	MessageScheduled = "scheduled"
+	MessageDeferred  = "deferred"
+)
+
+// PeekedMessage is a message looked at in place, Task is set when the payload is an audio task
+type PeekedMessage struct {
+	SequenceNumber int64                 `json:"sequenceNumber"`
+	MessageID      string                `json:"messageID"`
+	SessionID      string                `json:"sessionID,omitempty"`
+	State          string                `json:"state"`
+	EnqueuedAt     time.Time             `json:"enqueuedAt"`
+	ScheduledAt    *time.Time            `json:"scheduledAt,omitempty"`
+	DeliveryCount  uint32                `json:"deliveryCount"`
+	Msg            *Msg                  `json:"msg,omitempty"`
+	Task           *audioTypes.AudioTask `json:"task,omitempty"`
+	Body           string                `json:"body,omitempty"` // raw body when it isn't a Msg
+}
+
+// PeekOptions pages through a queue. SessionID is required for session enabled queues, which can
+// only be peeked one session at a time
+type PeekOptions struct {
+	FromSequenceNumber int64
+	Max                int
+	SessionID          string
+}
+
+// peekPageSize is used when PeekOptions.Max isn't set
+const peekPageSize = 50
+
+func (opts PeekOptions) max() int {
+	if opts.Max <= 0 {
+		return peekPageSize
+	}
+	return opts.Max
+}
+
+// QueueStats reads the queue's runtime properties with the administration client
+func (sb *ServiceBus) QueueStats(queue string) (QueueStats, error) {
+	if err := sb.checkOpen(); err != nil {
+		return QueueStats{}, wrapError("stats", queue, err)
+	}
+	props, err := sb.admin.GetQueueRuntimeProperties(context.TODO(), queue, nil)
+	if err != nil {
+		return QueueStats{}, wrapError("stats", queue, err)
+	}
+	if props == nil {
+		return QueueStats{}, &Error{Op: "stats", Queue: queue, Err: errors.New("queue not found")}
+	}
+	return QueueStats{
+		Queue:                      queue,
+		ActiveMessages:             props.ActiveMessageCount,
+		ScheduledMessages:          props.ScheduledMessageCount,
+		DeadLetterMessages:         props.DeadLetterMessageCount,
+		TransferMessages:           props.TransferMessageCount,
+		TransferDeadLetterMessages: props.TransferDeadLetterMessageCount,
+		TotalMessages:              props.TotalMessageCount,
+		SizeBytes:                  props.SizeInBytes,
+		UpdatedAt:                  props.UpdatedAt,
+	}, nil
+}
+
+// Peek returns up to opts.Max messages starting at opts.FromSequenceNumber without locking or
+// changing them. the next page starts after the last sequence number returned
+func (sb *ServiceBus) Peek(queue string, opts PeekOptions) ([]PeekedMessage, error) {
+	if err := sb.checkOpen(); err != nil {
+		return nil, wrapError("peek", queue, err)
+	}
+	peekOptions := &azservicebus.PeekMessagesOptions{FromSequenceNumber: to.Ptr(opts.FromSequenceNumber)}
+
+	var messages []*azservicebus.ReceivedMessage
+	var err error
+	if opts.SessionID != "" {
+		// peeking a session needs its lock, which is released right away
+		var receiver *azservicebus.SessionReceiver
+		receiver, err = sb.client.AcceptSessionForQueue(context.TODO(), queue, opts.SessionID, nil)
+		if err == nil {
+			messages, err = receiver.PeekMessages(context.TODO(), opts.max(), peekOptions)
+			receiver.Close(context.Background())
+		}
+	} else {
+		err = sb.withReceiver(queue, 0, func(receiver *azservicebus.Receiver) error {
+			messages, err = receiver.PeekMessages(context.TODO(), opts.max(), peekOptions)
+			return err
+		})
+	}
+	if err != nil {
+		return nil, wrapError("peek", queue, err)
+	}
+
+	peeked := []PeekedMessage{}
+	for _, message := range messages {
+		peeked = append(peeked, newPeekedMessage(message))
+	}
+	return peeked, nil
+}
+
+func newPeekedMessage(message *azservicebus.ReceivedMessage) PeekedMessage {
+	received := newReceivedFields(message)
+	peeked := PeekedMessage{
+		SequenceNumber: received.SequenceNumber,
+		MessageID:      received.MessageID,
+		SessionID:      received.SessionID,
+		State:          MessageActive,
+		EnqueuedAt:     received.EnqueuedAt,
+		ScheduledAt:    message.ScheduledEnqueueTime,
+		DeliveryCount:  received.DeliveryCount,
+		Msg:            received.Msg,
+		Task:           received.Task,
+		Body:           received.Body,
+	}
+	switch message.State {
+	case azservicebus.MessageStateScheduled:
+		peeked.State = MessageScheduled
+	case azservicebus.MessageStateDeferred:
+		peeked.State = MessageDeferred
+	}
+	return peeked
+}
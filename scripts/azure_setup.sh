@@ -16,3 +16,13 @@
 
 # # set environment variables
 # az webapp config appsettings set --name manic-compression --resource-group my-team --settings AZURE_STORAGE_CONNECTION_STRING=$AZURE_STORAGE_CONNECTION_STRING
+
+# # create the priority lane queues (see web/manic-server/lanes.go). sessions group the tasks of a client and
+# # duplicate detection drops resent tasks, both can only be set when a queue is created
+# for lane in high normal low; do
+#   az servicebus queue create --resource-group my-team --namespace-name $SERVICEBUS_NAMESPACE --name audiotasks-$lane \
+#     --enable-session true --enable-duplicate-detection true --duplicate-detection-history-time-window PT10M
+# done
+
+# # set the task lease and in flight limits of the dispatcher
+# az webapp config appsettings set --name manic-compression --resource-group my-team --settings TASK_LEASE=30m MAX_IN_FLIGHT_TASKS=16 MAX_IN_FLIGHT_PER_CLIENT=4
@@ -1,4 +1,4 @@
-import React, { useEffect, useState } from "react";
+import React, { useEffect, useRef, useState } from "react";
 import {
   ChakraProvider,
   Button,
@@ -23,6 +23,9 @@ const App = () => {
   const [selectedAudioFunctions, setSelectedAudioFunctions] = useState([]);
   const [audioFunctionPipeline, setAudioFunctionPipeline] = useState([]);
 
+  // one key per start, kept until it succeeds so repeats of the same start are deduplicated
+  const idempotencyKey = useRef(crypto.randomUUID());
+
   useEffect(() => {
     setIsLoading(true);
     const initialize = async () => {
@@ -54,7 +57,8 @@ const App = () => {
         clientID: "webclient:3000",
         audioFunctionPipeline: audioFunctionPipeline,
       };
-      await handleStart(job);
+      await handleStart(job, idempotencyKey.current);
+      idempotencyKey.current = crypto.randomUUID();
     } catch (error) {
       console.error("Failed to start manic compression:", error);
     } finally {
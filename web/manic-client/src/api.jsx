@@ -8,14 +8,23 @@ const getEndpoint = async (endpoint) => {
   return res.data;
 };
 
+// returns the upload response, files that weren't stored (not audio, name taken, ...) are listed in
+// rejected. the request only fails (422 or 409) when no file was stored, its response lists them too
 const handleFileUpload = async (event, endpoint) => {
   const uploadedFiles = event.target.files;
   const formData = new FormData();
   for (const file of uploadedFiles) {
     formData.append("files", file);
   }
-  const res = await axios.post(API_PATH + endpoint, formData);
-  return res.data;
+  try {
+    const res = await axios.post(API_PATH + endpoint, formData);
+    return res.data;
+  } catch (error) {
+    if (error.response && error.response.data && error.response.data.rejected) {
+      return error.response.data;
+    }
+    throw error;
+  }
 };
 
 const handleFileDownload = async (containerPath, fileName) => {
@@ -35,12 +44,17 @@ const handleFileDownload = async (containerPath, fileName) => {
   }
 };
 
-const handleStart = async (job) => {
-  const res = await axios.post(API_PATH + "/start", {
-    inputFiles: job.inputFiles,
-    clientID: job.clientID,
-    audioFunctionPipeline: job.audioFunctionPipeline,
-  });
+// the idempotency key makes a repeated start (double click, retry) return the first response
+const handleStart = async (job, idempotencyKey) => {
+  const res = await axios.post(
+    API_PATH + "/start",
+    {
+      inputFiles: job.inputFiles,
+      clientID: job.clientID,
+      audioFunctionPipeline: job.audioFunctionPipeline,
+    },
+    { headers: { "Idempotency-Key": idempotencyKey } }
+  );
   return res.data;
 };
 
@@ -88,9 +102,23 @@ const handleDelete = async (containerPath, fileName) => {
   return res.data;
 };
 
+const JOB_POLL_INTERVAL = 1000;
+
+// polls a background job until it is no longer running and returns it
+const waitForJob = async (jobID) => {
+  for (;;) {
+    const res = await axios.get(`${API_PATH}/jobs/${jobID}`);
+    if (res.data.status !== "Running") {
+      return res.data;
+    }
+    await new Promise((resolve) => setTimeout(resolve, JOB_POLL_INTERVAL));
+  }
+};
+
+// clearing a container runs as a background job, this resolves with the job once it has finished
 const handleContainerClear = async (containerPath) => {
   const res = await axios.delete(API_PATH + containerPath);
-  return res.data;
+  return waitForJob(res.data.id);
 };
 
 export {
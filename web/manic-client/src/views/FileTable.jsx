@@ -79,7 +79,11 @@ const FileTable = ({
   const onFileUpload = async (event) => {
     setIsLoading(true);
     try {
-      await handleFileUpload(event, containerPath);
+      const result = await handleFileUpload(event, containerPath);
+      if (result.rejected && result.rejected.length > 0) {
+        const reasons = result.rejected.map((r) => `${r.name}: ${r.error}`);
+        window.alert(`Some files were not uploaded:\n${reasons.join("\n")}`);
+      }
       const updatedFiles = await getEndpoint(containerPath);
       setFiles(updatedFiles);
     } catch (error) {
@@ -98,8 +102,12 @@ const FileTable = ({
     }
     setIsLoading(true);
     try {
-      await handleContainerClear(containerPath);
-      setFiles([]);
+      const job = await handleContainerClear(containerPath);
+      if (job.status === "Failed") {
+        window.alert(`Could not clear ${containerPath}: ${job.error}`);
+      }
+      const files = await getEndpoint(containerPath);
+      setFiles(files);
     } catch (error) {
       console.error("Failed to clear container:", error);
     } finally {
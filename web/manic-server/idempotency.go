@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed" // set on responses that replay an earlier request
+
+	// message IDs are limited to 128 characters and the key gets a task index appended
+	maxIdempotencyKeyLength = 100
+	idempotencyTTL          = 24 * time.Hour // how long a key is remembered
+)
+
+var (
+	errIdempotencyInProgress = errors.New("a request with this idempotency key is still in progress")
+	errIdempotencyMismatch   = errors.New("the idempotency key was already used for a different request")
+)
+
+func validIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return fmt.Errorf("%s is longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return fmt.Errorf("%s may only contain printable ASCII characters", idempotencyKeyHeader)
+		}
+	}
+	return nil
+}
+
+// startRequestHash identifies the request a key was first used with
+func startRequestHash(req StartRequest) string {
+	data, _ := json.Marshal(req)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+type idempotencyRecord struct {
+	RequestHash string         `json:"requestHash"`
+	Response    *StartResponse `json:"response,omitempty"` // nil while the request is being handled
+	CreatedAt   time.Time      `json:"createdAt"`
+}
+
+// IdempotencyStore remembers the response to each start request sent with an Idempotency-Key,
+// persisted to a JSON file so a replay after a restart doesn't enqueue the tasks again
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]idempotencyRecord
+}
+
+// NewIdempotencyStore loads the keys persisted at path, a missing file starts empty
+func NewIdempotencyStore(path string) (*IdempotencyStore, error) {
+	s := &IdempotencyStore{path: path, records: map[string]idempotencyRecord{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		return nil, fmt.Errorf("could not parse idempotency keys %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Begin claims key for a request. it returns the stored response if the key was already used for
+// the same request, errIdempotencyInProgress while that request is still being handled and
+// errIdempotencyMismatch if it was used for a different one. a claimed key must be passed to Finish
+func (s *IdempotencyStore) Begin(key string, requestHash string) (*StartResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[key]
+	if ok && time.Since(record.CreatedAt) < idempotencyTTL {
+		if record.RequestHash != requestHash {
+			return nil, errIdempotencyMismatch
+		}
+		if record.Response == nil {
+			return nil, errIdempotencyInProgress
+		}
+		return record.Response, nil
+	}
+	s.records[key] = idempotencyRecord{RequestHash: requestHash, CreatedAt: time.Now()}
+	return nil, nil
+}
+
+// Finish stores the response of a claimed key, a nil response releases the key so the request can be tried again
+func (s *IdempotencyStore) Finish(key string, response *StartResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if response == nil {
+		delete(s.records, key)
+	} else {
+		record := s.records[key]
+		record.Response = response
+		s.records[key] = record
+	}
+	return s.persist()
+}
+
+// persist writes the finished requests, expired keys are dropped on the way. s.mu must be held
+func (s *IdempotencyStore) persist() error {
+	persisted := map[string]idempotencyRecord{}
+	for k, record := range s.records {
+		if time.Since(record.CreatedAt) >= idempotencyTTL {
+			delete(s.records, k)
+			continue
+		}
+		if record.Response != nil {
+			persisted[k] = record
+		}
+	}
+	return writeJSONFile(s.path, persisted)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestIdempotencyStore(t *testing.T, path string) *IdempotencyStore {
+	t.Helper()
+	s, err := NewIdempotencyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// persistedKeys returns the keys in the store's file
+func persistedKeys(t *testing.T, path string) map[string]idempotencyRecord {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]idempotencyRecord{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.json")
+	s := newTestIdempotencyStore(t, path)
+	response := &StartResponse{Failed: []TaskFailure{{InputFile: "a.wav", Error: "missing"}}}
+
+	if original, err := s.Begin("key", "hash"); original != nil || err != nil {
+		t.Fatalf("first use returned %v, %v", original, err)
+	}
+	for name, tc := range map[string]struct {
+		hash string
+		err  error
+	}{
+		"in progress": {"hash", errIdempotencyInProgress},
+		"mismatch":    {"other", errIdempotencyMismatch},
+	} {
+		if _, err := s.Begin("key", tc.hash); !errors.Is(err, tc.err) {
+			t.Errorf("%s: returned %v, want %v", name, err, tc.err)
+		}
+	}
+	if err := s.Finish("key", response); err != nil {
+		t.Fatal(err)
+	}
+
+	// the response is replayed, after a restart too
+	for name, store := range map[string]*IdempotencyStore{"same store": s, "reloaded": newTestIdempotencyStore(t, path)} {
+		original, err := store.Begin("key", "hash")
+		if err != nil || original == nil || len(original.Failed) != 1 || original.Failed[0].InputFile != "a.wav" {
+			t.Errorf("%s: replay returned %+v, %v", name, original, err)
+		}
+		if _, err := store.Begin("key", "other"); !errors.Is(err, errIdempotencyMismatch) {
+			t.Errorf("%s: reuse for another request returned %v", name, err)
+		}
+	}
+}
+
+func TestIdempotencyRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.json")
+	s := newTestIdempotencyStore(t, path)
+	if _, err := s.Begin("key", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Finish("key", nil); err != nil {
+		t.Fatal(err)
+	}
+	// a released key can be used again, for any request
+	if original, err := s.Begin("key", "other"); original != nil || err != nil {
+		t.Errorf("released key returned %v, %v", original, err)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	for name, finish := range map[string]*StartResponse{"finished": {}, "released": nil} {
+		path := filepath.Join(t.TempDir(), "idempotency.json")
+		s := newTestIdempotencyStore(t, path)
+		if _, err := s.Begin("old", "hash"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Finish("old", &StartResponse{}); err != nil {
+			t.Fatal(err)
+		}
+		// age the key past its TTL
+		s.mu.Lock()
+		record := s.records["old"]
+		record.CreatedAt = time.Now().Add(-idempotencyTTL - time.Minute)
+		s.records["old"] = record
+		s.mu.Unlock()
+
+		// an expired key is pruned whenever another key is finished or released
+		if _, err := s.Begin("new", "hash"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Finish("new", finish); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := persistedKeys(t, path)["old"]; ok {
+			t.Errorf("%s: the expired key is still persisted", name)
+		}
+
+		// and it can be used for a different request
+		if original, err := s.Begin("old", "other"); original != nil || err != nil {
+			t.Errorf("%s: expired key returned %v, %v", name, original, err)
+		}
+	}
+}
+
+func TestStartIdempotencyKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.json")
+	app := newTestStartApp(t, filepath.Join(t.TempDir(), "tasks.json"))
+	app.Idempotency = newTestIdempotencyStore(t, path)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/start", strings.NewReader(body))
+		r.Header.Set(idempotencyKeyHeader, "upload-1")
+		app.ManicCompressionHandler()(w, r)
+		return w
+	}
+
+	first := post(testStartBody)
+	replay := post(testStartBody)
+	if first.Code != http.StatusOK || replay.Code != http.StatusOK || first.Body.String() != replay.Body.String() {
+		t.Errorf("replay %d %s, first %d %s", replay.Code, replay.Body, first.Code, first.Body)
+	}
+	if replay.Header().Get(idempotentReplayedHeader) != "true" || first.Header().Get(idempotentReplayedHeader) != "" {
+		t.Error("the replay isn't marked")
+	}
+	if n := laneMessages(t, app); n != 2 {
+		t.Errorf("%d messages in the lane after a replay, want 2", n)
+	}
+
+	if w := post(strings.Replace(testStartBody, "a.wav", "c.wav", 1)); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reusing the key for another request returned %d", w.Code)
+	}
+}
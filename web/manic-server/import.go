@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	fileSystem "manic-compression/pkg/file_system"
+)
+
+type ImportRequest struct {
+	Directory   string   `json:"directory"` // relative to IMPORT_ROOT
+	Include     []string `json:"include"`
+	Exclude     []string `json:"exclude"`
+	Prefix      string   `json:"prefix"`
+	ClientID    string   `json:"clientID"`
+	Concurrency int      `json:"concurrency"`
+}
+
+// resolveImportDirectory confines a requested directory to IMPORT_ROOT
+func resolveImportDirectory(directory string) (string, error) {
+	if importRoot == "" {
+		return "", fmt.Errorf("server side imports are disabled, set IMPORT_ROOT to enable them")
+	}
+	root, err := filepath.Abs(importRoot)
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(root, filepath.FromSlash(directory))
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("directory %q is outside the import root", directory)
+	}
+	return resolved, nil
+}
+
+// ImportHandler starts a job importing a directory under IMPORT_ROOT into the container.
+// progress and per file failures are available from /jobs/{id}
+func (app *App) ImportHandler(fs *fileSystem.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Handling import request for %s", fs.ContainerName)
+
+		var req ImportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		directory, err := resolveImportDirectory(req.Directory)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		opts := fileSystem.ImportOptions{
+			Directory:   directory,
+			Include:     req.Include,
+			Exclude:     req.Exclude,
+			Prefix:      req.Prefix,
+			ClientID:    req.ClientID,
+			Concurrency: req.Concurrency,
+			// the same checks as an upload through /input or /output
+			AllowedFormats: app.AllowedFormats,
+		}
+		if err := opts.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		job := app.Jobs.Create("import", fs.ContainerName, false)
+
+		go func() {
+			report, err := fs.Import(context.Background(), opts, func(event fileSystem.ImportEvent) {
+				app.Jobs.Update(job.ID, func(j *Job) {
+					j.Total = event.Total
+					switch event.Status {
+					case fileSystem.ImportUploaded:
+						j.Succeeded++
+					case fileSystem.ImportSkipped:
+						j.Skipped++
+					case fileSystem.ImportFailed:
+						j.Failures = append(j.Failures, JobFailure{Name: event.Path, Error: event.Err.Error()})
+					default:
+						return
+					}
+					j.Processed++
+				})
+			})
+			if err == nil && len(report.Failures) > 0 {
+				err = fmt.Errorf("%d of %d files could not be imported", len(report.Failures), report.Total)
+			}
+			app.Jobs.Finish(job.ID, err)
+		}()
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	uuid "github.com/google/uuid"
+)
+
+// job status constants
+const (
+	JobRunning   = "Running"
+	JobCompleted = "Completed"
+	JobFailed    = "Failed"
+)
+
+type JobFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// Job tracks a long running storage operation so the client can poll its progress
+type Job struct {
+	ID         string       `json:"id"`
+	Kind       string       `json:"kind"`
+	Container  string       `json:"container"`
+	Status     string       `json:"status"`
+	DryRun     bool         `json:"dryRun"`
+	Total      int          `json:"total"`
+	Processed  int          `json:"processed"`
+	Succeeded  int          `json:"succeeded"`
+	Skipped    int          `json:"skipped"`
+	Failures   []JobFailure `json:"failures"`
+	Matched    []string     `json:"matched,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+}
+
+// jobRetention is how long a finished job stays available
+const jobRetention = time.Hour
+
+// JobStore keeps jobs in memory, finished jobs are dropped once they're older than the retention
+type JobStore struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	retention time.Duration
+}
+
+func NewJobStore(retention time.Duration) *JobStore {
+	return &JobStore{jobs: make(map[string]*Job), retention: retention}
+}
+
+// expireLocked drops finished jobs past the retention, s.mu must be held
+func (s *JobStore) expireLocked(now time.Time) {
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > s.retention {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// Create registers a new running job and returns a snapshot of it
+func (s *JobStore) Create(kind string, container string, dryRun bool) Job {
+	job := &Job{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Container: container,
+		Status:    JobRunning,
+		DryRun:    dryRun,
+		Failures:  []JobFailure{},
+		StartedAt: time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked(job.StartedAt)
+	s.jobs[job.ID] = job
+	return *job
+}
+
+// Update applies fn to the job while holding the store lock
+func (s *JobStore) Update(id string, fn func(job *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// Finish marks the job completed, or failed if err is not nil
+func (s *JobStore) Finish(id string, err error) {
+	s.Update(id, func(job *Job) {
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Status = JobCompleted
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+		}
+	})
+}
+
+func (s *JobStore) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked(time.Now())
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+func (s *JobStore) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked(time.Now())
+	jobs := []Job{}
+	for _, job := range s.jobs {
+		jobs = append(jobs, job.snapshot())
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.After(jobs[j].StartedAt) })
+	return jobs
+}
+
+// snapshot copies the job so it can be encoded without holding the lock
+func (job *Job) snapshot() Job {
+	cp := *job
+	cp.Failures = append([]JobFailure{}, job.Failures...)
+	if job.Matched != nil {
+		cp.Matched = append([]string{}, job.Matched...)
+	}
+	return cp
+}
+
+func (app *App) ListJobsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(app.Jobs.List())
+	}
+}
+
+func (app *App) GetJobHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		job, ok := app.Jobs.Get(id)
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobsExpireAfterRetention(t *testing.T) {
+	jobs := NewJobStore(time.Hour)
+	running := jobs.Create("delete", "input", false)
+	old := jobs.Create("delete", "input", false)
+	recent := jobs.Create("import", "input", false)
+	jobs.Finish(old.ID, nil)
+	jobs.Finish(recent.ID, nil)
+	jobs.Update(old.ID, func(job *Job) {
+		finishedAt := time.Now().Add(-2 * time.Hour)
+		job.FinishedAt = &finishedAt
+	})
+	jobs.Update(running.ID, func(job *Job) {
+		job.StartedAt = time.Now().Add(-2 * time.Hour)
+	})
+
+	if _, ok := jobs.Get(old.ID); ok {
+		t.Error("a job finished before the retention is still there")
+	}
+	for _, job := range []Job{running, recent} {
+		if _, ok := jobs.Get(job.ID); !ok {
+			t.Errorf("job %s expired", job.ID)
+		}
+	}
+	if n := len(jobs.List()); n != 2 {
+		t.Errorf("listed %d jobs, want 2", n)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+// started tasks wait in a queue per priority lane, the dispatcher forwards them to taskQueue,
+// which the functions consume, while fewer than maxInFlight tasks are in progress. the lanes are
+// session enabled queues with a session per client (see taskSession)
+var laneQueues = map[string]string{
+	audioTypes.PriorityHigh:   "audiotasks-high",
+	audioTypes.PriorityNormal: "audiotasks-normal",
+	audioTypes.PriorityLow:    "audiotasks-low",
+}
+
+// share of dispatches per lane when every lane has tasks waiting, low still gets one in seven
+var laneWeights = map[string]int{
+	audioTypes.PriorityHigh:   4,
+	audioTypes.PriorityNormal: 2,
+	audioTypes.PriorityLow:    1,
+}
+
+const (
+	laneWait     = time.Second     // how long a receive from a lane session waits for its message
+	dispatchIdle = 2 * time.Second // pause when nothing can be dispatched
+
+	anonymousSession = "anonymous" // session of tasks without a client ID
+)
+
+func laneQueue(task audioTypes.AudioTask) string {
+	return laneQueues[taskPriority(task)]
+}
+
+// LaneDispatcher moves tasks from the priority lanes to the task queue with smooth weighted
+// round robin, so high priority tasks overtake a backlog of low priority ones without starving it.
+// within a lane it rotates over the client sessions and skips clients that already have
+// maxPerSession tasks in progress, so one client's large request doesn't hold up the others
+type LaneDispatcher struct {
+	bus           serviceBus.Broker
+	tasks         *TaskStore
+	maxInFlight   int
+	maxPerSession int
+	current       map[string]int    // round robin credit per lane
+	lastSession   map[string]string // session dispatched last per lane
+}
+
+func NewLaneDispatcher(bus serviceBus.Broker, tasks *TaskStore, maxInFlight int, maxPerSession int) *LaneDispatcher {
+	return &LaneDispatcher{
+		bus:           bus,
+		tasks:         tasks,
+		maxInFlight:   maxInFlight,
+		maxPerSession: maxPerSession,
+		current:       map[string]int{},
+		lastSession:   map[string]string{},
+	}
+}
+
+// Run dispatches tasks until ctx is cancelled or the broker is closed
+func (d *LaneDispatcher) Run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		dispatched, err := d.dispatchNext(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, serviceBus.ErrClosed) {
+				return
+			}
+			log.Printf("could not dispatch tasks, retrying in %s: %v", backoff, err)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		} else {
+			backoff = time.Second
+			if dispatched {
+				continue
+			}
+		}
+
+		wait := dispatchIdle
+		if err != nil {
+			wait = backoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// dispatchNext forwards one task if the in flight limit allows it. the lane is picked among those
+// with a session that has tasks waiting and is below its cap; a session that turns out empty
+// (e.g. its scheduled messages aren't due yet) is skipped for this round
+func (d *LaneDispatcher) dispatchNext(ctx context.Context) (bool, error) {
+	total, bySession := d.tasks.InFlight()
+	if total >= d.maxInFlight {
+		return false, nil
+	}
+
+	ready := map[string][]string{}
+	depth := map[string]int{}
+	for lane, sessions := range d.tasks.Backlog() {
+		for session, waiting := range sessions {
+			if waiting > 0 && bySession[session] < d.maxPerSession {
+				ready[lane] = append(ready[lane], session)
+				depth[lane] += waiting
+			}
+		}
+	}
+
+	for {
+		lane := d.pick(depth)
+		if lane == "" {
+			return false, nil
+		}
+		delete(depth, lane)
+
+		for _, session := range rotate(ready[lane], d.lastSession[lane]) {
+			dispatched, err := d.forward(ctx, lane, session)
+			if err != nil {
+				return false, err
+			}
+			if dispatched {
+				d.lastSession[lane] = session
+				return true, nil
+			}
+		}
+	}
+}
+
+// rotate sorts the sessions and starts them after last, so every session gets its turn
+func rotate(sessions []string, last string) []string {
+	slices.Sort(sessions)
+	i, _ := slices.BinarySearch(sessions, last)
+	if i < len(sessions) && sessions[i] == last {
+		i++
+	}
+	return append(slices.Clone(sessions[i:]), sessions[:i]...)
+}
+
+// pick chooses the next lane by smooth weighted round robin over the lanes with waiting tasks
+func (d *LaneDispatcher) pick(depth map[string]int) string {
+	total := 0
+	best := ""
+	for _, lane := range audioTypes.Priorities {
+		if depth[lane] == 0 {
+			continue
+		}
+		d.current[lane] += laneWeights[lane]
+		total += laneWeights[lane]
+		if best == "" || d.current[lane] > d.current[best] {
+			best = lane
+		}
+	}
+	if best != "" {
+		d.current[best] -= total
+	}
+	return best
+}
+
+// forward moves one message of a session from a lane to the task queue, the lane message is only
+// completed once the task queue has accepted the copy
+func (d *LaneDispatcher) forward(ctx context.Context, lane string, session string) (bool, error) {
+	dispatched := false
+	err := d.bus.ReceiveSession(ctx, laneQueues[lane], session, 1, laneWait, func(delivery serviceBus.Delivery) error {
+		if delivery.Msg.Type != taskMessageType {
+			return serviceBus.DeadLetter("unexpected message type", fmt.Sprintf("expected %s, got %q", taskMessageType, delivery.Msg.Type))
+		}
+		var task audioTypes.AudioTask
+		if err := delivery.Msg.DecodePayload(&task); err != nil {
+			return serviceBus.DeadLetter("unparseable task", err.Error())
+		}
+
+		// the task queue isn't session enabled
+		msg := delivery.Msg
+		msg.SessionID = ""
+		if err := d.bus.SendMessage(msg, taskQueue); err != nil {
+			log.Printf("could not forward task %s from the %s lane: %v", task.TaskID, lane, err)
+			return err
+		}
+		dispatched = true
+		if err := d.tasks.Dispatched(task.TaskID); err != nil {
+			log.Printf("could not record dispatch of task %s: %v", task.TaskID, err)
+		}
+		return nil
+	})
+	return dispatched, err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+func newTestDispatcher(t *testing.T, maxInFlight int, maxPerSession int) *LaneDispatcher {
+	t.Helper()
+	tasks, err := NewTaskStore(filepath.Join(t.TempDir(), "tasks.json"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := serviceBus.NewMemoryBroker()
+	t.Cleanup(func() { bus.Close(context.Background()) })
+	return NewLaneDispatcher(bus, tasks, maxInFlight, maxPerSession)
+}
+
+// startTasks queues n tasks of a client in a lane, like /api/start
+func startTasks(t *testing.T, d *LaneDispatcher, clientID string, priority string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		task, msg := newAudioTask(clientID, fmt.Sprintf("%s-%d.wav", clientID, i), []string{audioTypes.AudioFunctionWAVToMp3}, priority, nil, "")
+		if err := d.bus.SendMessage(msg, laneQueue(task)); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.tasks.Record(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// dispatchAll dispatches until nothing more can be, and returns "<client>/<priority>" of each
+// task that reached the task queue, in order
+func dispatchAll(t *testing.T, d *LaneDispatcher) []string {
+	t.Helper()
+	for {
+		dispatched, err := d.dispatchNext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dispatched {
+			break
+		}
+	}
+
+	order := []string{}
+	err := d.bus.Receive(context.Background(), taskQueue, 1000, 0, func(delivery serviceBus.Delivery) error {
+		var task audioTypes.AudioTask
+		if err := delivery.Msg.DecodePayload(&task); err != nil {
+			return err
+		}
+		order = append(order, task.ClientID+"/"+task.Priority)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// countPrefix counts the items of the first n in order that start with prefix
+func countPrefix(order []string, prefix string, n int) int {
+	found := 0
+	for _, item := range order[:min(n, len(order))] {
+		if strings.HasPrefix(item, prefix) {
+			found++
+		}
+	}
+	return found
+}
+
+// a client with a large backlog in a lane takes turns with the others instead of going first
+func TestLaneSessionsTakeTurns(t *testing.T) {
+	d := newTestDispatcher(t, 100, 100)
+	startTasks(t, d, "big", audioTypes.PriorityNormal, 20)
+	startTasks(t, d, "small", audioTypes.PriorityNormal, 3)
+
+	order := dispatchAll(t, d)
+	if len(order) != 23 {
+		t.Fatalf("dispatched %d tasks, want 23", len(order))
+	}
+	if n := countPrefix(order, "small/", 6); n != 3 {
+		t.Errorf("small got %d of the first 6 dispatches, want 3: %v", n, order)
+	}
+}
+
+// a client at its in flight cap is skipped, so it can't block the lane for everyone else
+func TestLaneSessionCapLetsOthersThrough(t *testing.T) {
+	d := newTestDispatcher(t, 100, 2)
+	startTasks(t, d, "big", audioTypes.PriorityNormal, 20)
+	startTasks(t, d, "small", audioTypes.PriorityNormal, 2)
+
+	order := dispatchAll(t, d)
+	if countPrefix(order, "big/", len(order)) != 2 || countPrefix(order, "small/", len(order)) != 2 {
+		t.Errorf("dispatched %v, want 2 tasks of each client", order)
+	}
+	if total, bySession := d.tasks.InFlight(); total != 4 || bySession["big"] != 2 || bySession["small"] != 2 {
+		t.Errorf("in flight %d %v", total, bySession)
+	}
+}
+
+// the lanes share the dispatches 4:2:1, a backlog of high priority tasks doesn't starve the others
+func TestLaneWeightedRoundRobin(t *testing.T) {
+	d := newTestDispatcher(t, 100, 100)
+	startTasks(t, d, "a", audioTypes.PriorityHigh, 20)
+	startTasks(t, d, "b", audioTypes.PriorityNormal, 20)
+	startTasks(t, d, "c", audioTypes.PriorityLow, 20)
+
+	order := dispatchAll(t, d)
+	for _, lane := range []struct {
+		prefix string
+		want   int
+	}{{"a/high", 8}, {"b/normal", 4}, {"c/low", 2}} {
+		if n := countPrefix(order, lane.prefix, 14); n != lane.want {
+			t.Errorf("%s got %d of the first 14 dispatches, want %d: %v", lane.prefix, n, lane.want, order[:14])
+		}
+	}
+}
+
+// the in flight limit stops dispatching until results come in
+func TestLaneMaxInFlight(t *testing.T) {
+	d := newTestDispatcher(t, 3, 100)
+	startTasks(t, d, "a", audioTypes.PriorityNormal, 5)
+	if order := dispatchAll(t, d); len(order) != 3 {
+		t.Errorf("dispatched %d tasks, want 3", len(order))
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	serviceBus "manic-compression/pkg/service_bus"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultDeadLetterPeek = 100
+	defaultQueuePeek      = 50
+)
+
+// the queues the admin endpoints may touch
+var managedQueues = []string{
+	taskQueue,
+	taskResultsQueue,
+	laneQueues[audioTypes.PriorityHigh],
+	laneQueues[audioTypes.PriorityNormal],
+	laneQueues[audioTypes.PriorityLow],
+}
+
+// DeadLetterRequest selects dead lettered messages by sequence number, reason and/or age.
+// an empty selection is rejected unless all is set
+type DeadLetterRequest struct {
+	SequenceNumbers []int64 `json:"sequenceNumbers"`
+	Reason          string  `json:"reason"`
+	OlderThan       string  `json:"olderThan"` // e.g. 72h
+	All             bool    `json:"all"`
+}
+
+type DeadLetterResponse struct {
+	Queue           string  `json:"queue"`
+	SequenceNumbers []int64 `json:"sequenceNumbers"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// QueueStatsResponse is the stats of one queue, Error is set instead when they couldn't be read
+type QueueStatsResponse struct {
+	serviceBus.QueueStats
+	Error string `json:"error,omitempty"`
+}
+
+// PeekResponse is a page of messages, the next page is requested with
+// ?fromSequenceNumber=nextSequenceNumber. it is left out after the last page
+type PeekResponse struct {
+	Queue              string                     `json:"queue"`
+	Messages           []serviceBus.PeekedMessage `json:"messages"`
+	NextSequenceNumber int64                      `json:"nextSequenceNumber,omitempty"`
+}
+
+// managedQueue reads the {queue} url param, writing a 404 for queues the server doesn't use
+func managedQueue(w http.ResponseWriter, r *http.Request) (string, bool) {
+	queue := chi.URLParam(r, "queue")
+	if !slices.Contains(managedQueues, queue) {
+		http.Error(w, fmt.Sprintf("unknown queue %q", queue), http.StatusNotFound)
+		return "", false
+	}
+	return queue, true
+}
+
+// decodeDeadLetterFilter reads a DeadLetterRequest body, writing the error response on failure
+func decodeDeadLetterFilter(w http.ResponseWriter, r *http.Request) (serviceBus.DeadLetterFilter, bool) {
+	var req DeadLetterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request body: %v", err), http.StatusBadRequest)
+		return serviceBus.DeadLetterFilter{}, false
+	}
+
+	filter := serviceBus.DeadLetterFilter{SequenceNumbers: req.SequenceNumbers, Reason: req.Reason}
+	if req.OlderThan != "" {
+		olderThan, err := time.ParseDuration(req.OlderThan)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid olderThan: %v", err), http.StatusBadRequest)
+			return filter, false
+		}
+		filter.OlderThan = olderThan
+	}
+	if filter.IsZero() && !req.All {
+		http.Error(w, "select messages by sequenceNumbers, reason or olderThan, or set all", http.StatusBadRequest)
+		return filter, false
+	}
+	return filter, true
+}
+
+// QueueStatsHandler reports the message counts of every managed queue
+func (app *App) QueueStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Handling queue stats request")
+
+		response := []QueueStatsResponse{}
+		for _, queue := range managedQueues {
+			stats, err := app.Broker.QueueStats(queue)
+			if err != nil {
+				log.Printf("could not read stats of %s: %v", queue, err)
+				response = append(response, QueueStatsResponse{QueueStats: serviceBus.QueueStats{Queue: queue}, Error: err.Error()})
+				continue
+			}
+			response = append(response, QueueStatsResponse{QueueStats: stats})
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// GetQueueStatsHandler reports the message counts of one queue
+func (app *App) GetQueueStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue, ok := managedQueue(w, r)
+		if !ok {
+			return
+		}
+		log.Printf("Handling queue stats request for %s", queue)
+
+		stats, err := app.Broker.QueueStats(queue)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not read queue stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// PeekQueueHandler pages through the messages of a queue without receiving them. ?fromSequenceNumber=
+// is where the page starts, ?max= its size (default 50). the lane queues have sessions enabled and
+// are peeked one client at a time with ?sessionID= when they are on Service Bus
+func (app *App) PeekQueueHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue, ok := managedQueue(w, r)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		opts := serviceBus.PeekOptions{Max: defaultQueuePeek, SessionID: query.Get("sessionID")}
+		if value := query.Get("fromSequenceNumber"); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("invalid fromSequenceNumber %q", value), http.StatusBadRequest)
+				return
+			}
+			opts.FromSequenceNumber = n
+		}
+		if value := query.Get("max"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				http.Error(w, fmt.Sprintf("invalid max %q", value), http.StatusBadRequest)
+				return
+			}
+			opts.Max = n
+		}
+		log.Printf("Handling peek request for %s from %d", queue, opts.FromSequenceNumber)
+
+		messages, err := app.Broker.Peek(queue, opts)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not peek queue: %v", err), http.StatusInternalServerError)
+			return
+		}
+		response := PeekResponse{Queue: queue, Messages: messages}
+		// a full page may be followed by more messages
+		if len(messages) == opts.Max {
+			response.NextSequenceNumber = messages[len(messages)-1].SequenceNumber + 1
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// ListDeadLettersHandler peeks the dead letter queue, ?max= limits the number of messages (default 100)
+func (app *App) ListDeadLettersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue, ok := managedQueue(w, r)
+		if !ok {
+			return
+		}
+		log.Printf("Handling list dead letters request for %s", queue)
+
+		limit := defaultDeadLetterPeek
+		if value := r.URL.Query().Get("max"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				http.Error(w, fmt.Sprintf("invalid max %q", value), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		deadLetters, err := app.Broker.PeekDeadLetters(queue, limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not list dead letters: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(deadLetters)
+	}
+}
+
+// ResubmitDeadLettersHandler moves the selected dead lettered messages back onto the queue
+func (app *App) ResubmitDeadLettersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue, ok := managedQueue(w, r)
+		if !ok {
+			return
+		}
+		filter, ok := decodeDeadLetterFilter(w, r)
+		if !ok {
+			return
+		}
+		log.Printf("Handling resubmit dead letters request for %s", queue)
+
+		resubmitted, err := app.Broker.ResubmitDeadLetters(queue, filter)
+		writeDeadLetterResponse(w, queue, resubmitted, err)
+	}
+}
+
+// PurgeDeadLettersHandler deletes the selected dead lettered messages
+func (app *App) PurgeDeadLettersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue, ok := managedQueue(w, r)
+		if !ok {
+			return
+		}
+		filter, ok := decodeDeadLetterFilter(w, r)
+		if !ok {
+			return
+		}
+		log.Printf("Handling purge dead letters request for %s", queue)
+
+		purged, err := app.Broker.PurgeDeadLetters(queue, filter)
+		writeDeadLetterResponse(w, queue, purged, err)
+	}
+}
+
+// writeDeadLetterResponse reports the messages that were handled, which may be some even when err is set
+func writeDeadLetterResponse(w http.ResponseWriter, queue string, sequenceNumbers []int64, err error) {
+	response := DeadLetterResponse{Queue: queue, SequenceNumbers: sequenceNumbers}
+	if sequenceNumbers == nil {
+		response.SequenceNumbers = []int64{}
+	}
+	if err != nil {
+		log.Printf("dead letter operation on %s failed: %v", queue, err)
+		response.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(response)
+}
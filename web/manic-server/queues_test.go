@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	serviceBus "manic-compression/pkg/service_bus"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newTestQueueApp(t *testing.T) (*App, *serviceBus.MemoryBroker) {
+	t.Helper()
+	bus := serviceBus.NewMemoryBroker()
+	t.Cleanup(func() { bus.Close(context.Background()) })
+	app := &App{Router: chi.NewRouter(), Broker: bus}
+	app.InitializeRoutes()
+	return app, bus
+}
+
+func getJSON(t *testing.T, app *App, url string, v any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %v", url, err)
+		}
+	}
+	return w.Code
+}
+
+func sendTestMessages(t *testing.T, bus *serviceBus.MemoryBroker, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		msg, _ := serviceBus.NewMsg(taskMessageType, map[string]int{"n": i})
+		msg.MessageID = fmt.Sprintf("m%d", i)
+		if err := bus.SendMessage(msg, taskQueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueueStatsEndpoints(t *testing.T) {
+	app, bus := newTestQueueApp(t)
+	sendTestMessages(t, bus, 3)
+	for i := 0; i < 2; i++ {
+		msg, _ := serviceBus.NewMsg(taskMessageType, map[string]int{"scheduled": i})
+		if err := bus.SendMessageAt(msg, taskQueue, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := bus.Receive(context.Background(), taskQueue, 1, 0, func(serviceBus.Delivery) error {
+		return serviceBus.DeadLetter("test", "dead lettered by the test")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, stats serviceBus.QueueStats, active, scheduled, deadLetters int32) {
+		t.Helper()
+		if stats.ActiveMessages != active || stats.ScheduledMessages != scheduled || stats.DeadLetterMessages != deadLetters {
+			t.Errorf("%s: %d active, %d scheduled, %d dead lettered, want %d, %d, %d",
+				name, stats.ActiveMessages, stats.ScheduledMessages, stats.DeadLetterMessages, active, scheduled, deadLetters)
+		}
+	}
+
+	var all []QueueStatsResponse
+	if code := getJSON(t, app, "/admin/queues/", &all); code != http.StatusOK || len(all) != len(managedQueues) {
+		t.Fatalf("status %d, stats of %d queues", code, len(all))
+	}
+	for _, stats := range all {
+		if stats.Queue == taskQueue {
+			check(stats.Queue, stats.QueueStats, 2, 2, 1)
+		} else {
+			check(stats.Queue, stats.QueueStats, 0, 0, 0)
+		}
+		if stats.Error != "" {
+			t.Errorf("%s: %s", stats.Queue, stats.Error)
+		}
+	}
+
+	var one serviceBus.QueueStats
+	if code := getJSON(t, app, "/admin/queues/"+taskQueue, &one); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	check("single queue", one, 2, 2, 1)
+	if code := getJSON(t, app, "/admin/queues/unknown", &one); code != http.StatusNotFound {
+		t.Errorf("stats of an unknown queue returned %d", code)
+	}
+
+	// a queue whose stats can't be read is reported without failing the others
+	bus.Close(context.Background())
+	if code := getJSON(t, app, "/admin/queues/", &all); code != http.StatusOK || len(all) != len(managedQueues) || all[0].Error == "" {
+		t.Errorf("status %d with a closed broker: %+v", code, all)
+	}
+}
+
+func TestPeekQueueEndpoint(t *testing.T) {
+	app, bus := newTestQueueApp(t)
+	sendTestMessages(t, bus, 5)
+
+	peeked := ""
+	url := "/admin/queues/" + taskQueue + "/messages?max=2"
+	for pages := 0; pages < 10; pages++ {
+		var page PeekResponse
+		if code := getJSON(t, app, url, &page); code != http.StatusOK {
+			t.Fatalf("%s: status %d", url, code)
+		}
+		for _, message := range page.Messages {
+			peeked += message.MessageID + " "
+		}
+		if page.NextSequenceNumber == 0 {
+			break
+		}
+		url = fmt.Sprintf("/admin/queues/%s/messages?max=2&fromSequenceNumber=%d", taskQueue, page.NextSequenceNumber)
+	}
+	if peeked != "m0 m1 m2 m3 m4 " {
+		t.Errorf("peeked %q", peeked)
+	}
+
+	// peeking doesn't receive anything
+	stats, err := bus.QueueStats(taskQueue)
+	if err != nil || stats.ActiveMessages != 5 {
+		t.Errorf("%d messages left after peeking, %v", stats.ActiveMessages, err)
+	}
+
+	// a full last page is followed by an empty one
+	var page PeekResponse
+	getJSON(t, app, "/admin/queues/"+taskQueue+"/messages?max=5", &page)
+	if len(page.Messages) != 5 || page.NextSequenceNumber != page.Messages[4].SequenceNumber+1 {
+		t.Fatalf("full page of %d messages, next %d", len(page.Messages), page.NextSequenceNumber)
+	}
+	var last PeekResponse
+	getJSON(t, app, fmt.Sprintf("/admin/queues/%s/messages?fromSequenceNumber=%d", taskQueue, page.NextSequenceNumber), &last)
+	if len(last.Messages) != 0 || last.NextSequenceNumber != 0 {
+		t.Errorf("page after the last message has %d messages, next %d", len(last.Messages), last.NextSequenceNumber)
+	}
+
+	for _, query := range []string{"max=0", "max=x", "fromSequenceNumber=-1", "fromSequenceNumber=x"} {
+		if code := getJSON(t, app, "/admin/queues/"+taskQueue+"/messages?"+query, &page); code != http.StatusBadRequest {
+			t.Errorf("%s returned %d", query, code)
+		}
+	}
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	audioTypes "manic-compression/pkg/audio_types"
 	fileSystem "manic-compression/pkg/file_system"
@@ -28,26 +38,69 @@ func getEnvOrDefault(key, defaultValue string) string {
 const (
 	taskQueue        = "audiotasks"
 	taskResultsQueue = "audiotaskresults"
+
+	enqueueRetryAfter = "5" // seconds, sent with a 503 when the task queue is unreachable
 )
 
 var (
-	connectionString = os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
-	inputContainer   = getEnvOrDefault("INPUT_CONTAINER_NAME", "audio-input")
-	outputContainer  = getEnvOrDefault("OUTPUT_CONTAINER_NAME", "audio-output")
+	inputContainer  = getEnvOrDefault("INPUT_CONTAINER_NAME", "audio-input")
+	outputContainer = getEnvOrDefault("OUTPUT_CONTAINER_NAME", "audio-output")
+	keyFile         = os.Getenv("MANIC_KEYFILE")   // optional, enables encryption at rest
+	cacheDir        = os.Getenv("MANIC_CACHE_DIR") // optional, enables the download cache
+	cacheMaxMB      = getEnvOrDefault("MANIC_CACHE_MAX_MB", "1024")
+	allowedFormats  = getEnvOrDefault("ALLOWED_AUDIO_FORMATS", strings.Join(audioTypes.AllFormats, ","))
+	watchStateFile  = getEnvOrDefault("WATCH_STATE_FILE", "watch-rules.json")
+	taskStateFile   = getEnvOrDefault("TASK_STATE_FILE", "tasks.json")
+	idempotencyFile = getEnvOrDefault("IDEMPOTENCY_STATE_FILE", "idempotency.json")
+	watchInterval   = getEnvOrDefault("WATCH_INTERVAL", "30s")
+	trashRetention  = getEnvOrDefault("TRASH_RETENTION", "168h") // 0 deletes immediately
+	usageRefresh    = getEnvOrDefault("USAGE_REFRESH_INTERVAL", "10m")
+	importRoot      = os.Getenv("IMPORT_ROOT") // directory server side imports are confined to, unset disables them
+	maxInFlight     = getEnvOrDefault("MAX_IN_FLIGHT_TASKS", "16")
+	maxPerClient    = getEnvOrDefault("MAX_IN_FLIGHT_PER_CLIENT", "4")
+	taskLease       = getEnvOrDefault("TASK_LEASE", "30m") // how long an attempt of a task may take before it is retried
 )
 
 type App struct {
 	Router           *chi.Mux
 	InputFileSystem  *fileSystem.FileSystem
 	OutputFileSystem *fileSystem.FileSystem
-	ServiceBus       *serviceBus.ServiceBus
+	Broker           serviceBus.Broker
+	Jobs             *JobStore
+	Tasks            *TaskStore
+	Idempotency      *IdempotencyStore
+	Watcher          *Watcher
+	Usage            *UsageReporter
+	Dispatcher       *LaneDispatcher
+	AllowedFormats   []string
 }
 
 // start request specifies all the files to be processed and the audio functions to be applied to each file
 type StartRequest struct {
-	InputFiles            []string `json:"inputFiles"`
-	ClientID              string   `json:"clientID"`
-	AudioFunctionPipeline []string `json:"audioFunctionPipeline"`
+	InputFiles            []string   `json:"inputFiles"`
+	ClientID              string     `json:"clientID"`
+	AudioFunctionPipeline []string   `json:"audioFunctionPipeline"`
+	ScheduledAt           *time.Time `json:"scheduledAt"` // optional RFC 3339 time to start the tasks at
+	Priority              string     `json:"priority"`    // high, normal (the default) or low
+}
+
+type TaskFailure struct {
+	InputFile string `json:"inputFile"`
+	Error     string `json:"error"`
+}
+
+// StartResponse lists the tasks that were enqueued, inputs whose task could not be enqueued are in failed
+type StartResponse struct {
+	Tasks  []audioTypes.AudioTask `json:"tasks"`
+	Failed []TaskFailure          `json:"failed,omitempty"`
+}
+
+// ActiveTasksResponse is returned by /activeTasks?lanes=true, Lanes has the tasks waiting per priority lane
+type ActiveTasksResponse struct {
+	Tasks       map[string]audioTypes.AudioTask `json:"tasks"`
+	Lanes       map[string]int                  `json:"lanes"`
+	InFlight    int                             `json:"inFlight"`
+	MaxInFlight int                             `json:"maxInFlight"`
 }
 
 type TaskStatusRequest struct {
@@ -56,27 +109,121 @@ type TaskStatusRequest struct {
 
 func main() {
 
-	serviceClient := fileSystem.CreateServiceClient(connectionString)
+	backend, err := fileSystem.NewBackendFromEnv()
+	if err != nil {
+		log.Fatalf("could not create storage backend: %v", err)
+	}
+
+	bus, err := serviceBus.NewBrokerFromEnv()
+	if err != nil {
+		log.Fatalf("could not create message broker: %v", err)
+	}
 
 	app := &App{
 		Router: chi.NewRouter(),
 		InputFileSystem: &fileSystem.FileSystem{
 			ContainerName: inputContainer,
-			ServiceClient: serviceClient,
+			Backend:       backend,
 		},
 		OutputFileSystem: &fileSystem.FileSystem{
 			ContainerName: outputContainer,
-			ServiceClient: serviceClient,
+			Backend:       backend,
 		},
-		ServiceBus: serviceBus.NewServiceBus(),
+		Broker: bus,
+		Jobs:   NewJobStore(jobRetention),
+	}
+
+	formats, err := audioTypes.ParseFormats(allowedFormats)
+	if err != nil {
+		log.Fatalf("invalid ALLOWED_AUDIO_FORMATS: %v", err)
 	}
+	app.AllowedFormats = formats
+
+	// encrypt stored audio with per-client keys when a keyfile is configured
+	if keyFile != "" {
+		keyRing, err := fileSystem.LoadKeyRing(keyFile)
+		if err != nil {
+			log.Fatalf("could not load keyfile: %v", err)
+		}
+		app.InputFileSystem.KeyRing = keyRing
+		app.OutputFileSystem.KeyRing = keyRing
+	}
+
+	// share one download cache between both containers, keys include the container name
+	if cacheDir != "" {
+		maxMB, err := strconv.ParseInt(cacheMaxMB, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid MANIC_CACHE_MAX_MB: %v", err)
+		}
+		cache, err := fileSystem.NewDiskCache(cacheDir, maxMB<<20)
+		if err != nil {
+			log.Fatalf("could not create download cache: %v", err)
+		}
+		app.InputFileSystem.Cache = cache
+		app.OutputFileSystem.Cache = cache
+	}
+
+	// deletes go to the trash for the retention window, expired trash is purged hourly
+	retention, err := time.ParseDuration(trashRetention)
+	if err != nil {
+		log.Fatalf("invalid TRASH_RETENTION: %v", err)
+	}
+	app.InputFileSystem.TrashRetention = retention
+	app.OutputFileSystem.TrashRetention = retention
+	if retention > 0 {
+		go app.purgeExpiredTrash(context.Background(), time.Hour)
+	}
+
+	// rebuild the storage usage report in the background
+	usageInterval, err := time.ParseDuration(usageRefresh)
+	if err != nil {
+		log.Fatalf("invalid USAGE_REFRESH_INTERVAL: %v", err)
+	}
+	app.Usage = NewUsageReporter(app.InputFileSystem, app.OutputFileSystem)
+	go app.Usage.Run(context.Background(), usageInterval)
+
+	// poll the input container for watch rule ("hot folder") arrivals
+	interval, err := time.ParseDuration(watchInterval)
+	if err != nil {
+		log.Fatalf("invalid WATCH_INTERVAL: %v", err)
+	}
+	lease, err := time.ParseDuration(taskLease)
+	if err != nil || lease <= 0 {
+		log.Fatalf("invalid TASK_LEASE %q, expected a positive duration", taskLease)
+	}
+	app.Tasks, err = NewTaskStore(taskStateFile, lease)
+	if err != nil {
+		log.Fatalf("could not load task state: %v", err)
+	}
+	app.Idempotency, err = NewIdempotencyStore(idempotencyFile)
+	if err != nil {
+		log.Fatalf("could not load idempotency keys: %v", err)
+	}
+
+	// like /start the task is recorded before its message is sent
+	app.Watcher, err = NewWatcher(watchStateFile, app.InputFileSystem, func(task audioTypes.AudioTask, msg serviceBus.Msg) error {
+		if err := app.Tasks.Record(task); err != nil {
+			return fmt.Errorf("could not record task %s: %w", task.TaskID, err)
+		}
+		if err := app.Broker.SendMessage(msg, laneQueue(task)); err != nil {
+			if err := app.Tasks.Remove(task.TaskID); err != nil {
+				log.Printf("could not remove unsent task %s: %v", task.TaskID, err)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("could not load watch rules: %v", err)
+	}
+	go app.Watcher.Run(context.Background(), interval)
 
 	// Initialize CORS middleware with desired options
 	corsMiddleware := cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", idempotencyKeyHeader},
+		ExposedHeaders:   []string{"Link", idempotentReplayedHeader},
 		AllowCredentials: false,
 		MaxAge:           300,
 	})
@@ -94,10 +241,50 @@ func main() {
 	apiRouter := chi.NewRouter()
 	apiRouter.Mount("/api", app.Router)
 
-	// start API server
+	// start API server, on SIGINT/SIGTERM stop taking requests and close the broker
 	log.Println("Starting server on port :8080...")
 	http.Handle("/", apiRouter)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server := &http.Server{Addr: ":8080"}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// apply results from the functions to the task state, and retry the tasks that never get one
+	go app.consumeResults(ctx)
+	go app.reapExpiredTasks(ctx, reapInterval)
+
+	// feed the functions from the priority lanes
+	inFlight, err := strconv.Atoi(maxInFlight)
+	if err != nil || inFlight < 1 {
+		log.Fatalf("invalid MAX_IN_FLIGHT_TASKS %q, expected a positive number", maxInFlight)
+	}
+	perClient, err := strconv.Atoi(maxPerClient)
+	if err != nil || perClient < 1 {
+		log.Fatalf("invalid MAX_IN_FLIGHT_PER_CLIENT %q, expected a positive number", maxPerClient)
+	}
+	app.Dispatcher = NewLaneDispatcher(app.Broker, app.Tasks, inFlight, perClient)
+	go app.Dispatcher.Run(ctx)
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		log.Println("Shutting down server...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-drained // in flight requests may still be using the broker
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := app.Broker.Close(closeCtx); err != nil {
+		log.Printf("could not close message broker: %v", err)
+	}
 }
 
 func (app *App) initializeFiles() {
@@ -121,6 +308,11 @@ func (app *App) InitializeRoutes() {
 		r.Get("/", app.GetActiveTasksHandler())
 	})
 
+	app.Router.Route("/scheduledTasks", func(r chi.Router) {
+		r.Get("/", app.GetScheduledTasksHandler())
+		r.Delete("/{id}", app.CancelScheduledTaskHandler())
+	})
+
 	app.Router.Route("/completedTasks", func(r chi.Router) {
 		r.Get("/", app.GetCompletedTasksHandler())
 	})
@@ -137,20 +329,58 @@ func (app *App) InitializeRoutes() {
 		r.Get("/", GetAudioFunctions())
 	})
 
+	app.Router.Route("/cache", func(r chi.Router) {
+		r.Get("/", app.GetCacheStatsHandler())
+	})
+
+	app.Router.Route("/watch", func(r chi.Router) {
+		r.Get("/", app.ListWatchRulesHandler())
+		r.Post("/", app.CreateWatchRuleHandler())
+		r.Delete("/{id}", app.DeleteWatchRuleHandler())
+	})
+
+	app.Router.Route("/storage", func(r chi.Router) {
+		r.Get("/usage", app.StorageUsageHandler())
+	})
+
+	app.Router.Route("/trash", func(r chi.Router) {
+		r.Get("/", app.ListTrashHandler())
+		r.Post("/restore", app.RestoreTrashHandler())
+		r.Post("/purge", app.PurgeTrashHandler())
+	})
+
+	app.Router.Route("/admin/queues", func(r chi.Router) {
+		r.Get("/", app.QueueStatsHandler())
+		r.Get("/{queue}", app.GetQueueStatsHandler())
+		r.Get("/{queue}/messages", app.PeekQueueHandler())
+		r.Route("/{queue}/deadletter", func(r chi.Router) {
+			r.Get("/", app.ListDeadLettersHandler())
+			r.Post("/resubmit", app.ResubmitDeadLettersHandler())
+			r.Post("/purge", app.PurgeDeadLettersHandler())
+		})
+	})
+
+	app.Router.Route("/jobs", func(r chi.Router) {
+		r.Get("/", app.ListJobsHandler())
+		r.Get("/{id}", app.GetJobHandler())
+	})
+
 	app.Router.Route("/input", func(r chi.Router) {
 		r.Get("/", ListFilesHandler(app.InputFileSystem))
 		r.Get("/{name}", DownloadFileHandler(app.InputFileSystem))
-		r.Post("/", UploadFileHandler(app.InputFileSystem))
+		r.Post("/", app.UploadFileHandler(app.InputFileSystem))
+		r.Post("/import", app.ImportHandler(app.InputFileSystem))
 		r.Delete("/{name}", DeleteFileHandler(app.InputFileSystem))
-		r.Delete("/", ClearContainerHandler(app.InputFileSystem))
+		r.Delete("/", app.ClearContainerHandler(app.InputFileSystem))
 	})
 
 	app.Router.Route("/output", func(r chi.Router) {
 		r.Get("/", ListFilesHandler(app.OutputFileSystem))
 		r.Get("/{name}", DownloadFileHandler(app.OutputFileSystem))
-		r.Post("/", UploadFileHandler(app.OutputFileSystem))
+		r.Post("/", app.UploadFileHandler(app.OutputFileSystem))
+		r.Post("/import", app.ImportHandler(app.OutputFileSystem))
 		r.Delete("/{name}", DeleteFileHandler(app.OutputFileSystem))
-		r.Delete("/", ClearContainerHandler(app.OutputFileSystem))
+		r.Delete("/", app.ClearContainerHandler(app.OutputFileSystem))
 	})
 }
 
@@ -165,72 +395,265 @@ func (app *App) ManicCompressionHandler() http.HandlerFunc {
 			return
 		}
 
+		// a request repeated with the same Idempotency-Key gets the response of the first one.
+		// the key is released again when no task was enqueued, so the request can be retried
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key != "" {
+			if err := validIdempotencyKey(key); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			original, err := app.Idempotency.Begin(key, startRequestHash(req))
+			if errors.Is(err, errIdempotencyInProgress) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if errors.Is(err, errIdempotencyMismatch) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if original != nil {
+				log.Printf("replaying start request with idempotency key %s", key)
+				w.Header().Set(idempotentReplayedHeader, "true")
+				json.NewEncoder(w).Encode(original)
+				return
+			}
+		}
+		finish := func(response *StartResponse) {
+			if key == "" {
+				return
+			}
+			if err := app.Idempotency.Finish(key, response); err != nil {
+				log.Printf("could not store response for idempotency key %s: %v", key, err)
+			}
+		}
+
+		if req.ScheduledAt != nil && !req.ScheduledAt.After(time.Now()) {
+			finish(nil)
+			http.Error(w, "scheduledAt must be in the future", http.StatusBadRequest)
+			return
+		}
+		priority, err := audioTypes.ParsePriority(req.Priority)
+		if err != nil {
+			finish(nil)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		messages := []serviceBus.Msg{}
 		tasks := []audioTypes.AudioTask{}
 
-		for _, inputFile := range req.InputFiles {
-			taskID := uuid.New().String()
-			task := audioTypes.AudioTask{
-				ClientID:              req.ClientID,
-				TaskID:                taskID,
-				Status:                serviceBus.TaskInProgress,
-				InputFile:             inputFile,
-				AudioFunctionPipeline: req.AudioFunctionPipeline,
-			}
-			msg := serviceBus.Msg{
-				Type:    "processAudio",
-				Content: task.Serialize(),
+		for i, inputFile := range req.InputFiles {
+			task, msg := newAudioTask(req.ClientID, inputFile, req.AudioFunctionPipeline, priority, req.ScheduledAt, key)
+			if key != "" {
+				// lets the broker's duplicate detection drop a resend of the same task
+				msg.MessageID = fmt.Sprintf("%s:%d", key, i)
 			}
 			messages = append(messages, msg)
 			tasks = append(tasks, task)
 		}
 
-		app.ServiceBus.SendMessageBatch(messages, taskQueue)
+		// the tasks are recorded before their messages are sent, so the dispatcher never takes a
+		// message of a task it doesn't know yet. nothing has been sent if they can't be recorded
+		if err := app.Tasks.Record(tasks...); err != nil {
+			finish(nil)
+			http.Error(w, fmt.Sprintf("could not record tasks: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// large requests are split over several batches, so only report the tasks that were enqueued.
+		// scheduled tasks use scheduled messages, which stay invisible to the dispatcher until then
+		var sendErrs []error
+		var sequenceNumbers []int64
+		lane := laneQueues[priority]
+		if req.ScheduledAt != nil {
+			sequenceNumbers, sendErrs, err = app.Broker.ScheduleMessages(messages, lane, *req.ScheduledAt)
+		} else {
+			sendErrs, err = app.Broker.SendMessageBatch(messages, lane)
+		}
+		response := StartResponse{Tasks: []audioTypes.AudioTask{}}
+		unsent := []string{}
+		scheduled := map[string]int64{}
+		for i, task := range tasks {
+			if sendErrs[i] != nil {
+				response.Failed = append(response.Failed, TaskFailure{InputFile: task.InputFile, Error: sendErrs[i].Error()})
+				unsent = append(unsent, task.TaskID)
+				continue
+			}
+			if sequenceNumbers != nil {
+				task.ScheduledSequence = sequenceNumbers[i]
+				scheduled[task.TaskID] = task.ScheduledSequence
+			}
+			response.Tasks = append(response.Tasks, task)
+		}
+
+		// the store is already updated in memory when these fail, only persisting it did
+		if len(unsent) > 0 {
+			if err := app.Tasks.Remove(unsent...); err != nil {
+				log.Printf("could not remove unsent tasks: %v", err)
+			}
+		}
+		if len(scheduled) > 0 {
+			if err := app.Tasks.Scheduled(scheduled); err != nil {
+				log.Printf("could not record scheduled tasks: %v", err)
+			}
+		}
+
+		if err != nil {
+			log.Printf("could not enqueue tasks: %v", err)
+			if len(response.Tasks) == 0 {
+				finish(nil)
+				if serviceBus.IsRetryable(err) {
+					w.Header().Set("Retry-After", enqueueRetryAfter)
+					http.Error(w, fmt.Sprintf("task queue is unavailable, try again later: %v", err), http.StatusServiceUnavailable)
+					return
+				}
+				http.Error(w, fmt.Sprintf("could not enqueue tasks: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		finish(&response)
 
 		// return task IDs to client so they can poll for results
-		json.NewEncoder(w).Encode(map[string][]audioTypes.AudioTask{"tasks": tasks})
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
+// newAudioTask creates a queued task for one input file along with the message that starts it,
+// the message goes to the lane of the priority in the client's session. a task with scheduledAt
+// is Scheduled instead, idempotencyKey is the key of the start request, if any
+func newAudioTask(clientID string, inputFile string, audioFunctionPipeline []string, priority string, scheduledAt *time.Time, idempotencyKey string) (audioTypes.AudioTask, serviceBus.Msg) {
+	task := audioTypes.AudioTask{
+		ClientID:              clientID,
+		TaskID:                uuid.New().String(),
+		Status:                serviceBus.TaskQueued,
+		DeliveryCount:         1,
+		InputFile:             inputFile,
+		AudioFunctionPipeline: audioFunctionPipeline,
+		Priority:              priority,
+		IdempotencyKey:        idempotencyKey,
+	}
+	if scheduledAt != nil {
+		task.Status = serviceBus.TaskScheduled
+		task.ScheduledAt = scheduledAt
+	}
+	return task, taskMessage(task)
+}
+
+// taskMessage is the message that starts a task, every message about the task is correlated by its ID
+func taskMessage(task audioTypes.AudioTask) serviceBus.Msg {
+	// Serialize maps the pipeline to activity names, so the payload is passed on as is
+	msg, _ := serviceBus.NewMsg(taskMessageType, json.RawMessage(task.Serialize()))
+	msg.CorrelationID = task.TaskID
+	msg.SessionID = taskSession(task)
+	return msg
+}
+
+// GetActiveTasksHandler lists queued and in progress tasks, with ?lanes=true they're wrapped in an
+// ActiveTasksResponse that also reports the depth of each priority lane
 func (app *App) GetActiveTasksHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Handling active tasks request")
-		activeTasks, err := app.ServiceBus.PeekQueue(taskQueue)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("could not get active tasks: %v", err), http.StatusInternalServerError)
+		tasks := app.Tasks.List(tasksActive)
+		if r.URL.Query().Get("lanes") != "true" {
+			json.NewEncoder(w).Encode(tasks)
 			return
 		}
-		json.NewEncoder(w).Encode(activeTasks)
+		inFlight, _ := app.Tasks.InFlight()
+		json.NewEncoder(w).Encode(ActiveTasksResponse{
+			Tasks:       tasks,
+			Lanes:       app.Tasks.LaneDepth(),
+			InFlight:    inFlight,
+			MaxInFlight: app.Dispatcher.maxInFlight,
+		})
 	}
 }
 
-func (app *App) GetCompletedTasksHandler() http.HandlerFunc {
+// GetScheduledTasksHandler lists tasks that are waiting for their scheduledAt time
+func (app *App) GetScheduledTasksHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Handling completed tasks request")
-		completedTasks, err := app.ServiceBus.PeekQueue(taskResultsQueue)
+		log.Println("Handling scheduled tasks request")
+		json.NewEncoder(w).Encode(app.Tasks.List(tasksScheduled))
+	}
+}
+
+// CancelScheduledTaskHandler cancels a scheduled task that hasn't started yet
+func (app *App) CancelScheduledTaskHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		log.Printf("Handling cancel scheduled task request for %s", id)
+
+		task, err := app.Tasks.Cancel(id, func(task audioTypes.AudioTask) error {
+			return app.Broker.CancelScheduledMessages(laneQueue(task), []int64{task.ScheduledSequence})
+		})
+		if errors.Is(err, errTaskNotFound) {
+			http.Error(w, fmt.Sprintf("could not cancel %s: %v", id, err), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errNotScheduled) {
+			http.Error(w, fmt.Sprintf("could not cancel %s: %v", id, err), http.StatusConflict)
+			return
+		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf("could not get active tasks: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("could not cancel %s: %v", id, err), http.StatusInternalServerError)
 			return
 		}
-		json.NewEncoder(w).Encode(completedTasks)
+		json.NewEncoder(w).Encode(task)
+	}
+}
+
+// GetCompletedTasksHandler lists finished tasks, results are applied by the results queue consumer
+func (app *App) GetCompletedTasksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Handling completed tasks request")
+		json.NewEncoder(w).Encode(app.Tasks.List(tasksFinished))
 	}
 }
 
+// ClearActiveTasks drops the queued tasks, in the lanes and the task queue, and forgets every task still in progress
 func (app *App) ClearActiveTasks() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Handling clear active tasks request")
-		app.ServiceBus.ClearQueue(taskQueue)
+		for _, priority := range audioTypes.Priorities {
+			if err := app.Broker.ClearQueue(laneQueues[priority]); err != nil {
+				http.Error(w, fmt.Sprintf("could not clear %s: %v", laneQueues[priority], err), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := app.Broker.ClearQueue(taskQueue); err != nil {
+			http.Error(w, fmt.Sprintf("could not clear %s: %v", taskQueue, err), http.StatusInternalServerError)
+			return
+		}
+		if err := app.Tasks.Clear(tasksActive); err != nil {
+			http.Error(w, fmt.Sprintf("could not clear active tasks: %v", err), http.StatusInternalServerError)
+			return
+		}
 		msg := fmt.Sprintf("%s cleared successfully", taskQueue)
 		json.NewEncoder(w).Encode(msg)
 	}
 }
 
+// ClearCompletedTasks forgets finished tasks. the results queue is left alone so results that
+// haven't been applied yet aren't lost
 func (app *App) ClearCompletedTasks() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Handling clear task results request")
-		app.ServiceBus.ClearQueue(taskResultsQueue)
-		msg := fmt.Sprintf("%s cleared successfully", taskResultsQueue)
-		json.NewEncoder(w).Encode(msg)
+		if err := app.Tasks.Clear(tasksFinished); err != nil {
+			http.Error(w, fmt.Sprintf("could not clear completed tasks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode("completed tasks cleared successfully")
+	}
+}
+
+func (app *App) GetCacheStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.InputFileSystem.Cache == nil {
+			http.Error(w, "download cache is not enabled", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(app.InputFileSystem.Cache.Stats())
 	}
 }
 
@@ -261,7 +684,23 @@ func DownloadFileHandler(fs *fileSystem.FileSystem) http.HandlerFunc {
 	}
 }
 
-func UploadFileHandler(fs *fileSystem.FileSystem) http.HandlerFunc {
+type UploadRejection struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+type UploadResponse struct {
+	Uploaded []string          `json:"uploaded"` // final blob names
+	Renamed  map[string]string `json:"renamed,omitempty"`
+	Rejected []UploadRejection `json:"rejected"`
+}
+
+// UploadFileHandler stores every uploaded file that sniffs as an allowed audio format under a
+// sanitized name. files that fail validation are reported individually, the request only fails
+// as a whole (422, or 409 if every file clashed with an existing blob) when nothing could be uploaded.
+// onConflict=overwrite|rename|reject picks what happens to names that are already taken, renamed
+// files are listed under their final name with the mapping in renamed
+func (app *App) UploadFileHandler(fs *fileSystem.FileSystem) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		log.Println("Handling file upload request")
@@ -274,43 +713,170 @@ func UploadFileHandler(fs *fileSystem.FileSystem) http.HandlerFunc {
 
 		// gt files from form data
 		files := r.MultipartForm.File["files"]
-		if files == nil {
+		if len(files) == 0 {
 			http.Error(w, "no files provided", http.StatusBadRequest)
 			return
 		}
 
-		filesUploaded := []string{}
+		// optional client the uploaded files belong to, selects the encryption key
+		clientID := r.FormValue("clientID")
+
+		policy, err := fileSystem.ParseConflictPolicy(r.FormValue("onConflict"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response := UploadResponse{Uploaded: []string{}, Renamed: map[string]string{}, Rejected: []UploadRejection{}}
+		conflicts := 0
+		reject := func(name string, err error) {
+			if errors.Is(err, fileSystem.ErrUploadConflict) {
+				conflicts++
+			}
+			response.Rejected = append(response.Rejected, UploadRejection{Name: name, Error: err.Error()})
+		}
 
 		for _, fileHeader := range files {
+			name, err := fileSystem.SanitizeFileName(fileHeader.Filename)
+			if err != nil {
+				reject(fileHeader.Filename, err)
+				continue
+			}
+
 			file, err := fileHeader.Open()
 			if err != nil {
 				http.Error(w, fmt.Sprintf("could not open file: %v", err), http.StatusInternalServerError)
 				return
 			}
-			defer file.Close()
+			stored, err := app.storeUpload(r.Context(), fs, file, name, clientID, policy)
+			file.Close()
+			if err != nil {
+				reject(fileHeader.Filename, err)
+				continue
+			}
+			if stored != name {
+				response.Renamed[name] = stored
+			}
+			response.Uploaded = append(response.Uploaded, stored)
+		}
 
-			fs.UploadFile(file, fileHeader.Filename)
-			filesUploaded = append(filesUploaded, fileHeader.Filename)
+		if len(response.Uploaded) == 0 {
+			status := http.StatusUnprocessableEntity
+			if conflicts == len(response.Rejected) {
+				status = http.StatusConflict
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
 		}
-		json.NewEncoder(w).Encode(filesUploaded)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// storeUpload checks the magic bytes of an uploaded file against the allowed formats and uploads it,
+// returning the name it was stored under. the header is read in place, so the file is uploaded as is
+func (app *App) storeUpload(ctx context.Context, fs *fileSystem.FileSystem, file multipart.File, name string, clientID string, policy fileSystem.ConflictPolicy) (string, error) {
+	header := make([]byte, audioTypes.SniffLength)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("could not read file: %w", err)
 	}
+	format := audioTypes.DetectFormat(header[:n])
+	if format == "" {
+		return "", fmt.Errorf("not a recognised audio file")
+	}
+	if !slices.Contains(app.AllowedFormats, format) {
+		return "", fmt.Errorf("%s files are not allowed (allowed: %s)", format, strings.Join(app.AllowedFormats, ", "))
+	}
+
+	stored, err := fs.UploadFileWithPolicy(ctx, file, name, clientID, policy)
+	if err != nil {
+		return "", fmt.Errorf("could not upload: %w", err)
+	}
+	return stored, nil
 }
 
 // DeleteBlobHandler handles the DELETE requests to delete blobs.
 func DeleteFileHandler(fs *fileSystem.FileSystem) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		file := chi.URLParam(r, "name")
-		fs.DeleteBlob(file)
+		if err := fs.Delete(r.Context(), file); err != nil {
+			http.Error(w, fmt.Sprintf("could not delete %s: %v", file, err), http.StatusInternalServerError)
+			return
+		}
 		msg := fmt.Sprintf("%s deleted successfully", file)
 		json.NewEncoder(w).Encode(msg)
 	}
 }
 
-func ClearContainerHandler(fs *fileSystem.FileSystem) http.HandlerFunc {
-	fmt.Printf("Clearing container: %s", fs.ContainerName)
+// ClearContainerHandler starts a batch delete job over the container and returns it immediately.
+// optional query params: prefix, glob, olderThan (e.g. 72h), dryRun and concurrency (at most 32).
+// progress is available from /jobs/{id}
+func (app *App) ClearContainerHandler(fs *fileSystem.FileSystem) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fs.ClearContainer()
-		msg := fmt.Sprintf("%s cleared successfully", fs.ContainerName)
-		json.NewEncoder(w).Encode(msg)
+		log.Printf("Handling clear container request for %s", fs.ContainerName)
+
+		query := r.URL.Query()
+		opts := fileSystem.BatchDeleteOptions{
+			Filter: fileSystem.DeleteFilter{
+				Prefix: query.Get("prefix"),
+				Glob:   query.Get("glob"),
+			},
+		}
+
+		var err error
+		if value := query.Get("olderThan"); value != "" {
+			if opts.Filter.OlderThan, err = time.ParseDuration(value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid olderThan: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if value := query.Get("dryRun"); value != "" {
+			if opts.DryRun, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid dryRun: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if value := query.Get("concurrency"); value != "" {
+			if opts.Concurrency, err = strconv.Atoi(value); err != nil || opts.Concurrency < 1 {
+				http.Error(w, "concurrency must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := opts.Filter.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		job := app.Jobs.Create("delete", fs.ContainerName, opts.DryRun)
+
+		go func() {
+			report, err := fs.BatchDelete(context.Background(), opts, func(matched []fileSystem.BlobInfo, done *fileSystem.BlobInfo, err error) {
+				app.Jobs.Update(job.ID, func(j *Job) {
+					if done == nil {
+						j.Total = len(matched)
+						if opts.DryRun {
+							j.Matched = []string{}
+							for _, blob := range matched {
+								j.Matched = append(j.Matched, blob.Name)
+							}
+						}
+						return
+					}
+					j.Processed++
+					if err != nil {
+						j.Failures = append(j.Failures, JobFailure{Name: done.Name, Error: err.Error()})
+					} else {
+						j.Succeeded++
+					}
+				})
+			})
+			if err == nil && len(report.Failures) > 0 {
+				err = fmt.Errorf("%d of %d blobs could not be deleted", len(report.Failures), len(report.Matched))
+			}
+			app.Jobs.Finish(job.ID, err)
+		}()
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
 	}
 }
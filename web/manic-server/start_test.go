@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+func newTestStartApp(t *testing.T, taskPath string) *App {
+	t.Helper()
+	tasks, err := NewTaskStore(taskPath, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := serviceBus.NewMemoryBroker()
+	t.Cleanup(func() { bus.Close(context.Background()) })
+	return &App{Broker: bus, Tasks: tasks}
+}
+
+func postStart(app *App, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	app.ManicCompressionHandler()(w, httptest.NewRequest(http.MethodPost, "/start", strings.NewReader(body)))
+	return w
+}
+
+const testStartBody = `{"inputFiles": ["a.wav", "b.wav"], "clientID": "client", "audioFunctionPipeline": ["wav_to_mp3"]}`
+
+func laneMessages(t *testing.T, app *App) int32 {
+	t.Helper()
+	stats, err := app.Broker.QueueStats(laneQueues[audioTypes.PriorityNormal])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats.ActiveMessages
+}
+
+func TestStartRecordsTasks(t *testing.T) {
+	app := newTestStartApp(t, filepath.Join(t.TempDir(), "tasks.json"))
+	w := postStart(app, testStartBody)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var response StartResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	active := app.Tasks.List(tasksActive)
+	for _, task := range response.Tasks {
+		if active[task.TaskID].Status != serviceBus.TaskQueued {
+			t.Errorf("task %s is %q", task.TaskID, active[task.TaskID].Status)
+		}
+	}
+	if len(response.Tasks) != 2 || laneMessages(t, app) != 2 {
+		t.Errorf("started %d tasks, %d messages in the lane", len(response.Tasks), laneMessages(t, app))
+	}
+}
+
+// tasks that can't be recorded aren't sent, the dispatcher would never know about them
+func TestStartFailsWhenTasksCantBeRecorded(t *testing.T) {
+	app := newTestStartApp(t, filepath.Join(t.TempDir(), "missing", "tasks.json"))
+	w := postStart(app, testStartBody)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", w.Code)
+	}
+	if n := laneMessages(t, app); n != 0 {
+		t.Errorf("sent %d messages", n)
+	}
+	if tasks := app.Tasks.List(tasksActive); len(tasks) != 0 {
+		t.Errorf("%d tasks were left in the store", len(tasks))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	fileSystem "manic-compression/pkg/file_system"
+)
+
+const usageLargestBlobs = 20
+
+type StorageUsage struct {
+	GeneratedAt time.Time                   `json:"generatedAt"`
+	Containers  []fileSystem.ContainerUsage `json:"containers"`
+}
+
+// UsageReporter keeps the last storage usage report, which is rebuilt in the background
+// because listing a large container is too slow to do per request
+type UsageReporter struct {
+	mu          sync.Mutex
+	report      *StorageUsage
+	lastError   string
+	refreshing  bool
+	fileSystems []*fileSystem.FileSystem
+}
+
+func NewUsageReporter(fileSystems ...*fileSystem.FileSystem) *UsageReporter {
+	return &UsageReporter{fileSystems: fileSystems}
+}
+
+// Refresh rebuilds the report, concurrent calls collapse into the one already running
+func (ur *UsageReporter) Refresh(ctx context.Context) {
+	ur.mu.Lock()
+	if ur.refreshing {
+		ur.mu.Unlock()
+		return
+	}
+	ur.refreshing = true
+	ur.mu.Unlock()
+
+	report := &StorageUsage{GeneratedAt: time.Now(), Containers: []fileSystem.ContainerUsage{}}
+	var err error
+	for _, fs := range ur.fileSystems {
+		var usage fileSystem.ContainerUsage
+		usage, err = fs.Usage(ctx, usageLargestBlobs)
+		if err != nil {
+			break
+		}
+		report.Containers = append(report.Containers, usage)
+	}
+
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.refreshing = false
+	if err != nil {
+		// keep serving the previous report
+		log.Printf("could not refresh storage usage: %v", err)
+		ur.lastError = err.Error()
+		return
+	}
+	ur.report = report
+	ur.lastError = ""
+}
+
+// Run refreshes the report every interval until ctx is cancelled
+func (ur *UsageReporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ur.Refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// StorageUsageHandler serves the cached report; ?refresh=true also starts a rebuild in the background
+func (app *App) StorageUsageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Handling storage usage request")
+		if r.URL.Query().Get("refresh") == "true" {
+			go app.Usage.Refresh(context.Background())
+		}
+
+		app.Usage.mu.Lock()
+		report, lastError := app.Usage.report, app.Usage.lastError
+		app.Usage.mu.Unlock()
+
+		if report == nil {
+			w.Header().Set("Retry-After", "10")
+			msg := "storage usage is still being computed"
+			if lastError != "" {
+				msg = "could not compute storage usage: " + lastError
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
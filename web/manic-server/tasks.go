@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+// message types on the task and results queues
+const (
+	taskMessageType   = serviceBus.MessageProcessAudio
+	resultMessageType = serviceBus.MessageProcessAudioResult
+
+	resultsWait  = 5 * time.Second // how long each receive from the results queue waits
+	reapInterval = time.Minute     // how often tasks are checked for an expired lease
+)
+
+// the views tasks are listed and cleared by
+const (
+	tasksActive    = "active"    // enqueued and not finished
+	tasksScheduled = "scheduled" // waiting for their scheduled time
+	tasksFinished  = "finished"  // completed, failed or cancelled
+)
+
+// taskView places a task in one of the views. a scheduled task counts as active once its time has come
+func taskView(task audioTypes.AudioTask, now time.Time) string {
+	switch task.Status {
+	case serviceBus.TaskInProgress, serviceBus.TaskQueued:
+		return tasksActive
+	case serviceBus.TaskScheduled:
+		if task.ScheduledAt != nil && now.Before(*task.ScheduledAt) {
+			return tasksScheduled
+		}
+		return tasksActive
+	default:
+		return tasksFinished
+	}
+}
+
+// TaskStore keeps the state of every task the server started, updated from the results queue.
+// it is persisted to a JSON file because result messages are gone once they're completed.
+// every attempt of a task in progress holds a lease, a task without a result when its lease
+// expires is considered lost (see reapExpiredTasks)
+type TaskStore struct {
+	mu     sync.Mutex
+	path   string
+	tasks  map[string]audioTypes.AudioTask
+	lease  time.Duration
+	leases map[string]time.Time // expiry of the current attempt of tasks in progress, by task ID
+}
+
+// NewTaskStore loads the tasks persisted at path, a missing file starts empty. leases aren't
+// persisted, tasks in progress get a new lease of the given duration
+func NewTaskStore(path string, lease time.Duration) (*TaskStore, error) {
+	s := &TaskStore{path: path, tasks: map[string]audioTypes.AudioTask{}, lease: lease, leases: map[string]time.Time{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.tasks); err != nil {
+		return nil, fmt.Errorf("could not parse task state %s: %w", path, err)
+	}
+	expires := time.Now().Add(lease)
+	for id, task := range s.tasks {
+		if task.Status == serviceBus.TaskInProgress {
+			s.leases[id] = expires
+		}
+	}
+	return s, nil
+}
+
+// Record adds newly started tasks. a task that is already known (its result may have been
+// applied first) is left alone. nothing is added if the tasks can't be persisted
+func (s *TaskStore) Record(tasks ...audioTypes.AudioTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := []string{}
+	for _, task := range tasks {
+		if _, ok := s.tasks[task.TaskID]; !ok {
+			s.tasks[task.TaskID] = task
+			added = append(added, task.TaskID)
+		}
+	}
+	if err := writeJSONFile(s.path, s.tasks); err != nil {
+		for _, id := range added {
+			delete(s.tasks, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove forgets recorded tasks whose start message couldn't be sent
+func (s *TaskStore) Remove(taskIDs ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range taskIDs {
+		delete(s.tasks, id)
+		delete(s.leases, id)
+	}
+	return writeJSONFile(s.path, s.tasks)
+}
+
+// Scheduled stores the sequence numbers of scheduled tasks' messages, by task ID, which cancel them
+func (s *TaskStore) Scheduled(sequenceNumbers map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sequence := range sequenceNumbers {
+		if task, ok := s.tasks[id]; ok {
+			task.ScheduledSequence = sequence
+			s.tasks[id] = task
+		}
+	}
+	return writeJSONFile(s.path, s.tasks)
+}
+
+// ApplyResult updates a task from a result message. applying the same result again is a no-op,
+// a task that already finished keeps its first result and a result of an earlier delivery than
+// the one stored is ignored, so redelivered messages are harmless. it reports whether the stored task changed
+func (s *TaskStore) ApplyResult(result audioTypes.AudioTask) (bool, error) {
+	return s.update(result)
+}
+
+// Retried reports whether the retry that follows this failed result has already been recorded
+func (s *TaskStore) Retried(result audioTypes.AudioTask) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.tasks[result.TaskID]
+	return ok && current.DeliveryCount > result.DeliveryCount
+}
+
+// Retry records that a task was enqueued again to start at startAt, task carries the new delivery
+// count. the lease of the new attempt starts then
+func (s *TaskStore) Retry(task audioTypes.AudioTask, startAt time.Time) error {
+	changed, err := s.update(task)
+	if changed {
+		s.mu.Lock()
+		s.leases[task.TaskID] = startAt.Add(s.lease)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *TaskStore) update(task audioTypes.AudioTask) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.tasks[task.TaskID]
+	if ok && (taskView(current, time.Now()) == tasksFinished || current.DeliveryCount > task.DeliveryCount) {
+		return false, nil
+	}
+	s.tasks[task.TaskID] = task
+	if err := writeJSONFile(s.path, s.tasks); err != nil {
+		// keep memory in line with the file so the redelivered message is applied again
+		if ok {
+			s.tasks[task.TaskID] = current
+		} else {
+			delete(s.tasks, task.TaskID)
+		}
+		return false, err
+	}
+	if task.Status != serviceBus.TaskInProgress {
+		delete(s.leases, task.TaskID)
+	}
+	return true, nil
+}
+
+// Dispatched marks a queued task as in progress once it was forwarded from its lane to the functions.
+// unknown tasks (e.g. cleared while queued) and tasks that already moved on are left alone
+func (s *TaskStore) Dispatched(taskID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[taskID]
+	if !ok || !laneQueued(task, time.Now()) {
+		return nil
+	}
+	task.Status = serviceBus.TaskInProgress
+	s.tasks[taskID] = task
+	s.leases[taskID] = time.Now().Add(s.lease)
+	return writeJSONFile(s.path, s.tasks)
+}
+
+// laneQueued reports whether a task is waiting in its priority lane, a scheduled task is once its time has come
+func laneQueued(task audioTypes.AudioTask, now time.Time) bool {
+	return task.Status == serviceBus.TaskQueued || (task.Status == serviceBus.TaskScheduled && taskView(task, now) == tasksActive)
+}
+
+// InFlight counts the tasks handed to the functions that haven't finished, in total and per session
+func (s *TaskStore) InFlight() (int, map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	bySession := map[string]int{}
+	for _, task := range s.tasks {
+		if task.Status == serviceBus.TaskInProgress {
+			total++
+			bySession[taskSession(task)]++
+		}
+	}
+	return total, bySession
+}
+
+// Expired returns the tasks in progress whose lease expired before now
+func (s *TaskStore) Expired(now time.Time) []audioTypes.AudioTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := []audioTypes.AudioTask{}
+	for id, expires := range s.leases {
+		if task, ok := s.tasks[id]; ok && task.Status == serviceBus.TaskInProgress && expires.Before(now) {
+			expired = append(expired, task)
+		}
+	}
+	return expired
+}
+
+// Backlog counts the tasks waiting in each priority lane by session
+func (s *TaskStore) Backlog() map[string]map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	backlog := map[string]map[string]int{}
+	for _, priority := range audioTypes.Priorities {
+		backlog[priority] = map[string]int{}
+	}
+	for _, task := range s.tasks {
+		if laneQueued(task, now) {
+			backlog[taskPriority(task)][taskSession(task)]++
+		}
+	}
+	return backlog
+}
+
+// LaneDepth counts the tasks waiting in each priority lane
+func (s *TaskStore) LaneDepth() map[string]int {
+	depth := map[string]int{}
+	for lane, sessions := range s.Backlog() {
+		depth[lane] = 0
+		for _, count := range sessions {
+			depth[lane] += count
+		}
+	}
+	return depth
+}
+
+// taskSession is the session of a task in its lane, tasks are grouped by client so one client's
+// backlog can't hold up everyone else's
+func taskSession(task audioTypes.AudioTask) string {
+	if task.ClientID == "" {
+		return anonymousSession
+	}
+	return task.ClientID
+}
+
+// taskPriority is the lane of a task, tasks from before priorities existed are normal
+func taskPriority(task audioTypes.AudioTask) string {
+	if task.Priority == "" {
+		return audioTypes.PriorityNormal
+	}
+	return task.Priority
+}
+
+// List returns the tasks in one of the views (tasksActive, tasksScheduled or tasksFinished)
+func (s *TaskStore) List(view string) map[string]audioTypes.AudioTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	tasks := map[string]audioTypes.AudioTask{}
+	for id, task := range s.tasks {
+		if taskView(task, now) == view {
+			if view == tasksActive && task.Status == serviceBus.TaskScheduled {
+				task.Status = serviceBus.TaskQueued
+			}
+			tasks[id] = task
+		}
+	}
+	return tasks
+}
+
+// Clear forgets the tasks in a view
+func (s *TaskStore) Clear(view string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, task := range s.tasks {
+		if taskView(task, now) == view {
+			delete(s.tasks, id)
+			delete(s.leases, id)
+		}
+	}
+	return writeJSONFile(s.path, s.tasks)
+}
+
+// Cancel marks a scheduled task cancelled once cancel, which should cancel its message, succeeds.
+// it fails with errTaskNotFound or, if the task is no longer waiting, errNotScheduled. the store
+// isn't locked while cancel talks to the broker, the task is checked again before it is updated
+func (s *TaskStore) Cancel(taskID string, cancel func(task audioTypes.AudioTask) error) (audioTypes.AudioTask, error) {
+	s.mu.Lock()
+	task, ok := s.tasks[taskID]
+	s.mu.Unlock()
+	if !ok {
+		return task, errTaskNotFound
+	}
+	// without a sequence number its message is still being scheduled by /start
+	if taskView(task, time.Now()) != tasksScheduled || task.ScheduledSequence == 0 {
+		return task, errNotScheduled
+	}
+	if err := cancel(task); err != nil {
+		return task, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the message is cancelled either way, but a task that was cleared or moved on meanwhile is left alone
+	current, ok := s.tasks[taskID]
+	if !ok {
+		return task, errTaskNotFound
+	}
+	if current.Status != serviceBus.TaskScheduled || current.ScheduledSequence != task.ScheduledSequence {
+		return current, errNotScheduled
+	}
+	current.Status = serviceBus.TaskCancelled
+	s.tasks[taskID] = current
+	return current, writeJSONFile(s.path, s.tasks)
+}
+
+var (
+	errTaskNotFound = errors.New("task not found")
+	errNotScheduled = errors.New("task is not scheduled or has already started")
+)
+
+// handleResult applies one message from the results queue, anything that isn't a task result
+// is dead-lettered rather than retried
+func (app *App) handleResult(delivery serviceBus.Delivery) error {
+	if delivery.Msg.Type != resultMessageType {
+		return serviceBus.DeadLetter("unexpected message type", fmt.Sprintf("expected %s, got %q", resultMessageType, delivery.Msg.Type))
+	}
+	var result audioTypes.AudioTask
+	if err := delivery.Msg.DecodePayload(&result); err != nil {
+		return serviceBus.DeadLetter("unparseable task", err.Error())
+	}
+	if result.TaskID == "" {
+		return serviceBus.DeadLetter("unparseable task", "result has no taskID")
+	}
+	if result.Status == serviceBus.TaskFailed {
+		return app.handleFailedResult(result, delivery.Msg)
+	}
+
+	changed, err := app.Tasks.ApplyResult(result)
+	if err != nil {
+		return fmt.Errorf("could not apply result for task %s: %w", result.TaskID, err)
+	}
+	if changed {
+		log.Printf("task %s is %s", result.TaskID, result.Status)
+	}
+	return nil
+}
+
+// handleFailedResult retries a task whose pipeline step failed according to the step's retry
+// policy, by scheduling the task again after the policy's backoff. the pipeline then runs from the
+// start. once the task is out of attempts, or the error is fatal, it is marked Failed and the result
+// message is dead-lettered with the failing step and error
+func (app *App) handleFailedResult(result audioTypes.AudioTask, cause serviceBus.Msg) error {
+	policy := audioTypes.RetryPolicyFor(result.FailedStep)
+	if !policy.ShouldRetry(result.ErrorClass, result.DeliveryCount) {
+		if _, err := app.Tasks.ApplyResult(result); err != nil {
+			return fmt.Errorf("could not apply result for task %s: %w", result.TaskID, err)
+		}
+		log.Printf("task %s failed in %s after %d attempts: %s", result.TaskID, result.FailedStep, result.DeliveryCount, result.Error)
+		return serviceBus.DeadLetter(fmt.Sprintf("%s failed (%s)", result.FailedStep, result.ErrorClass), result.Error)
+	}
+	if app.Tasks.Retried(result) {
+		return nil
+	}
+
+	retry := result
+	retry.Status = serviceBus.TaskInProgress
+	retry.DeliveryCount++
+	retry.FailedStep, retry.Error, retry.ErrorClass = "", "", ""
+	msg := taskMessage(retry).CausedBy(cause)
+	msg.SessionID = "" // retries skip the lanes, the task queue isn't session enabled
+
+	backoff := policy.Backoff(result.DeliveryCount)
+	if err := app.Broker.SendMessageAt(msg, taskQueue, time.Now().Add(backoff)); err != nil {
+		return fmt.Errorf("could not schedule retry of task %s: %w", result.TaskID, err)
+	}
+	log.Printf("task %s failed in %s, attempt %d of %d in %s: %s", result.TaskID, result.FailedStep, retry.DeliveryCount, policy.MaxAttempts, backoff, result.Error)
+
+	// the stored task keeps the last failure so it's visible while the retry is pending
+	retry.FailedStep, retry.Error, retry.ErrorClass = result.FailedStep, result.Error, result.ErrorClass
+	if err := app.Tasks.Retry(retry, time.Now().Add(backoff)); err != nil {
+		return fmt.Errorf("could not record retry of task %s: %w", result.TaskID, err)
+	}
+	return nil
+}
+
+// reapExpiredTasks checks every interval for tasks that got no result within their lease, e.g.
+// because the orchestrator crashed, until ctx is cancelled
+func (app *App) reapExpiredTasks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, task := range app.Tasks.Expired(time.Now()) {
+			if err := app.reapTask(task); err != nil {
+				log.Printf("could not handle the expired lease of task %s: %v", task.TaskID, err)
+			}
+		}
+	}
+}
+
+// reapTask enqueues a lost task again, like a retryable failure of an unknown step, or marks it
+// Failed once it's out of attempts. a late result of the lost attempt is ignored by ApplyResult
+// because of its lower delivery count. when the enqueue fails the lease stays expired and the
+// next round tries again
+func (app *App) reapTask(task audioTypes.AudioTask) error {
+	policy := audioTypes.DefaultRetryPolicy
+	task.FailedStep = ""
+	task.Error = fmt.Sprintf("no result within %s", app.Tasks.lease)
+	task.ErrorClass = audioTypes.ErrorRetryable
+	if !policy.ShouldRetry(task.ErrorClass, task.DeliveryCount) {
+		task.Status = serviceBus.TaskFailed
+		if _, err := app.Tasks.ApplyResult(task); err != nil {
+			return err
+		}
+		log.Printf("task %s failed after %d attempts: %s", task.TaskID, task.DeliveryCount, task.Error)
+		return nil
+	}
+
+	retry := task
+	retry.DeliveryCount++
+	retry.Error, retry.ErrorClass = "", ""
+	msg := taskMessage(retry)
+	msg.SessionID = "" // like other retries it skips the lanes
+	if err := app.Broker.SendMessage(msg, taskQueue); err != nil {
+		return err
+	}
+	log.Printf("task %s got no result within %s, attempt %d of %d", task.TaskID, app.Tasks.lease, retry.DeliveryCount, policy.MaxAttempts)
+
+	// the stored task keeps the reason of the retry
+	retry.Error, retry.ErrorClass = task.Error, task.ErrorClass
+	return app.Tasks.Retry(retry, time.Now())
+}
+
+// consumeResults receives from the results queue until ctx is cancelled
+func (app *App) consumeResults(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := app.Broker.Receive(ctx, taskResultsQueue, 10, resultsWait, func(delivery serviceBus.Delivery) error {
+			err := app.handleResult(delivery)
+			if err != nil {
+				log.Printf("result message %s: %v", delivery.MessageID, err)
+			}
+			return err
+		})
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil || errors.Is(err, serviceBus.ErrClosed) {
+			return
+		}
+
+		log.Printf("could not receive results, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
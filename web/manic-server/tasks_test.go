@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+// a redelivered or late result doesn't overwrite the first one, and results survive a restart
+func TestTaskStoreAppliesResultsOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	tasks, err := NewTaskStore(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, _ := newAudioTask("client", "a.wav", []string{audioTypes.AudioFunctionWAVToMp3}, audioTypes.PriorityNormal, nil, "")
+	if err := tasks.Record(task); err != nil {
+		t.Fatal(err)
+	}
+
+	result := task
+	result.Status = serviceBus.TaskCompleted
+	result.OutputFile = "a.mp3"
+	if changed, err := tasks.ApplyResult(result); err != nil || !changed {
+		t.Fatalf("applying the result returned %v, %v", changed, err)
+	}
+	late := result
+	late.OutputFile = "late.mp3"
+	if changed, err := tasks.ApplyResult(late); err != nil || changed {
+		t.Errorf("applying a second result returned %v, %v", changed, err)
+	}
+	// recording the task again doesn't undo its result
+	if err := tasks.Record(task); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewTaskStore(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.List(tasksFinished)[task.TaskID]; got.Status != serviceBus.TaskCompleted || got.OutputFile != "a.mp3" {
+		t.Errorf("reloaded task %+v", got)
+	}
+	if active := reloaded.List(tasksActive); len(active) != 0 {
+		t.Errorf("%d tasks are still active", len(active))
+	}
+}
+
+// tasks that can't be persisted aren't kept in memory either, so /start can fail before sending
+func TestTaskStoreRecordFailsWithoutAFile(t *testing.T) {
+	tasks, err := NewTaskStore(filepath.Join(t.TempDir(), "missing", "tasks.json"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, _ := newAudioTask("client", "a.wav", []string{audioTypes.AudioFunctionWAVToMp3}, audioTypes.PriorityNormal, nil, "")
+	if err := tasks.Record(task); err == nil {
+		t.Fatal("recorded a task that couldn't be persisted")
+	}
+	if active := tasks.List(tasksActive); len(active) != 0 {
+		t.Errorf("%d tasks were left in the store", len(active))
+	}
+}
+
+func newTestScheduledTask(t *testing.T, tasks *TaskStore) audioTypes.AudioTask {
+	t.Helper()
+	at := time.Now().Add(time.Hour)
+	task, _ := newAudioTask("client", "a.wav", []string{audioTypes.AudioFunctionWAVToMp3}, audioTypes.PriorityNormal, &at, "")
+	if err := tasks.Record(task); err != nil {
+		t.Fatal(err)
+	}
+	if err := tasks.Scheduled(map[string]int64{task.TaskID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func TestTaskCancel(t *testing.T) {
+	tasks, err := NewTaskStore(filepath.Join(t.TempDir(), "tasks.json"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := newTestScheduledTask(t, tasks)
+
+	cancelled, err := tasks.Cancel(task.TaskID, func(task audioTypes.AudioTask) error {
+		// the store stays usable while the broker is called
+		if len(tasks.List(tasksScheduled)) != 1 {
+			t.Error("the task isn't listed during the cancel")
+		}
+		if task.ScheduledSequence != 7 {
+			t.Errorf("cancelling sequence %d", task.ScheduledSequence)
+		}
+		return nil
+	})
+	if err != nil || cancelled.Status != serviceBus.TaskCancelled {
+		t.Errorf("cancel returned %q, %v", cancelled.Status, err)
+	}
+	if _, err := tasks.Cancel(task.TaskID, func(audioTypes.AudioTask) error { return nil }); !errors.Is(err, errNotScheduled) {
+		t.Errorf("cancelling again returned %v", err)
+	}
+}
+
+// a task that changes while its message is being cancelled isn't overwritten
+func TestTaskCancelRechecksTheTask(t *testing.T) {
+	tasks, err := NewTaskStore(filepath.Join(t.TempDir(), "tasks.json"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := newTestScheduledTask(t, tasks)
+	_, err = tasks.Cancel(task.TaskID, func(audioTypes.AudioTask) error {
+		return tasks.Clear(tasksScheduled)
+	})
+	if !errors.Is(err, errTaskNotFound) {
+		t.Errorf("cancelling a task cleared meanwhile returned %v", err)
+	}
+
+	// a task whose message isn't scheduled yet can't be cancelled
+	at := time.Now().Add(time.Hour)
+	pending, _ := newAudioTask("client", "b.wav", []string{audioTypes.AudioFunctionWAVToMp3}, audioTypes.PriorityNormal, &at, "")
+	if err := tasks.Record(pending); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tasks.Cancel(pending.TaskID, func(audioTypes.AudioTask) error { return nil }); !errors.Is(err, errNotScheduled) {
+		t.Errorf("cancelling a task without a sequence number returned %v", err)
+	}
+}
+
+func newTestFailedTask(t *testing.T, app *App, deliveryCount int) audioTypes.AudioTask {
+	t.Helper()
+	task, _ := newAudioTask("client", "a.wav", []string{audioTypes.AudioFunctionWAVToMp3}, audioTypes.PriorityNormal, nil, "")
+	task.Status = serviceBus.TaskInProgress
+	task.DeliveryCount = deliveryCount
+	if err := app.Tasks.Record(task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func taskQueueStats(t *testing.T, app *App) serviceBus.QueueStats {
+	t.Helper()
+	stats, err := app.Broker.QueueStats(taskQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestHandleFailedResult(t *testing.T) {
+	maxAttempts := audioTypes.RetryPolicyFor("WavToMP3").MaxAttempts
+	for name, tc := range map[string]struct {
+		deliveryCount int
+		errorClass    string
+		retried       bool
+	}{
+		"retryable":    {1, audioTypes.ErrorRetryable, true},
+		"last attempt": {maxAttempts, audioTypes.ErrorRetryable, false},
+		"fatal":        {1, audioTypes.ErrorFatal, false},
+	} {
+		app := newTestStartApp(t, filepath.Join(t.TempDir(), "tasks.json"))
+		result := newTestFailedTask(t, app, tc.deliveryCount)
+		result.Status = serviceBus.TaskFailed
+		result.FailedStep, result.Error, result.ErrorClass = "WavToMP3", "storage unavailable", tc.errorClass
+
+		err := app.handleFailedResult(result, serviceBus.Msg{MessageID: "result"})
+		stored := app.Tasks.List(tasksActive)[result.TaskID]
+		stats := taskQueueStats(t, app)
+		if !tc.retried {
+			var deadLetter *serviceBus.DeadLetterError
+			if !errors.As(err, &deadLetter) {
+				t.Errorf("%s: returned %v, want the result dead-lettered", name, err)
+			}
+			if failed := app.Tasks.List(tasksFinished)[result.TaskID]; failed.Status != serviceBus.TaskFailed {
+				t.Errorf("%s: task is %q", name, failed.Status)
+			}
+			if stats.TotalMessages != 0 {
+				t.Errorf("%s: sent %d retries", name, stats.TotalMessages)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if stored.DeliveryCount != tc.deliveryCount+1 || stored.FailedStep != "WavToMP3" || stored.Error == "" {
+			t.Errorf("%s: stored %+v", name, stored)
+		}
+		// the retry waits for its backoff
+		if stats.ScheduledMessages != 1 || stats.ActiveMessages != 0 {
+			t.Errorf("%s: %d scheduled, %d active messages", name, stats.ScheduledMessages, stats.ActiveMessages)
+		}
+
+		// a redelivered result doesn't schedule another retry
+		if err := app.handleFailedResult(result, serviceBus.Msg{MessageID: "result"}); err != nil {
+			t.Errorf("%s: redelivery returned %v", name, err)
+		}
+		if n := taskQueueStats(t, app).TotalMessages; n != 1 {
+			t.Errorf("%s: %d retries after a redelivery", name, n)
+		}
+	}
+}
+
+func TestReapTask(t *testing.T) {
+	maxAttempts := audioTypes.DefaultRetryPolicy.MaxAttempts
+	for name, tc := range map[string]struct {
+		deliveryCount int
+		retried       bool
+	}{
+		"first attempt": {1, true},
+		"last attempt":  {maxAttempts, false},
+	} {
+		app := newTestStartApp(t, filepath.Join(t.TempDir(), "tasks.json"))
+		task := newTestFailedTask(t, app, tc.deliveryCount)
+		if err := app.reapTask(task); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		stats := taskQueueStats(t, app)
+		if !tc.retried {
+			if failed := app.Tasks.List(tasksFinished)[task.TaskID]; failed.Status != serviceBus.TaskFailed || failed.Error == "" {
+				t.Errorf("%s: stored %+v", name, failed)
+			}
+			if stats.TotalMessages != 0 {
+				t.Errorf("%s: sent %d retries", name, stats.TotalMessages)
+			}
+			continue
+		}
+
+		// a lost task is enqueued again right away, with a new lease
+		stored := app.Tasks.List(tasksActive)[task.TaskID]
+		if stored.DeliveryCount != tc.deliveryCount+1 || stored.Status != serviceBus.TaskInProgress {
+			t.Errorf("%s: stored %+v", name, stored)
+		}
+		if stats.ActiveMessages != 1 {
+			t.Errorf("%s: %d messages on the task queue", name, stats.ActiveMessages)
+		}
+		if expired := app.Tasks.Expired(time.Now()); len(expired) != 0 {
+			t.Errorf("%s: the retry's lease already expired", name)
+		}
+	}
+}
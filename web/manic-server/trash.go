@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	fileSystem "manic-compression/pkg/file_system"
+)
+
+type TrashRequest struct {
+	Container string   `json:"container"`
+	IDs       []string `json:"ids"`
+}
+
+// fileSystemFor looks up one of the app's file systems by container name
+func (app *App) fileSystemFor(container string) (*fileSystem.FileSystem, bool) {
+	for _, fs := range []*fileSystem.FileSystem{app.InputFileSystem, app.OutputFileSystem} {
+		if fs.ContainerName == container {
+			return fs, true
+		}
+	}
+	return nil, false
+}
+
+// decodeTrashRequest reads the request body and resolves its container, writing the error response on failure
+func (app *App) decodeTrashRequest(w http.ResponseWriter, r *http.Request) (TrashRequest, *fileSystem.FileSystem, bool) {
+	var req TrashRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request body: %v", err), http.StatusBadRequest)
+		return req, nil, false
+	}
+	fs, ok := app.fileSystemFor(req.Container)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown container %q", req.Container), http.StatusBadRequest)
+		return req, nil, false
+	}
+	return req, fs, true
+}
+
+func (app *App) ListTrashHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Handling list trash request")
+		items := []fileSystem.TrashItem{}
+		for _, fs := range []*fileSystem.FileSystem{app.InputFileSystem, app.OutputFileSystem} {
+			trashed, err := fs.ListTrash(r.Context())
+			if err != nil {
+				http.Error(w, fmt.Sprintf("could not list trash: %v", err), http.StatusInternalServerError)
+				return
+			}
+			items = append(items, trashed...)
+		}
+		json.NewEncoder(w).Encode(items)
+	}
+}
+
+func (app *App) RestoreTrashHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Handling restore trash request")
+		req, fs, ok := app.decodeTrashRequest(w, r)
+		if !ok {
+			return
+		}
+		if len(req.IDs) == 0 {
+			http.Error(w, "no ids provided", http.StatusBadRequest)
+			return
+		}
+
+		restored, failures, err := fs.RestoreTrash(r.Context(), req.IDs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not restore: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"restored": restored, "failures": failures})
+	}
+}
+
+// PurgeTrashHandler permanently deletes the given ids, or the whole trash of the container when ids is empty
+func (app *App) PurgeTrashHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Handling purge trash request")
+		req, fs, ok := app.decodeTrashRequest(w, r)
+		if !ok {
+			return
+		}
+
+		purged, failures, err := fs.PurgeTrash(r.Context(), req.IDs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not purge: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"purged": purged, "failures": failures})
+	}
+}
+
+// purgeExpiredTrash removes trash past its retention window every interval until ctx is cancelled
+func (app *App) purgeExpiredTrash(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, fs := range []*fileSystem.FileSystem{app.InputFileSystem, app.OutputFileSystem} {
+			purged, err := fs.PurgeExpiredTrash(ctx)
+			if err != nil {
+				log.Printf("could not purge expired trash in %s: %v", fs.ContainerName, err)
+			}
+			if purged > 0 {
+				log.Printf("purged %d expired items from the %s trash", purged, fs.ContainerName)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
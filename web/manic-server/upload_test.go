@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	fileSystem "manic-compression/pkg/file_system"
+)
+
+func postUpload(t *testing.T, app *App, files map[string][]byte) *httptest.ResponseRecorder {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for name, data := range files {
+		part, err := form.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	form.WriteField("clientID", "client")
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/input", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	// nothing in these requests gets as far as the backend
+	app.UploadFileHandler(&fileSystem.FileSystem{ContainerName: "input"})(w, r)
+	return w
+}
+
+func TestUploadWithoutFiles(t *testing.T) {
+	app := &App{AllowedFormats: audioTypes.AllFormats}
+	if w := postUpload(t, app, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", w.Code)
+	}
+}
+
+func TestUploadRejectsFormats(t *testing.T) {
+	app := &App{AllowedFormats: []string{audioTypes.FormatMP3}}
+	w := postUpload(t, app, map[string][]byte{
+		"notes.wav": []byte("not audio at all"),
+		"a.wav":     []byte("RIFF\x24\x00\x00\x00WAVEfmt "),
+	})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want 422", w.Code)
+	}
+	var response UploadResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Uploaded) != 0 || len(response.Rejected) != 2 {
+		t.Errorf("response %+v", response)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	fileSystem "manic-compression/pkg/file_system"
+	serviceBus "manic-compression/pkg/service_bus"
+
+	"github.com/go-chi/chi/v5"
+	uuid "github.com/google/uuid"
+)
+
+// a watch rule maps a prefix ("hot folder") in the input container to a pipeline. the watcher polls
+// the container and enqueues one task for every blob that shows up under the prefix after the rule
+// was created. rules and the blobs already handled are persisted so a restart neither misses nor
+// repeats work
+
+// seen states of a blob under a rule
+const (
+	watchPending  = "pending"  // recorded, enqueue not confirmed yet
+	watchEnqueued = "enqueued" // task sent
+)
+
+type WatchRule struct {
+	ID                    string    `json:"id"`
+	Prefix                string    `json:"prefix"`
+	ClientID              string    `json:"clientID"`
+	AudioFunctionPipeline []string  `json:"audioFunctionPipeline"`
+	CreatedAt             time.Time `json:"createdAt"`
+}
+
+type watchState struct {
+	Rules []WatchRule                  `json:"rules"`
+	Seen  map[string]map[string]string `json:"seen"` // rule id -> blob key -> seen state
+}
+
+type Watcher struct {
+	polling   sync.Mutex // one poll at a time, held while tasks are enqueued without mu
+	mu        sync.Mutex
+	statePath string
+	state     watchState
+	fs        *fileSystem.FileSystem
+	enqueue   func(task audioTypes.AudioTask, msg serviceBus.Msg) error
+}
+
+// NewWatcher loads persisted rules from statePath, a missing file starts with no rules
+func NewWatcher(statePath string, fs *fileSystem.FileSystem, enqueue func(task audioTypes.AudioTask, msg serviceBus.Msg) error) (*Watcher, error) {
+	w := &Watcher{
+		statePath: statePath,
+		state:     watchState{Rules: []WatchRule{}, Seen: map[string]map[string]string{}},
+		fs:        fs,
+		enqueue:   enqueue,
+	}
+
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &w.state); err != nil {
+		return nil, fmt.Errorf("could not parse watch state %s: %w", statePath, err)
+	}
+	if w.state.Seen == nil {
+		w.state.Seen = map[string]map[string]string{}
+	}
+	return w, nil
+}
+
+// watchKey identifies one version of a blob, a re-upload under the same name counts as new
+func watchKey(blob fileSystem.BlobInfo) string {
+	return blob.Name + "@" + blob.LastModified.UTC().Format(time.RFC3339Nano)
+}
+
+// watchTaskID derives the ID of the task for one version of a blob under a rule. a task enqueued
+// again after a failed or unconfirmed send is the same task, and its ID is also the message ID, so
+// the broker's duplicate detection drops a resend that did go through
+func watchTaskID(ruleID string, blob fileSystem.BlobInfo) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(ruleID+"/"+watchKey(blob)+"/"+blob.ETag)).String()
+}
+
+// saveLocked writes the state atomically (temp file + rename), w.mu must be held
+func (w *Watcher) saveLocked() error {
+	return writeJSONFile(w.statePath, w.state)
+}
+
+func (w *Watcher) Rules() []WatchRule {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WatchRule{}, w.state.Rules...)
+}
+
+// AddRule registers a rule; blobs already under the prefix are marked as seen so only new arrivals are processed
+func (w *Watcher) AddRule(ctx context.Context, rule WatchRule) (WatchRule, error) {
+	blobs, err := w.fs.List(ctx)
+	if err != nil {
+		return WatchRule{}, err
+	}
+
+	rule.ID = uuid.New().String()
+	rule.CreatedAt = time.Now()
+
+	seen := map[string]string{}
+	for _, blob := range blobs {
+		if strings.HasPrefix(blob.Name, rule.Prefix) {
+			seen[watchKey(blob)] = watchEnqueued
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state.Rules = append(w.state.Rules, rule)
+	w.state.Seen[rule.ID] = seen
+	if err := w.saveLocked(); err != nil {
+		w.state.Rules = w.state.Rules[:len(w.state.Rules)-1]
+		delete(w.state.Seen, rule.ID)
+		return WatchRule{}, err
+	}
+	return rule, nil
+}
+
+func (w *Watcher) DeleteRule(id string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, rule := range w.state.Rules {
+		if rule.ID == id {
+			w.state.Rules = append(w.state.Rules[:i], w.state.Rules[i+1:]...)
+			delete(w.state.Seen, id)
+			return true, w.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// Run polls the input container until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Poll(ctx); err != nil {
+			log.Printf("watcher: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll diffs the container listing against the seen blobs of every rule and enqueues the new ones.
+// each blob is recorded as pending and persisted before its task is sent and marked enqueued after,
+// so a blob is never enqueued twice; only a crash between the two writes re-sends it on the next poll,
+// as the same task with the same message ID
+func (w *Watcher) Poll(ctx context.Context) error {
+	w.polling.Lock()
+	defer w.polling.Unlock()
+
+	blobs, err := w.fs.List(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list %s: %w", w.fs.ContainerName, err)
+	}
+
+	w.mu.Lock()
+
+	type pendingTask struct {
+		ruleID string
+		key    string
+		task   audioTypes.AudioTask
+		msg    serviceBus.Msg
+	}
+	pending := []pendingTask{}
+
+	for _, rule := range w.state.Rules {
+		seen := w.state.Seen[rule.ID]
+		if seen == nil {
+			seen = map[string]string{}
+			w.state.Seen[rule.ID] = seen
+		}
+
+		present := map[string]bool{}
+		for _, blob := range blobs {
+			if !strings.HasPrefix(blob.Name, rule.Prefix) {
+				continue
+			}
+			key := watchKey(blob)
+			present[key] = true
+			if seen[key] == watchEnqueued {
+				continue
+			}
+
+			seen[key] = watchPending
+			pipeline := append([]string{}, rule.AudioFunctionPipeline...)
+			task, _ := newAudioTask(rule.ClientID, blob.Name, pipeline, audioTypes.PriorityNormal, nil, "")
+			task.TaskID = watchTaskID(rule.ID, blob)
+			msg := taskMessage(task)
+			msg.MessageID = task.TaskID
+			log.Printf("watcher: rule %s picked up %s as task %s", rule.ID, blob.Name, task.TaskID)
+			pending = append(pending, pendingTask{ruleID: rule.ID, key: key, task: task, msg: msg})
+		}
+
+		// forget blobs that were deleted so the seen set doesn't grow forever
+		for key := range seen {
+			if !present[key] {
+				delete(seen, key)
+			}
+		}
+	}
+
+	err = w.saveLocked()
+	w.mu.Unlock()
+	if len(pending) == 0 || err != nil {
+		return err
+	}
+
+	// the broker is called without mu, so rules can be listed and changed meanwhile
+	var errs []error
+	enqueued := []pendingTask{}
+	for _, p := range pending {
+		if err := w.enqueue(p.task, p.msg); err != nil {
+			// leave it pending, the next poll retries
+			errs = append(errs, fmt.Errorf("could not enqueue %s: %w", p.key, err))
+			continue
+		}
+		enqueued = append(enqueued, p)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, p := range enqueued {
+		// the rule may have been deleted while its tasks were sent
+		if seen := w.state.Seen[p.ruleID]; seen != nil && seen[p.key] == watchPending {
+			seen[p.key] = watchEnqueued
+		}
+	}
+	if err := w.saveLocked(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+type WatchRuleRequest struct {
+	Prefix                string   `json:"prefix"`
+	ClientID              string   `json:"clientID"`
+	AudioFunctionPipeline []string `json:"audioFunctionPipeline"`
+}
+
+func (app *App) ListWatchRulesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(app.Watcher.Rules())
+	}
+}
+
+// validateWatchPrefix rejects prefixes no stored blob can start with. uploads and imports store flat,
+// sanitized names (drafts/a.wav is imported as drafts_a.wav), so a prefix containing "/" never matches
+func validateWatchPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if strings.ContainsAny(prefix, `/\`) {
+		return fmt.Errorf("prefix %q must not contain folders, blob names are flat (drafts/ files are imported as drafts_...)", prefix)
+	}
+	if sanitized, err := fileSystem.SanitizeFileName(prefix); err != nil || sanitized != prefix {
+		return fmt.Errorf("prefix %q can't start a stored blob name", prefix)
+	}
+	return nil
+}
+
+// CreateWatchRuleHandler adds a rule for new input blobs whose name starts with the prefix. the prefix
+// is matched against the flat names uploads and imports store, so it can't contain "/"
+func (app *App) CreateWatchRuleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req WatchRuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := validateWatchPrefix(req.Prefix); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.AudioFunctionPipeline) == 0 {
+			http.Error(w, "audioFunctionPipeline must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := app.Watcher.AddRule(r.Context(), WatchRule{
+			Prefix:                req.Prefix,
+			ClientID:              req.ClientID,
+			AudioFunctionPipeline: req.AudioFunctionPipeline,
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not create watch rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+	}
+}
+
+func (app *App) DeleteWatchRuleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		found, err := app.Watcher.DeleteRule(id)
+		if !found {
+			http.Error(w, "watch rule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not delete watch rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(fmt.Sprintf("%s deleted successfully", id))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	audioTypes "manic-compression/pkg/audio_types"
+	fileSystem "manic-compression/pkg/file_system"
+	serviceBus "manic-compression/pkg/service_bus"
+)
+
+// memoryBackend is a fileSystem.Backend over a map, enough for the watcher's listing
+type memoryBackend struct {
+	mu    sync.Mutex
+	blobs map[string]fileSystem.BlobInfo
+}
+
+func (mb *memoryBackend) Upload(ctx context.Context, container string, name string, r io.Reader, metadata map[string]string, cond fileSystem.UploadCondition) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.blobs[name] = fileSystem.BlobInfo{Name: name, Size: int64(len(data)), LastModified: time.Now(), ETag: time.Now().String()}
+	return nil
+}
+
+func (mb *memoryBackend) Download(ctx context.Context, container string, name string, offset int64, count int64, ifMatch string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(nil)), nil
+}
+
+func (mb *memoryBackend) Properties(ctx context.Context, container string, name string) (fileSystem.BlobProperties, error) {
+	return fileSystem.BlobProperties{}, errors.New("not implemented")
+}
+
+func (mb *memoryBackend) Copy(ctx context.Context, container string, src string, dst string, cond fileSystem.UploadCondition) error {
+	return errors.New("not implemented")
+}
+
+func (mb *memoryBackend) List(ctx context.Context, container string) ([]fileSystem.BlobInfo, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	blobs := []fileSystem.BlobInfo{}
+	for _, blob := range mb.blobs {
+		blobs = append(blobs, blob)
+	}
+	return blobs, nil
+}
+
+func (mb *memoryBackend) Delete(ctx context.Context, container string, name string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	delete(mb.blobs, name)
+	return nil
+}
+
+func TestWatcherRetriesTheSameTask(t *testing.T) {
+	fs := &fileSystem.FileSystem{Backend: &memoryBackend{blobs: map[string]fileSystem.BlobInfo{}}, ContainerName: "input"}
+	var w *Watcher
+	sent := []serviceBus.Msg{}
+	fail := true
+	w, err := NewWatcher(filepath.Join(t.TempDir(), "watch.json"), fs, func(task audioTypes.AudioTask, msg serviceBus.Msg) error {
+		// the watcher isn't locked while tasks are enqueued
+		if len(w.Rules()) != 1 {
+			t.Error("rule missing during the enqueue")
+		}
+		sent = append(sent, msg)
+		if fail {
+			fail = false
+			return errors.New("broker unavailable")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AddRule(context.Background(), WatchRule{Prefix: "hot_", ClientID: "client", AudioFunctionPipeline: []string{audioTypes.AudioFunctionWAVToMp3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.UploadFile(bytes.NewReader([]byte("audio")), "hot_a.wav"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Poll(context.Background()); err == nil {
+		t.Error("a failed enqueue wasn't reported")
+	}
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(sent))
+	}
+	if sent[0].MessageID == "" || sent[0].MessageID != sent[1].MessageID || sent[0].CorrelationID != sent[1].CorrelationID {
+		t.Errorf("the retry was sent as %s/%s, first as %s/%s", sent[1].MessageID, sent[1].CorrelationID, sent[0].MessageID, sent[0].CorrelationID)
+	}
+}
+
+func TestValidateWatchPrefix(t *testing.T) {
+	for prefix, ok := range map[string]bool{
+		"":        true,
+		"hot_":    true,
+		"drafts-": true,
+		"hot/":    false,
+		`hot\`:    false,
+		".hidden": false,
+		"a?":      false,
+	} {
+		if err := validateWatchPrefix(prefix); (err == nil) != ok {
+			t.Errorf("validateWatchPrefix(%q) = %v", prefix, err)
+		}
+	}
+}